@@ -0,0 +1,120 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultHost is the github host used when user has no host prefix
+const defaultHost = "github.com"
+
+// endpoint contains github host endpoints: web host, rest api url and git
+// ssh host
+type endpoint struct {
+	Host    string // Web host name, used as gh --hostname
+	APIURL  string // Rest api base url without trailing slash
+	GitHost string // Host used in git ssh url: git@<GitHost>:owner/repo.git
+
+	GitURL  string // Git base url used instead of ssh url if not empty
+	ListAPI bool   // List repositories with rest api instead of gh
+}
+
+// account is github user or organisation on some github host
+type account struct {
+	*endpoint
+	Name string
+}
+
+// String return account name with host prefix if host is not default
+func (a account) String() string {
+	if a.Host == defaultHost {
+		return a.Name
+	}
+	return a.Host + "/" + a.Name
+}
+
+// path return repository path relative to the output folder: the 'repo'
+// for github.com and 'host/repo' for other hosts
+func (a account) path(repo string) string {
+	if a.Host == defaultHost {
+		return repo
+	}
+	return a.Host + "/" + repo
+}
+
+// gitURL return ssh url of repository on account git host, or url with
+// endpoint git base url if it is set
+func (a account) gitURL(repo string) string {
+	if len(a.GitURL) != 0 {
+		return a.GitURL + "/" + repo + ".git"
+	}
+	return "git@" + a.GitHost + ":" + repo + ".git"
+}
+
+// newEndpoint create endpoint with default api url and git host for host:
+//
+//	github.com   -> https://api.github.com, github.com
+//	*.ghe.com    -> https://api.<host>, <host>
+//	other (GHES) -> https://<host>/api/v3, <host>
+func newEndpoint(host string) *endpoint {
+	e := &endpoint{Host: host, GitHost: host}
+	switch {
+	case host == defaultHost:
+		e.APIURL = "https://api.github.com"
+	case strings.HasSuffix(host, ".ghe.com"):
+		e.APIURL = "https://api." + host
+	default:
+		e.APIURL = "https://" + host + "/api/v3"
+	}
+	return e
+}
+
+// parseHosts parse -hosts parameter and return endpoints map by host name.
+// The parameter is semicolon separated list of host definitions, each
+// definition is comma separated host name and optional 'api=' and 'git='
+// overrides:
+//
+//	tenant.ghe.com,api=https://api.tenant.ghe.com,git=tenant.ghe.com
+func parseHosts(hostslist string) (hosts map[string]*endpoint, err error) {
+	hosts = map[string]*endpoint{defaultHost: newEndpoint(defaultHost)}
+	for _, def := range strings.Split(hostslist, ";") {
+		def = strings.TrimSpace(def)
+		if len(def) == 0 {
+			continue
+		}
+		fields := strings.Split(def, ",")
+		e := newEndpoint(strings.TrimSpace(fields[0]))
+		for _, f := range fields[1:] {
+			key, val, ok := strings.Cut(strings.TrimSpace(f), "=")
+			switch {
+			case ok && key == "api":
+				e.APIURL = strings.TrimSuffix(val, "/")
+			case ok && key == "git":
+				e.GitHost = val
+			default:
+				return nil, fmt.Errorf("wrong host parameter '%s' in '%s'", f, def)
+			}
+		}
+		hosts[e.Host] = e
+	}
+	return
+}
+
+// parseAccount parse user parameter in form [host/]name and return account.
+// Endpoints of unknown hosts are created with defaults and added to hosts map
+func parseAccount(user string, hosts map[string]*endpoint) account {
+	host, name := defaultHost, user
+	if i := strings.LastIndex(user, "/"); i >= 0 {
+		host, name = user[:i], user[i+1:]
+	}
+	e, ok := hosts[host]
+	if !ok {
+		e = newEndpoint(host)
+		hosts[host] = e
+	}
+	return account{endpoint: e, Name: name}
+}
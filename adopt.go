@@ -0,0 +1,267 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// adoptedRepo is repository found in existing backup folder
+type adoptedRepo struct {
+	dir     string // Found mirror or working clone .git folder
+	working bool   // Non-bare working clone
+	path    string // Repository path in current layout: [host/]owner/repo
+	fetched time.Time
+}
+
+// adoptCmd is 'adopt' command: scan existing backup folder created by older
+// versions or by hand, infer owners and repositories from origin urls or
+// folders, fill backup state with last fetch time of each repository, and
+// with -reorganize move mirrors to the current layout and convert working
+// clones to mirrors, so the existing backup is updated instead of re-cloned
+func adoptCmd(args []string) {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+	output := fs.String("output", "repos", "existing backup folder")
+	reorganize := fs.Bool("reorganize", false, "move mirrors to [host/]owner/repo.git layout and convert working clones to mirrors")
+	dryRun := fs.Bool("dry-run", false, "print found repositories and changes but does not change anything")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup adopt [-output folder] [-reorganize] [-dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if err := loadState(*output); err != nil {
+		logFatal(err)
+	}
+	repos, err := findAdoptable(*output)
+	if err != nil {
+		logFatal(err)
+	}
+
+	var adopted, moved, skipped int
+	for _, r := range repos {
+		current := filepath.Join(*output, filepath.FromSlash(r.path)+".git")
+		inPlace := !r.working && r.dir == current
+		switch {
+		case inPlace:
+			fmt.Printf("adopt   %s\n", r.path)
+		case !*reorganize:
+			fmt.Printf("skip    %s: %s is not in current layout, use "+
+				"-reorganize\n", r.path, r.dir)
+			skipped++
+			continue
+		case r.working:
+			fmt.Printf("convert %s: working clone %s\n", r.path, r.dir)
+		default:
+			fmt.Printf("move    %s: %s\n", r.path, r.dir)
+		}
+		if *dryRun {
+			adopted++
+			continue
+		}
+
+		if !inPlace {
+			if err := reorganizeRepo(r, current); err != nil {
+				logError(fmt.Sprintf("%s: %s", r.path, err),
+					append(repoFields(r.path), "error", err)...)
+				skipped++
+				continue
+			}
+			moved++
+		}
+		if err := adoptMirror(current); err != nil {
+			logError(fmt.Sprintf("%s: %s", r.path, err),
+				append(repoFields(r.path), "error", err)...)
+		}
+		if prev, ok := state.Repos[r.path]; !ok || prev.Before(r.fetched) {
+			state.Repos[r.path] = r.fetched
+		}
+		adopted++
+	}
+
+	fmt.Printf("\n%d repositories adopted, %d reorganized, %d skipped\n",
+		adopted, moved, skipped)
+	if *dryRun || adopted == 0 {
+		return
+	}
+	// Keep last run time of existing state, adopt is not a backup run
+	if lastRun := state.LastRun; !lastRun.IsZero() {
+		runStart = lastRun
+	}
+	if err := saveState(*output); err != nil {
+		logFatal(err)
+	}
+	fmt.Println("backup state saved:", stateFile(*output))
+}
+
+// findAdoptable find mirrors and working clones in output folder. Snapshots
+// folders, object stores and backup state folder are skipped
+func findAdoptable(output string) (repos []adoptedRepo, err error) {
+	snapshots := map[string]bool{}
+	list, _ := listSnapshots(output)
+	for _, s := range list {
+		snapshots[filepath.Join(output, s.Name)] = true
+	}
+	err = filepath.Walk(output, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if snapshots[p] || filepath.Base(p) == ".github-backup" {
+			return filepath.SkipDir
+		}
+
+		var r adoptedRepo
+		switch {
+		case isGitDir(filepath.Join(p, ".git")):
+			r = adoptedRepo{dir: p, working: true}
+		case strings.HasSuffix(p, ".git") && isGitDir(p):
+			r = adoptedRepo{dir: p}
+		default:
+			return nil
+		}
+		gitDir := r.dir
+		if r.working {
+			gitDir = filepath.Join(r.dir, ".git")
+		}
+		r.path = inferRepoPath(output, r.dir, remoteURL(gitDir))
+		r.fetched = lastFetch(gitDir)
+		repos = append(repos, r)
+		return filepath.SkipDir
+	})
+	return
+}
+
+// isGitDir return true if folder is git repository folder
+func isGitDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "objects"))
+	return err == nil
+}
+
+// remoteURL return origin url of git folder
+func remoteURL(gitDir string) string {
+	out, err := exec.Command("git", "--git-dir", gitDir, "config",
+		"remote.origin.url").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// inferRepoPath return repository path [host/]owner/repo in current layout
+// from origin url (git@host:owner/repo.git, ssh://git@host/owner/repo.git or
+// https://host/owner/repo.git), or from folder path relative to output
+// folder if origin url is not github-like
+func inferRepoPath(output, dir, url string) string {
+	host, repo := parseRemoteURL(url)
+	if len(repo) == 0 {
+		rel, _ := filepath.Rel(output, dir)
+		parts := strings.Split(strings.TrimSuffix(filepath.ToSlash(rel),
+			".git"), "/")
+		if len(parts) > 2 {
+			host = strings.Join(parts[:len(parts)-2], "/")
+			parts = parts[len(parts)-2:]
+		}
+		repo = strings.Join(parts, "/")
+	}
+	if len(host) == 0 {
+		host = defaultHost
+	}
+	return account{endpoint: &endpoint{Host: host}}.path(repo)
+}
+
+// parseRemoteURL return host and owner/repo of github-like remote url, or
+// empty strings if url is not github-like
+func parseRemoteURL(url string) (host, repo string) {
+	var rest string
+	switch {
+	case strings.Contains(url, "://"):
+		scheme, r, _ := strings.Cut(url, "://")
+		if scheme == "file" {
+			return
+		}
+		host, rest, _ = strings.Cut(r, "/")
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+		host, _, _ = strings.Cut(host, ":")
+	case strings.Contains(url, ":"):
+		host, rest, _ = strings.Cut(url, ":")
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			host = host[i+1:]
+		}
+	default:
+		return
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(rest, "/"), ".git"),
+		"/")
+	if len(host) == 0 || len(parts) != 2 {
+		return "", ""
+	}
+	return host, strings.Join(parts, "/")
+}
+
+// lastFetch return time of last fetch of git folder: FETCH_HEAD, packed-refs
+// or folder modification time
+func lastFetch(gitDir string) time.Time {
+	for _, name := range []string{"FETCH_HEAD", "packed-refs", "refs"} {
+		if info, err := os.Stat(filepath.Join(gitDir, name)); err == nil {
+			return info.ModTime().UTC()
+		}
+	}
+	info, err := os.Stat(gitDir)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime().UTC()
+}
+
+// reorganizeRepo move mirror to current layout path, or convert working
+// clone to mirror at current layout path. The working clone is kept, the
+// mirror objects are hardlinked to it
+func reorganizeRepo(r adoptedRepo, current string) error {
+	if _, err := os.Stat(current); err == nil {
+		return fmt.Errorf("%s already exists", current)
+	}
+	if err := os.MkdirAll(filepath.Dir(current), 0755); err != nil {
+		return err
+	}
+	if !r.working {
+		return os.Rename(r.dir, current)
+	}
+	url := remoteURL(filepath.Join(r.dir, ".git"))
+	if err := run("git", "clone", "-q", "--mirror", r.dir, current); err != nil {
+		return err
+	}
+	if len(url) == 0 {
+		return nil
+	}
+	return run("git", "-C", current, "remote", "set-url", "origin", url)
+}
+
+// adoptMirror set mirror configuration of adopted mirror: mirror remote and
+// refspecs of all refs, so the mirror is updated like a cloned one
+func adoptMirror(mirror string) error {
+	if run("git", "-C", mirror, "config", "remote.origin.url") != nil {
+		return fmt.Errorf("origin remote is not set")
+	}
+	if err := run("git", "-C", mirror, "config", "remote.origin.mirror",
+		"true"); err != nil {
+		return err
+	}
+	return setRefspecs(mirror, nil)
+}
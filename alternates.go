@@ -0,0 +1,154 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// objectStoresDir is folder of fork families shared object stores relative
+// to the output folder
+const objectStoresDir = ".github-backup/objects"
+
+// Fork alternates flag set by -fork-alternates parameter, and object stores
+// used in this run (paths relative to the output folder)
+var forkAlternates bool
+var usedStores = map[string]bool{}
+
+// objectStore return shared object store (path relative to output folder) of
+// repository fork family named by the family root repository. Forks always
+// use the store, other repositories use the store if it was created by their
+// forks. Returns empty string if store is not used
+func objectStore(acc account, repo, output string) (store string, err error) {
+	root := repo
+	a, ok := repoAttrs[acc.path(repo)]
+	if !ok || a.Fork {
+		var data struct {
+			Fork   bool `json:"fork"`
+			Source struct {
+				FullName string `json:"full_name"`
+			} `json:"source"`
+		}
+		err = newAPIClient(acc.endpoint).get("/repos/"+repo, &data)
+		if err != nil {
+			return
+		}
+		if data.Fork && len(data.Source.FullName) != 0 {
+			root = data.Source.FullName
+		}
+	}
+	store = objectStoresDir + "/" + acc.path(root) + ".git"
+	if root == repo {
+		if _, serr := os.Stat(filepath.Join(output, store)); serr != nil {
+			store = ""
+		}
+	}
+	return
+}
+
+// addToStore fetch mirror refs and objects to shared object store under
+// refs/members/<path>/ namespace, set the store as mirror alternate object
+// database and remove mirror objects which exist in the store. Refs of the
+// store are never pruned, so objects used by mirrors of older snapshots are
+// kept
+func addToStore(output, store, mirror, path string) error {
+	storeDir := filepath.Join(output, store)
+	if _, err := os.Stat(filepath.Join(storeDir, "HEAD")); err != nil {
+		if err := run("git", "init", "-q", "--bare", storeDir); err != nil {
+			return err
+		}
+	}
+	// The mirror path should be absolute, git -C resolves relative path from
+	// the store folder
+	abs, err := filepath.Abs(mirror)
+	if err != nil {
+		return err
+	}
+	if err := run("git", "-C", storeDir, "fetch", "-q", "--no-tags", abs,
+		"+refs/*:refs/members/"+path+"/*"); err != nil {
+		return err
+	}
+	if err := setAlternate(mirror, storeDir); err != nil {
+		return err
+	}
+	return run("git", "-C", mirror, "repack", "-a", "-d", "-l", "-q")
+}
+
+// setAlternate add store objects folder to mirror alternates with path
+// relative to mirror objects folder, so output folder may be moved or copied
+func setAlternate(mirror, storeDir string) error {
+	objects := filepath.Join(mirror, "objects")
+	rel, err := filepath.Rel(objects, filepath.Join(storeDir, "objects"))
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(objects, "info", "alternates")
+	data, _ := os.ReadFile(name)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == rel {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, []byte(rel+"\n")...), 0644)
+}
+
+// forkReference set fork family object store of job and return the store
+// folder to clone mirror with as reference, or empty string if the store is
+// not used or doesn't exist yet
+func forkReference(j *pipelineJob) string {
+	var err error
+	if j.store, err = objectStore(j.acc, j.repo, j.dir); err != nil {
+		logWarn(fmt.Sprintf("%s: can't get fork family object store: %s",
+			j.repo, err), append(repoFields(j.repo), "error", err)...)
+		return ""
+	}
+	if len(j.store) == 0 {
+		return ""
+	}
+	reference := filepath.Join(j.dir, j.store)
+	if _, err := os.Stat(filepath.Join(reference, "HEAD")); err != nil {
+		return ""
+	}
+	return reference
+}
+
+// alternatesStage add repository mirror to fork family shared object store
+func alternatesStage(j *pipelineJob) error {
+	if len(j.store) == 0 {
+		return nil
+	}
+	err := addToStore(j.dir, j.store, filepath.Join(j.dir, j.path+".git"),
+		j.acc.path(j.repo))
+	if err != nil {
+		return err
+	}
+	usedStores[j.store] = true
+	return nil
+}
+
+// putStores copy object stores used in this run to destinations, mirrors
+// copied to destinations refer to it
+func putStores(output string) error {
+	var stores []string
+	for store := range usedStores {
+		stores = append(stores, store)
+	}
+	sort.Strings(stores)
+	return putDests(output, stores)
+}
+
+// isObjectStore return true if mirror is shared object store
+func isObjectStore(output, mirror string) bool {
+	rel, err := filepath.Rel(output, mirror)
+	return err == nil && strings.HasPrefix(filepath.ToSlash(rel),
+		objectStoresDir+"/")
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAddToStore(t *testing.T) {
+	m := newTestGitHub(t)
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"relative output", "repos"},
+		{"absolute output", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			chdir(t, dir)
+			output := tt.output
+			if len(output) == 0 {
+				output = filepath.Join(dir, "abs")
+			}
+			path := filepath.Join("octo", "alpha")
+			mirrorRemote(t, m, "octo/alpha", output, path)
+			store := objectStoresDir + "/octo/alpha.git"
+			mirror := filepath.Join(output, path+".git")
+			if err := addToStore(output, store, mirror,
+				"octo/alpha"); err != nil {
+				t.Fatal(err)
+			}
+			if headTip(mirror) != m.remoteTip("octo/alpha") {
+				t.Error("mirror tip mismatch")
+			}
+			if err := run("git", "-C", mirror, "fsck", "--connectivity-only",
+				"--no-progress"); err != nil {
+				t.Fatal(err)
+			}
+			refs := mirrorRefs(filepath.Join(output, store))
+			if len(refs["refs/members/octo/alpha/heads/master"]) == 0 &&
+				len(refs["refs/members/octo/alpha/heads/main"]) == 0 {
+				t.Errorf("mirror refs are not fetched to store: %v", refs)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// apiClient is github rest api client of one host endpoint
+type apiClient struct {
+	*endpoint
+	token string
+	rate  apiRateLimit
+}
+
+// apiClients contains created api clients by host name
+var apiClients = struct {
+	sync.Mutex
+	m map[string]*apiClient
+}{m: map[string]*apiClient{}}
+
+// newAPIClient return api client of endpoint. The token is taken from
+// GH_TOKEN or GITHUB_TOKEN environment variables for github.com,
+// GH_ENTERPRISE_TOKEN or GITHUB_ENTERPRISE_TOKEN for other hosts, or from
+// the 'gh auth token' output if the variables are empty
+func newAPIClient(e *endpoint) *apiClient {
+	apiClients.Lock()
+	defer apiClients.Unlock()
+
+	if c, ok := apiClients.m[e.Host]; ok {
+		return c
+	}
+
+	vars := []string{"GH_TOKEN", "GITHUB_TOKEN"}
+	if e.Host != defaultHost {
+		vars = []string{"GH_ENTERPRISE_TOKEN", "GITHUB_ENTERPRISE_TOKEN"}
+	}
+	var token string
+	for _, v := range vars {
+		if token = os.Getenv(v); len(token) != 0 {
+			break
+		}
+	}
+	if len(token) == 0 {
+		out, err := exec.Command("gh", "auth", "token", "--hostname",
+			e.Host).Output()
+		if err == nil {
+			token = strings.TrimSpace(string(out))
+		}
+	}
+
+	c := &apiClient{endpoint: e, token: token}
+	apiClients.m[e.Host] = c
+	return c
+}
+
+// newRequest create api request to endpoint with accept, user agent and
+// authorization headers. The endpoint is relative to rest api base url or
+// absolute url
+func (c *apiClient) newRequest(method, endpoint string) (*http.Request, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = c.APIURL + endpoint
+	}
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", userAgent())
+	if len(c.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// get execute api GET request to endpoint and unmarshal json response to v.
+// Transient failures are retried
+func (c *apiClient) get(endpoint string, v interface{}) error {
+	var body []byte
+	err := retry("api "+endpoint, func() (err error) {
+		body, err = c.getBody(endpoint)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("can't parse response body to json: %s\n%s", err,
+			string(body))
+	}
+	return nil
+}
+
+// send execute api request with json body of data to endpoint and unmarshal
+// json response to v if it is not nil. Transient failures are retried
+func (c *apiClient) send(method, endpoint string, data, v interface{}) error {
+	return c.sendJSON(method, endpoint, data, v, true)
+}
+
+// create execute api POST request creating item with json body of data and
+// unmarshal json response to v if it is not nil. The request is not retried:
+// transient failure (e.g. gateway timeout) may happen after the item is
+// created, and the retried request would create duplicate item
+func (c *apiClient) create(endpoint string, data, v interface{}) error {
+	return c.sendJSON(http.MethodPost, endpoint, data, v, false)
+}
+
+// sendJSON execute api request with json body of data to endpoint and
+// unmarshal json response to v if it is not nil. Transient failures are
+// retried if retried is true
+func (c *apiClient) sendJSON(method, endpoint string, data, v interface{},
+	retried bool) error {
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	op := func() error {
+		req, err := c.newRequest(method, endpoint)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Body = io.NopCloser(bytes.NewReader(payload))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(payload)), nil
+		}
+		req.ContentLength = int64(len(payload))
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			return &apiError{resp.StatusCode, fmt.Sprintf("%s %s: %s\n%s",
+				req.Method, req.URL, resp.Status, string(body))}
+		}
+		return nil
+	}
+	if retried {
+		err = retry("api "+method+" "+endpoint, op)
+	} else {
+		err = op()
+	}
+	if err != nil || v == nil || len(bytes.TrimSpace(body)) == 0 {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("can't parse response body to json: %s\n%s", err,
+			string(body))
+	}
+	return nil
+}
+
+// getBody execute api GET request to endpoint and return response body. The
+// responses with ETag are cached and the next requests are conditional
+func (c *apiClient) getBody(endpoint string) ([]byte, error) {
+	if err := chaosAPI(endpoint); err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest("GET", endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Conditional request with cached response ETag, not modified response
+	// doesn't count against rate limit
+	url := req.URL.String()
+	cached := c.cached(url)
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.Body, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		c.cache(url, resp.Header.Get("ETag"), body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &apiError{resp.StatusCode, fmt.Sprintf("%s %s: %s\n%s",
+			req.Method, req.URL, resp.Status, string(body))}
+	}
+	return body, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Folder of api responses cache, the cache is disabled if empty
+var apiCacheDir string
+
+// apiCacheEntry is cached api response with its ETag
+type apiCacheEntry struct {
+	URL  string          `json:"url"`
+	ETag string          `json:"etag"`
+	Body json.RawMessage `json:"body"`
+}
+
+// setAPICache set api responses cache folder in output folder
+func setAPICache(output string) {
+	apiCacheDir = filepath.Join(output, ".github-backup", "api-cache")
+}
+
+// cacheFile return cache file name of api url requested with token. The
+// token is part of the key, so responses of different tokens are not mixed
+func (c *apiClient) cacheFile(url string) string {
+	sum := sha256.Sum256([]byte(c.token + "\n" + url))
+	return filepath.Join(apiCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// cached return cached response of api url, or nil if it is not cached
+func (c *apiClient) cached(url string) *apiCacheEntry {
+	if len(apiCacheDir) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(c.cacheFile(url))
+	if err != nil {
+		return nil
+	}
+	var e apiCacheEntry
+	if json.Unmarshal(data, &e) != nil || e.URL != url {
+		return nil
+	}
+	return &e
+}
+
+// cache save api url response with ETag to cache
+func (c *apiClient) cache(url, etag string, body []byte) {
+	if len(apiCacheDir) == 0 || len(etag) == 0 || !json.Valid(body) {
+		return
+	}
+	data, err := json.Marshal(apiCacheEntry{url, etag, body})
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(apiCacheDir, 0700); err != nil {
+		return
+	}
+	name := c.cacheFile(url)
+	if os.WriteFile(name+".tmp", data, 0600) == nil {
+		os.Rename(name+".tmp", name)
+	}
+}
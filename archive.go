@@ -0,0 +1,457 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats
+const (
+	formatMirror  = "mirror"  // Bare mirror repositories
+	formatArchive = "archive" // Mirror repositories packed to tar archive
+	formatBundle  = "bundle"  // Git bundle of mirror repositories
+)
+
+// Archive compressions
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// Output formats selected by -format parameter, the format is the first of
+// them
+var format = formatMirror
+var formats = []string{formatMirror}
+
+// parseFormats set output formats from comma separated list. All formats are
+// produced from one fetch of each repository
+func parseFormats(list string) error {
+	formats = nil
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case f != formatMirror && f != formatArchive && f != formatBundle:
+			return fmt.Errorf("wrong output format '%s'", f)
+		case hasFormat(f):
+			return fmt.Errorf("output format '%s' is duplicated", f)
+		}
+		formats = append(formats, f)
+	}
+	format = formats[0]
+	return nil
+}
+
+// hasFormat return true if output format is selected
+func hasFormat(f string) bool {
+	for _, s := range formats {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
+
+// packaged return true if mirrors are packed to archives or bundles
+func packaged() bool {
+	return hasFormat(formatArchive) || hasFormat(formatBundle)
+}
+
+// Archive compression and compression level selected by -compress and
+// -compress-level parameters, level 0 is default level of compression
+var compress = compressGzip
+var compressLevel int
+
+// checkCompress check compression and compression level parameters
+func checkCompress() error {
+	switch {
+	case compress != compressGzip && compress != compressZstd:
+		return fmt.Errorf("wrong compression '%s'", compress)
+	case compress == compressGzip && (compressLevel < 0 || compressLevel > 9),
+		compress == compressZstd && (compressLevel < 0 || compressLevel > 22):
+		return fmt.Errorf("wrong %s compression level %d", compress,
+			compressLevel)
+	}
+	return nil
+}
+
+// archiveName return archive path of repository relative to the output folder:
+// owner/repo-YYYYMMDD.tar.gz or owner/repo-YYYYMMDD.tar.zst
+func archiveName(path string, t time.Time) string {
+	ext := ".tar.gz"
+	if compress == compressZstd {
+		ext = ".tar.zst"
+	}
+	return path + "-" + t.Format("20060102") + ext + encryptExt()
+}
+
+// newCompressor return writer which compress data to w with selected
+// compression
+func newCompressor(w io.Writer) (io.WriteCloser, error) {
+	if compress == compressZstd {
+		return newZstdWriter(w)
+	}
+	level := compressLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// newZstdWriter start 'zstd' cli application compressing data to w using all
+// cpu cores
+func newZstdWriter(w io.Writer) (*cmdWriter, error) {
+	args := []string{"-q", "-c", "-T0"}
+	if compressLevel > 19 {
+		args = append(args, "--ultra")
+	}
+	if compressLevel > 0 {
+		args = append(args, "-"+strconv.Itoa(compressLevel))
+	}
+	return newCmdWriter(w, "zstd", args...)
+}
+
+// cmdWriter is writer to standard input of command which write its standard
+// output to other writer
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// newCmdWriter start command with standard output to w
+func newCmdWriter(w io.Writer, name string, args ...string) (c *cmdWriter,
+	err error) {
+
+	c = &cmdWriter{cmd: exec.Command(name, args...)}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = os.Stderr
+	if c.WriteCloser, err = c.cmd.StdinPipe(); err != nil {
+		return
+	}
+	err = c.cmd.Start()
+	return
+}
+
+// Close close command input and wait until command output is written
+func (c *cmdWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+// archiveRepo pack repository mirror, its wiki and other repository files to
+// compressed tar archive. The path is repository path relative to dir folder, paths
+// are mirrors folders and files relative to dir folder. Returns archive path relative to dir folder
+func archiveRepo(dir, path string, paths []string) (name string, err error) {
+	name = archiveName(path, time.Now())
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	ew, err := newEncryptor(f)
+	if err != nil {
+		return
+	}
+	cw, err := newCompressor(ew)
+	if err != nil {
+		return
+	}
+	tw := tar.NewWriter(cw)
+	for _, p := range paths {
+		if err = tarDir(tw, filepath.Join(dir, p), filepath.Base(p)); err != nil {
+			return
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	if err = cw.Close(); err != nil {
+		return
+	}
+	err = ew.Close()
+	return
+}
+
+// tarDir write folder content to tar writer with prefix folder name. The
+// archive is portable: PAX format keeps modification times with sub-second
+// precision, permissions are normalized to owner writable and the executable
+// bits, owners are not saved, and symlinks targets are saved with slashes
+func tarDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			link = filepath.ToSlash(link)
+		case !mode.IsRegular() && !mode.IsDir():
+			// Sockets, pipes and devices are not part of repositories
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		hdr.Format = tar.FormatPAX
+		hdr.Mode = portableMode(info)
+		hdr.ModTime = info.ModTime()
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// portableMode return tar permissions of file which don't depend on
+// platform and umask: 0755 for folders and executable files, 0777 for
+// symlinks, 0644 or 0444 (read-only git objects) for other files
+func portableMode(info os.FileInfo) int64 {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir(), mode&0111 != 0 && mode.IsRegular():
+		return 0755
+	case mode&os.ModeSymlink != 0:
+		return 0777
+	case mode&0200 == 0:
+		return 0444
+	}
+	return 0644
+}
+
+// extractArchive extract not encrypted repository archive to dir folder,
+// restoring folders, files permissions, symlinks and modification times.
+// Entries written through symlinks and symlinks pointing outside of the
+// folder are refused
+func extractArchive(name, dir string) error {
+	dir = filepath.Clean(dir)
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, closeReader, err := archiveReader(name, f)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	// Folders modification times are set after its content is extracted
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		parent := filepath.Dir(p)
+		if hdr.Typeflag == tar.TypeDir {
+			parent = p
+		}
+		if err := checkSymlinks(dir, parent); err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			os.Chmod(p, mode|0700)
+			dirs = append(dirs, dirTime{p, hdr.ModTime})
+			continue
+		case tar.TypeReg:
+			if err := extractFile(tr, p, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(target) {
+				return fmt.Errorf("%s: absolute symlink %s", hdr.Name,
+					hdr.Linkname)
+			}
+			if !inFolder(dir, filepath.Join(filepath.Dir(p), target)) {
+				return fmt.Errorf("%s: symlink %s points outside of folder",
+					hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			os.Remove(p)
+			if err := os.Symlink(target, p); err != nil {
+				return err
+			}
+			continue
+		default:
+			continue
+		}
+		if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// extractPath return local path of archive entry in dir folder, entries
+// outside of the folder are refused
+func extractPath(dir, name string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if filepath.IsAbs(rel) || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+		strings.Contains(rel, string(filepath.Separator)+".."+
+			string(filepath.Separator)) {
+		return "", fmt.Errorf("wrong archive entry %s", name)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// inFolder return true if path p is dir folder or inside of it
+func inFolder(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkSymlinks return error if folder p or any of its parent folders inside
+// dir folder is symlink, so archive entries can't be written through
+// symlinks extracted before
+func checkSymlinks(dir, p string) error {
+	for ; p != dir && inFolder(dir, p); p = filepath.Dir(p) {
+		info, err := os.Lstat(p)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(dir, p)
+			return fmt.Errorf("archive entry is written through symlink %s",
+				filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+// extractFile write archive entry content to file with permissions
+func extractFile(r io.Reader, name string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	os.Remove(name)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0200)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// Restore read-only permissions after the content is written
+	return os.Chmod(name, mode)
+}
+
+// archiveReader return decompressed reader of archive file by archive name
+// extension and function which releases the reader
+func archiveReader(name string, f io.Reader) (io.Reader, func(), error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case strings.HasSuffix(name, ".tar.zst"):
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = f
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, nil, err
+		}
+		return out, func() { out.Close(); cmd.Wait() }, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported archive %s, encrypted archives "+
+		"should be decrypted first", name)
+}
+
+// extractCmd is 'extract' command: extract repository archives to folder
+// restoring permissions, symlinks and modification times on any platform
+func extractCmd(args []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	output := fs.String("output", ".", "folder to extract archives to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup extract [-output folder] archive...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, name := range fs.Args() {
+		if err := extractArchive(name, *output); err != nil {
+			logFatal(name+": ", err)
+		}
+		logInfo("extracted: "+name, "archive", name)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	m := newTestGitHub(t)
+	defer func(c string) { compress = c }(compress)
+	compress = compressGzip
+
+	tests := []struct {
+		name  string
+		repo  string
+		setup func(mirror string) error
+	}{
+		{"mirror", "octo/alpha", nil},
+		{"wiki", "octo/alpha.wiki", nil},
+		{"symlink", "octo/beta", func(mirror string) error {
+			return os.Symlink("description", filepath.Join(mirror,
+				"description.link"))
+		}},
+		{"executable hook", "octo/beta", func(mirror string) error {
+			return os.WriteFile(filepath.Join(mirror, "hooks", "post-update"),
+				[]byte("#!/bin/sh\n"), 0755)
+		}},
+		{"read-only file", "octo/alpha", func(mirror string) error {
+			return os.Chmod(filepath.Join(mirror, "description"), 0444)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.FromSlash(tt.repo)
+			mirrorRemote(t, m, tt.repo, dir, path)
+			mirror := filepath.Join(dir, path+".git")
+			if tt.setup != nil {
+				if err := tt.setup(mirror); err != nil {
+					t.Fatal(err)
+				}
+			}
+			old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := os.Chtimes(filepath.Join(mirror, "config"), old,
+				old); err != nil {
+				t.Fatal(err)
+			}
+
+			name, err := archiveRepo(dir, path, []string{path + ".git"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted := t.TempDir()
+			if err := extractArchive(filepath.Join(dir, name),
+				extracted); err != nil {
+				t.Fatal(err)
+			}
+			err = compareTrees(mirror, filepath.Join(extracted,
+				filepath.Base(path)+".git"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// tarEntry is entry of test archive
+type tarEntry struct {
+	name string
+	typ  byte
+	link string
+}
+
+// writeTestArchive write tar.gz archive with entries to file
+func writeTestArchive(t *testing.T, name string, entries []tarEntry) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link,
+			Mode: 0644, ModTime: time.Now()}
+		var data []byte
+		if e.typ == tar.TypeReg {
+			data = []byte("data\n")
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		err     string
+	}{
+		{"parent entry", []tarEntry{
+			{"../x", tar.TypeReg, ""},
+		}, "wrong archive entry"},
+		{"absolute symlink", []tarEntry{
+			{"a", tar.TypeSymlink, "/etc"},
+		}, "absolute symlink"},
+		{"relative symlink outside", []tarEntry{
+			{"repo.git/a", tar.TypeSymlink, "../../.."},
+		}, "points outside"},
+		{"write through symlink", []tarEntry{
+			{"repo.git/a", tar.TypeSymlink, "b"},
+			{"repo.git/b/", tar.TypeDir, ""},
+			{"repo.git/a/x", tar.TypeReg, ""},
+		}, "written through symlink"},
+		{"folder through symlink", []tarEntry{
+			{"repo.git/b/", tar.TypeDir, ""},
+			{"repo.git/a", tar.TypeSymlink, "b"},
+			{"repo.git/a/", tar.TypeDir, ""},
+		}, "written through symlink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "test.tar.gz")
+			writeTestArchive(t, name, tt.entries)
+			target := filepath.Join(dir, "target")
+			err := extractArchive(name, target)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, expected %q", err, tt.err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "x")); err == nil {
+				t.Error("file is written outside of target folder")
+			}
+		})
+	}
+}
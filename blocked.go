@@ -0,0 +1,171 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Reasons of repository block by github
+const (
+	blockDMCA     = "dmca"     // DMCA takedown
+	blockLegal    = "legal"    // Other legal restriction, e.g. government request
+	blockDisabled = "disabled" // Access disabled by github staff
+)
+
+// blockPatterns is github responses of blocked repositories: git remote
+// messages and api errors, matched in order
+var blockPatterns = []struct{ pattern, reason string }{
+	{"dmca takedown", blockDMCA},
+	{`"reason":"dmca"`, blockDMCA},
+	{"repository access blocked", blockLegal},
+	{"unavailable for legal reasons", blockLegal},
+	{"returned error: 451", blockLegal},
+	{"access to this repository has been disabled", blockDisabled},
+	{"this repository has been disabled", blockDisabled},
+}
+
+// blockedRepo is blocked repository saved in backup state
+type blockedRepo struct {
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+	Since     time.Time `json:"since"`     // First run the block detected
+	LastGood  time.Time `json:"last_good"` // Last successful backup
+	Preserved bool      `json:"preserved"` // Last good mirror is kept
+}
+
+// blockedName is file flagging preserved mirror of blocked repository
+const blockedName = "BLOCKED"
+
+// blockReason return reason of repository block if error is github DMCA or
+// legal block response, or empty string
+func blockReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range blockPatterns {
+		if strings.Contains(msg, p.pattern) {
+			return p.reason
+		}
+	}
+	var e *apiError
+	if errors.As(err, &e) && e.code == http.StatusUnavailableForLegalReasons {
+		return blockLegal
+	}
+	return ""
+}
+
+// blockMessage return first github message line of block error
+func blockMessage(err error) string {
+	for _, line := range strings.Split(err.Error(), "\n") {
+		l := strings.ToLower(line)
+		for _, p := range blockPatterns {
+			if strings.Contains(l, p.pattern) {
+				return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(
+					line), "remote:"))
+			}
+		}
+	}
+	return firstLine(err.Error())
+}
+
+// markBlocked classify failed repository backup blocked by github: keep last
+// good mirror (restored from previous snapshot in snapshot mode), flag it with
+// BLOCKED file and save the block to backup state, so the mirror is not
+// pruned
+func markBlocked(j *pipelineJob, r *repoResult, reason string, err error) {
+	path := j.acc.path(j.repo)
+	b := state.Blocked[path]
+	if b == nil {
+		b = &blockedRepo{Since: runStart.UTC()}
+		state.Blocked[path] = b
+	}
+	b.Reason, b.Message, b.LastGood = reason, blockMessage(err), state.Repos[path]
+	r.Blocked = reason
+
+	mirror := filepath.Join(j.dir, filepath.FromSlash(j.path)+".git")
+	if _, serr := os.Stat(filepath.Join(mirror, "HEAD")); serr != nil &&
+		len(prevSnapshot) != 0 {
+		prev := filepath.Join(j.dir, prevSnapshot, filepath.FromSlash(path)+".git")
+		if _, perr := os.Stat(filepath.Join(prev, "HEAD")); perr == nil {
+			os.RemoveAll(mirror)
+			if rerr := restoreBlocked(j.acc, j.repo, prev, mirror); rerr != nil {
+				logError(fmt.Sprintf("%s: can't restore mirror of previous "+
+					"snapshot: %s", j.repo, rerr), repoFields(j.repo)...)
+			}
+		}
+	}
+	_, serr := os.Stat(filepath.Join(mirror, "HEAD"))
+	b.Preserved = serr == nil
+	if b.Preserved {
+		flag := fmt.Sprintf("Repository is blocked by github: %s\n%s\n"+
+			"Blocked since: %s\nLast good backup: %s\n", reason, b.Message,
+			b.Since.Format(time.RFC3339), b.LastGood.UTC().Format(time.RFC3339))
+		os.WriteFile(filepath.Join(mirror, blockedName), []byte(flag), 0644)
+		r.Refs, r.Tip = mirrorRefs(mirror), headTip(mirror)
+		r.Files = []string{j.path + ".git"}
+		r.Size = filesSize(j.dir, r.Files)
+	}
+	logWarn(fmt.Sprintf("%s: blocked by github (%s), last good mirror "+
+		"preserved: %t", j.repo, reason, b.Preserved),
+		append(repoFields(j.repo), "reason", reason)...)
+}
+
+// restoreBlocked clone last good mirror of blocked repository from previous
+// snapshot with hardlinked objects
+func restoreBlocked(acc account, repo, prev, mirror string) error {
+	if err := os.MkdirAll(filepath.Dir(mirror), 0755); err != nil {
+		return err
+	}
+	if err := run("git", "clone", "-q", "--mirror", "--local", prev,
+		mirror); err != nil {
+		return err
+	}
+	return run("git", "-C", mirror, "remote", "set-url", "origin",
+		acc.gitURL(repo))
+}
+
+// clearBlocked remove block of repository backed up successfully again
+func clearBlocked(j *pipelineJob) {
+	path := j.acc.path(j.repo)
+	if _, ok := state.Blocked[path]; !ok {
+		return
+	}
+	delete(state.Blocked, path)
+	os.Remove(filepath.Join(j.dir, filepath.FromSlash(j.path)+".git",
+		blockedName))
+	logInfo(fmt.Sprintf("%s: repository is not blocked anymore", j.repo),
+		repoFields(j.repo)...)
+}
+
+// blockedSummary return list of repositories blocked in this run with block
+// reason, message and last good backup
+func blockedSummary() string {
+	var b strings.Builder
+	for _, r := range results {
+		if len(r.Blocked) == 0 {
+			continue
+		}
+		s := state.Blocked[r.Path]
+		if s == nil {
+			continue
+		}
+		preserved := "last good mirror preserved"
+		if !s.Preserved {
+			preserved = "no local mirror"
+		}
+		fmt.Fprintf(&b, "%s: %s since %s, %s, last good backup %s\n  %s\n",
+			r.Path, s.Reason, s.Since.Format("2006-01-02"), preserved,
+			s.LastGood.UTC().Format(time.RFC3339), s.Message)
+	}
+	return b.String()
+}
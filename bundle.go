@@ -0,0 +1,281 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Incremental bundles flag set by -incremental parameter
+var incremental bool
+
+// bundleRepo create git bundle with all refs of each repository mirror in
+// paths: owner/repo.bundle and owner/repo.wiki.bundle. In incremental mode the
+// full bundle is created once and then incremental bundles are created. The
+// bundles are encrypted when encryption recipients are set. Not mirror paths
+// are returned as is. Returns bundles and other files paths relative to dir
+// folder
+func bundleRepo(dir string, paths []string) (names []string, err error) {
+	// Bundles paths should be absolute, git -C resolves relative paths from
+	// the mirror folder
+	if dir, err = filepath.Abs(dir); err != nil {
+		return
+	}
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".git") {
+			names = append(names, path)
+			continue
+		}
+		base := strings.TrimSuffix(path, ".git")
+
+		var name string
+		if incremental {
+			name, err = bundleIncrement(dir, path, base)
+		} else {
+			name = base + ".bundle"
+			err = run("git", "-C", filepath.Join(dir, path), "bundle",
+				"create", "--quiet", filepath.Join(dir, name), "--all")
+		}
+		if err != nil {
+			return
+		}
+		if len(name) == 0 {
+			continue
+		}
+
+		if name, err = encryptFile(dir, name); err != nil {
+			return
+		}
+		names = append(names, name)
+		if incremental {
+			names = append(names, base+".bundle.refs")
+		}
+	}
+	return
+}
+
+// bundleIncrement create full base bundle owner/repo.bundle if chain of
+// repository is not started yet, or incremental bundle
+// owner/repo-YYYYMMDDTHHMMSS.inc.bundle with objects not reachable from refs
+// of the last bundle in the chain. Refs of the last bundle are saved to
+// owner/repo.bundle.refs file. Returns empty name if there are no changes
+func bundleIncrement(dir, path, base string) (name string, err error) {
+	if dir, err = filepath.Abs(dir); err != nil {
+		return
+	}
+	mirror := filepath.Join(dir, path)
+	refsFile := filepath.Join(dir, base+".bundle.refs")
+
+	// Get current refs of mirror
+	refs, err := exec.Command("git", "-C", mirror, "show-ref").Output()
+	if err != nil {
+		return "", fmt.Errorf("git show-ref in %s: %s", mirror, err)
+	}
+
+	// Get refs of the last bundle in chain
+	last, err := os.ReadFile(refsFile)
+	switch {
+	case os.IsNotExist(err):
+		name = base + ".bundle"
+		err = run("git", "-C", mirror, "bundle", "create", "--quiet",
+			filepath.Join(dir, name), "--all")
+	case err != nil:
+		return
+	case bytes.Equal(refs, last):
+		return "", nil
+	default:
+		// Exclude objects reachable from refs of the last bundle
+		var stdin strings.Builder
+		for _, line := range strings.Split(string(last), "\n") {
+			if hash, _, ok := strings.Cut(line, " "); ok &&
+				exec.Command("git", "-C", mirror, "cat-file", "-e",
+					hash).Run() == nil {
+				stdin.WriteString("^" + hash + "\n")
+			}
+		}
+		name = base + "-" + time.Now().UTC().Format("20060102T150405") +
+			".inc.bundle"
+		cmd := exec.Command("git", "-C", mirror, "bundle", "create", "--quiet",
+			filepath.Join(dir, name), "--all", "--stdin")
+		cmd.Stdin = strings.NewReader(stdin.String())
+		if out, cerr := cmd.CombinedOutput(); cerr != nil {
+			// Only deleted refs, there are no new objects
+			if strings.Contains(string(out), "empty bundle") {
+				name = ""
+				break
+			}
+			err = fmt.Errorf("git bundle create %s: %s\n%s", name, cerr,
+				strings.TrimSpace(string(out)))
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(refsFile, refs, 0644)
+	return
+}
+
+// chainFiles return base bundle and incremental bundles of chain sorted by
+// creation time
+func chainFiles(base string) (files []string, err error) {
+	if _, err = os.Stat(base + ".bundle"); err != nil {
+		return
+	}
+	incs, err := filepath.Glob(base + "-*.inc.bundle")
+	if err != nil {
+		return
+	}
+	sort.Strings(incs)
+	return append([]string{base + ".bundle"}, incs...), nil
+}
+
+// verifyChain check that base bundle and incremental bundles of chain can
+// reconstruct the repository: bundles are fetched one by one to empty
+// repository, connectivity is checked and refs are compared with refs of the
+// last bundle. Returns number of bundles in chain
+func verifyChain(base string) (n int, err error) {
+	// Bundles paths should be absolute, git -C resolves relative paths from
+	// the temporary repository
+	if base, err = filepath.Abs(base); err != nil {
+		return
+	}
+	files, err := chainFiles(base)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.MkdirTemp("", "github-backup-verify-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	if err = run("git", "init", "--quiet", "--bare", tmp); err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if err = run("git", "-C", tmp, "bundle", "verify", "--quiet",
+			file); err != nil {
+			return
+		}
+		if err = run("git", "-C", tmp, "fetch", "--quiet", file,
+			"+refs/*:refs/*"); err != nil {
+			return
+		}
+		n++
+	}
+	if err = run("git", "-C", tmp, "fsck", "--connectivity-only",
+		"--no-progress"); err != nil {
+		return
+	}
+
+	// Compare refs, deleted refs are not tracked in bundles so reconstructed
+	// repository may contain more refs
+	last, err := os.ReadFile(base + ".bundle.refs")
+	if err != nil {
+		return
+	}
+	out, err := exec.Command("git", "-C", tmp, "show-ref").Output()
+	if err != nil {
+		return
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		have[line] = true
+	}
+	for _, line := range strings.Split(string(last), "\n") {
+		if len(line) != 0 && !have[line] {
+			return n, fmt.Errorf("ref is not reconstructed: %s", line)
+		}
+	}
+	return
+}
+
+// verifyChainCmd is 'verify-chain' command: check that incremental bundles
+// chain of repository and its wiki can reconstruct the repository
+func verifyChainCmd(args []string) {
+	fs := flag.NewFlagSet("verify-chain", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup verify-chain [-output folder] [host/]owner/repo")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	repo := filepath.Join(*output, fs.Arg(0))
+	bases := []string{repo}
+	if _, err := os.Stat(repo + ".wiki.bundle"); err == nil {
+		bases = append(bases, repo+".wiki")
+	}
+
+	failed := false
+	for _, base := range bases {
+		n, err := verifyChain(base)
+		if err != nil {
+			logError(fmt.Sprintf("%s: chain is broken after %d bundles: %s",
+				base, n, err), "bundles", n, "error", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: chain of %d bundles is valid\n", base, n)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// encryptFile encrypt file when encryption recipients are set and remove not
+// encrypted file. Returns encrypted file name
+func encryptFile(dir, name string) (encrypted string, err error) {
+	if len(encryptRecipients) == 0 {
+		return name, nil
+	}
+	encrypted = name + encryptExt()
+
+	in, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, encrypted))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out.Name())
+			return
+		}
+		os.Remove(in.Name())
+	}()
+
+	ew, err := newEncryptor(out)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(ew, in); err != nil {
+		ew.Close()
+		return
+	}
+	err = ew.Close()
+	return
+}
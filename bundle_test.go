@@ -0,0 +1,78 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBundleRepo(t *testing.T) {
+	m := newTestGitHub(t)
+	defer func(v bool) { incremental = v }(incremental)
+
+	tests := []struct {
+		name        string
+		incremental bool
+		updates     int  // Commits pushed between runs
+		bundles     int  // Bundles in chain after all runs
+		chain       bool // Chain is verified
+	}{
+		{"full", false, 0, 1, false},
+		{"incremental base", true, 0, 1, true},
+		{"incremental chain", true, 1, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Relative output folder, as default -output repos
+			chdir(t, t.TempDir())
+			incremental = tt.incremental
+			const repo = "octo/alpha"
+			path := filepath.Join("octo", "alpha")
+			mirrorRemote(t, m, repo, "repos", path)
+
+			for n := 0; n <= tt.updates; n++ {
+				if n > 0 {
+					if err := m.addCommit(repo, "update.txt"); err != nil {
+						t.Fatal(err)
+					}
+					if err := run("git", "-C", filepath.Join("repos",
+						path+".git"), "fetch", "-q", "--prune",
+						"origin"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				names, err := bundleRepo("repos", []string{path + ".git"})
+				if err != nil {
+					t.Fatalf("run %d: %s", n, err)
+				}
+				for _, name := range names {
+					if filepath.IsAbs(name) {
+						t.Errorf("bundle path %s is not relative", name)
+					}
+				}
+			}
+
+			base := filepath.Join("repos", path)
+			files, err := chainFiles(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != tt.bundles {
+				t.Fatalf("%d bundles, %d expected", len(files), tt.bundles)
+			}
+			if !tt.chain {
+				return
+			}
+			n, err := verifyChain(base)
+			if err != nil {
+				t.Fatalf("chain is broken after %d bundles: %s", n, err)
+			}
+			if n != tt.bundles {
+				t.Errorf("%d bundles verified, %d expected", n, tt.bundles)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits rate of transferred bytes shared by all connections
+type rateLimiter struct {
+	rate float64 // Bytes per second
+	mu   sync.Mutex
+	next time.Time // Time when next bytes may be transferred
+}
+
+// wait reserve transfer of n bytes and sleep until the bytes fit the rate
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledReader is reader limited by rate limiter
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (t throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err = t.r.Read(p)
+	t.l.wait(n)
+	return
+}
+
+// parseBandwidth parse bandwidth like 10MB/s, 500K or 1.5GiB/s to bytes per
+// second
+func parseBandwidth(s string) (float64, error) {
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("wrong bandwidth limit '%s'", s)
+	}
+	return rate, nil
+}
+
+// parseSize parse size like 10MB, 500K or 1.5GiB to bytes. Units are 1024
+// based
+func parseSize(s string) (float64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	mult := 1.0
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]); i >= 0 {
+			for ; i >= 0; i-- {
+				mult *= 1024
+			}
+			v = v[:n-1]
+		}
+	}
+	size, err := strconv.ParseFloat(v, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("wrong size '%s'", s)
+	}
+	return size * mult, nil
+}
+
+// startBWLimit start local http proxy with throttled transfer and set it as
+// git http.proxy for git processes, so clone and fetch traffic over http(s)
+// is limited to rate in both directions
+func startBWLimit(limit string) error {
+	rate, err := parseBandwidth(limit)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	down, up := &rateLimiter{rate: rate}, &rateLimiter{rate: rate}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				logError("bwlimit proxy", "error", err)
+				return
+			}
+			go proxyConn(conn, down, up)
+		}
+	}()
+
+	// Add git config to environment inherited by git processes
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	os.Setenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", n), "http.proxy")
+	os.Setenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", n), "http://"+ln.Addr().String())
+	os.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(n+1))
+	logInfo("clone traffic is limited to "+limit, "limit", limit)
+	return nil
+}
+
+// proxyConn serve http proxy client connection: tunnel CONNECT requests and
+// forward plain http requests, with throttled transfer
+func proxyConn(conn net.Conn, down, up *rateLimiter) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":80"
+		if req.Method == http.MethodConnect {
+			host = req.Host + ":443"
+		}
+	}
+	remote, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer remote.Close()
+
+	if req.Method == http.MethodConnect {
+		fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else if err := req.Write(remote); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(remote, throttledReader{r, up})
+		if c, ok := remote.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(conn, throttledReader{remote, down})
+}
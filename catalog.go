@@ -0,0 +1,118 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// catalogSchema is SQLite catalog tables: runs, per-repo outcomes of each run
+// and last known refs of repositories
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started TEXT NOT NULL,
+	finished TEXT NOT NULL,
+	host TEXT NOT NULL,
+	tool TEXT NOT NULL,
+	format TEXT NOT NULL,
+	snapshot TEXT NOT NULL,
+	repos INTEGER NOT NULL,
+	failed INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS repos (
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	repo TEXT NOT NULL,
+	started TEXT NOT NULL,
+	duration REAL NOT NULL,
+	head TEXT NOT NULL,
+	wiki INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS repos_repo ON repos(repo, started);
+CREATE TABLE IF NOT EXISTS refs (
+	repo TEXT NOT NULL,
+	ref TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	updated TEXT NOT NULL,
+	PRIMARY KEY (repo, ref)
+);
+`
+
+// Catalog database file name set by -catalog parameter
+var catalogFile string
+
+// sqlQuote return SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlite execute SQL script on database file with sqlite3 cli and return its
+// output
+func sqlite(filename, script string, args ...string) ([]byte, error) {
+	args = append([]string{"-bail", "-batch"}, args...)
+	cmd := exec.Command("sqlite3", append(args, filename)...)
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 %s: %s\n%s", filename, err, out)
+	}
+	return out, nil
+}
+
+// writeCatalog record this run, repositories outcomes and last known refs to
+// SQLite catalog. Refs of successfully backed up repositories replace the
+// refs recorded before
+func writeCatalog(filename string) error {
+	var b strings.Builder
+	b.WriteString(catalogSchema)
+	b.WriteString("BEGIN;\n")
+	fmt.Fprintf(&b, "INSERT INTO runs (started, finished, host, tool, format, "+
+		"snapshot, repos, failed) VALUES (%s, %s, %s, %s, %s, %s, %d, %d);\n",
+		sqlQuote(runStart.UTC().Format(time.RFC3339)),
+		sqlQuote(time.Now().UTC().Format(time.RFC3339)),
+		sqlQuote(hostname()), sqlQuote(userAgent()), sqlQuote(strings.Join(formats, ",")),
+		sqlQuote(snapshotName), len(results), failedResults())
+
+	for _, r := range results {
+		status, errText := "success", ""
+		if r.Err != nil {
+			status, errText = "failed", r.Err.Error()
+		}
+		wiki := 0
+		if r.Wiki {
+			wiki = 1
+		}
+		fmt.Fprintf(&b, "INSERT INTO repos VALUES ((SELECT max(id) FROM runs),"+
+			" %s, %s, %.3f, %s, %d, %d, %s, %s);\n", sqlQuote(r.Path),
+			sqlQuote(r.Start.UTC().Format(time.RFC3339)), r.Duration.Seconds(),
+			sqlQuote(r.Tip), wiki, r.Size, sqlQuote(status), sqlQuote(errText))
+
+		if r.Err != nil || r.Refs == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "DELETE FROM refs WHERE repo = %s;\n", sqlQuote(r.Path))
+		var refs []string
+		for ref := range r.Refs {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			fmt.Fprintf(&b, "INSERT INTO refs VALUES (%s, %s, %s, %s);\n",
+				sqlQuote(r.Path), sqlQuote(ref), sqlQuote(r.Refs[ref]),
+				sqlQuote(r.Start.UTC().Format(time.RFC3339)))
+		}
+	}
+	b.WriteString("COMMIT;\n")
+
+	_, err := sqlite(filename, b.String())
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosConfig is fault injection probabilities set by hidden -chaos
+// parameter: api - github api request fails, slow - destination transfer is
+// slowed down, kill - git clone is killed in the middle
+type chaosConfig struct {
+	api, slow, kill float64
+	delay           time.Duration // Maximum delay of slow transfer and kill
+}
+
+// Fault injection configuration, nil if -chaos parameter is not set, and its
+// random generator
+var chaos *chaosConfig
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// hiddenFlags is flags not printed in usage
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// flagUsage print command line usage without hidden flags
+func flagUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", flag.CommandLine.Name())
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.PrintDefaults()
+}
+
+// parseChaos parse -chaos parameter: comma separated list of api=p, slow=p,
+// kill=p probabilities (0-1), delay=maximum duration of slow transfer and of
+// command run before kill, and seed=n of random generator
+func parseChaos(list string) error {
+	if len(strings.TrimSpace(list)) == 0 {
+		return nil
+	}
+	c := &chaosConfig{delay: 5 * time.Second}
+	for _, f := range strings.Split(list, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(f), "=")
+		var err error
+		switch key {
+		case "api":
+			c.api, err = strconv.ParseFloat(val, 64)
+		case "slow":
+			c.slow, err = strconv.ParseFloat(val, 64)
+		case "kill":
+			c.kill, err = strconv.ParseFloat(val, 64)
+		case "delay":
+			c.delay, err = time.ParseDuration(val)
+		case "seed":
+			var seed int64
+			seed, err = strconv.ParseInt(val, 10, 64)
+			chaosRand.Rand = rand.New(rand.NewSource(seed))
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return fmt.Errorf("wrong chaos parameter '%s': %s", f, err)
+		}
+	}
+	chaos = c
+	return nil
+}
+
+// chaosHit return true with probability p
+func chaosHit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.Float64() < p
+}
+
+// chaosDuration return random duration up to max
+func chaosDuration(max time.Duration) time.Duration {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return time.Duration(chaosRand.Int63n(int64(max) + 1))
+}
+
+// chaosAPI return injected error of github api request
+func chaosAPI(endpoint string) error {
+	if chaos == nil || !chaosHit(chaos.api) {
+		return nil
+	}
+	return fmt.Errorf("chaos: injected api failure of %s", endpoint)
+}
+
+// chaosSlow slow down destination transfer
+func chaosSlow() {
+	if chaos == nil || !chaosHit(chaos.slow) {
+		return
+	}
+	time.Sleep(chaosDuration(chaos.delay))
+}
+
+// chaosRun execute command like run, but kill it after random delay with
+// kill probability, leaving partial result
+func chaosRun(name string, args ...string) error {
+	if chaos == nil || !chaosHit(chaos.kill) {
+		return transferRun(name, args...)
+	}
+	cmd, cancel := command(name, args...)
+	defer cancel()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(chaosDuration(chaos.delay), func() {
+		cmd.Process.Kill()
+	})
+	err := commandErr(cmd.Wait())
+	timer.Stop()
+	if err != nil {
+		return fmt.Errorf("chaos: %s %s killed: %s", name,
+			strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Maximum length of chat message body, longer body is truncated
+const chatBodyMax = 3500
+
+// chatSeverity is chat message formatting of notification type: emoji,
+// Slack attachment color and Discord embed color
+var chatSeverity = map[string]struct {
+	emoji string
+	color string
+	rgb   int
+}{
+	notifyInfo:    {"\u2139\ufe0f", "#439fe0", 0x439fe0},
+	notifySuccess: {"\u2705", "good", 0x2eb886},
+	notifyWarning: {"\u26a0\ufe0f", "warning", 0xdaa038},
+	notifyFailure: {"\u274c", "danger", 0xa30200},
+}
+
+// chatWebhook return chat kind of incoming webhook url: slack or discord,
+// or empty string if url is not Slack or Discord webhook
+func chatWebhook(u *url.URL) string {
+	if u.Scheme != "https" {
+		return ""
+	}
+	switch {
+	case u.Host == "hooks.slack.com":
+		return "slack"
+	case (u.Host == "discord.com" || u.Host == "discordapp.com") &&
+		strings.HasPrefix(u.Path, "/api/webhooks/"):
+		return "discord"
+	}
+	return ""
+}
+
+// slackNotifier post notifications to Slack incoming webhook
+type slackNotifier struct {
+	url string
+}
+
+func (s *slackNotifier) notify(n notification) error {
+	sev := chatSeverity[n.Type]
+	data, err := json.Marshal(map[string]interface{}{
+		"text": sev.emoji + " " + n.Title,
+		"attachments": []map[string]interface{}{{
+			"color":  sev.color,
+			"text":   "```" + chatBody(n.Body) + "```",
+			"footer": "github-backup on " + hostname(),
+			"ts":     time.Now().Unix(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, data)
+}
+
+// discordNotifier post notifications to Discord webhook
+type discordNotifier struct {
+	url string
+}
+
+func (d *discordNotifier) notify(n notification) error {
+	sev := chatSeverity[n.Type]
+	data, err := json.Marshal(map[string]interface{}{
+		"username": "github-backup",
+		"embeds": []map[string]interface{}{{
+			"title":       sev.emoji + " " + n.Title,
+			"description": "```\n" + chatBody(n.Body) + "\n```",
+			"color":       sev.rgb,
+			"footer":      map[string]string{"text": hostname()},
+			"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(d.url, data)
+}
+
+// chatBody return notification body truncated to chat message limits
+func chatBody(body string) string {
+	body = strings.TrimSpace(body)
+	if len(body) > chatBodyMax {
+		body = strings.ToValidUTF8(body[:chatBodyMax], "") + "\n..."
+	}
+	return body
+}
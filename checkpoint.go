@@ -0,0 +1,147 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Resume interrupted run flag
+var resume bool
+
+// checkpointHeader is first line of run checkpoint file
+type checkpointHeader struct {
+	Start    time.Time `json:"start"`              // Run start time
+	Snapshot string    `json:"snapshot,omitempty"` // Run snapshot folder
+}
+
+// Run checkpoint: file where results of completed repositories are appended
+// during the run, and repositories completed by interrupted run
+var checkpoint *os.File
+var checkpointDone = map[string]repoResult{}
+
+// checkpointFile return run checkpoint file name in output folder
+func checkpointFile(output string) string {
+	return filepath.Join(output, ".github-backup", "checkpoint.jsonl")
+}
+
+// startCheckpoint start run checkpoint. With -resume parameter the run
+// continues interrupted run: its start time and snapshot folder are reused,
+// and repositories completed by it are added to results and skipped. Without
+// -resume the checkpoint of interrupted run is discarded
+func startCheckpoint(output string) error {
+	name := checkpointFile(output)
+	if resume {
+		n, err := loadCheckpoint(output)
+		switch {
+		case err == nil:
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			checkpoint = f
+			logInfo(fmt.Sprintf("resume run started %s: %d repositories "+
+				"completed", runStart.Format(time.RFC3339), n),
+				"started", runStart.Format(time.RFC3339), "completed", n)
+			return nil
+		case os.IsNotExist(err):
+			logInfo("resume: no interrupted run, start new run")
+		default:
+			logWarn("resume: start new run", "error", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(checkpointHeader{runStart, snapshotName})
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	checkpoint = f
+	return nil
+}
+
+// loadCheckpoint load checkpoint of interrupted run and return number of
+// completed repositories
+func loadCheckpoint(output string) (n int, err error) {
+	f, err := os.Open(checkpointFile(output))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	var h checkpointHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &h) != nil {
+		return 0, fmt.Errorf("wrong checkpoint header")
+	}
+	if (len(h.Snapshot) != 0) != (len(snapshotName) != 0) {
+		return 0, fmt.Errorf("interrupted run snapshot mode differs")
+	}
+	var done []repoResult
+	for scanner.Scan() {
+		var r repoResult
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			// The last line may be partially written by interrupted run
+			break
+		}
+		done = append(done, r)
+	}
+
+	runStart = h.Start
+	if len(h.Snapshot) != 0 {
+		resumeSnapshot(output, h.Snapshot)
+	}
+	for _, r := range done {
+		results = append(results, r)
+		checkpointDone[r.Path] = r
+		state.Repos[r.Path] = r.Start
+	}
+	return len(done), nil
+}
+
+// checkpointRepo append result of successfully backed up repository to run
+// checkpoint
+func checkpointRepo(r *repoResult) {
+	if checkpoint == nil || r.Err != nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err == nil {
+		_, err = checkpoint.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logError("write run checkpoint", "error", err)
+	}
+}
+
+// completedRepo return result of repository completed by interrupted run
+func completedRepo(path string) (r repoResult, ok bool) {
+	r, ok = checkpointDone[path]
+	return
+}
+
+// clearCheckpoint remove checkpoint of finished run
+func clearCheckpoint(output string) {
+	if checkpoint == nil {
+		return
+	}
+	checkpoint.Close()
+	checkpoint = nil
+	if err := os.Remove(checkpointFile(output)); err != nil {
+		logError("remove run checkpoint", "error", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumsName is checksum manifest file name. The manifest is written in
+// sha256sum format to output folder, or to snapshot folder in snapshot mode
+const checksumsName = "SHA256SUMS"
+
+// Checksums of archives and bundles created in this run by path relative to
+// the manifest folder
+var checksums = map[string]string{}
+
+// checksumStage add SHA-256 checksums of repository archives and bundles to
+// this run checksums
+func checksumStage(j *pipelineJob) error {
+	for _, file := range j.files {
+		local := filepath.Join(j.dir, file)
+		if info, err := os.Stat(local); err != nil || info.IsDir() {
+			continue
+		}
+		sum, err := fileSHA256(local)
+		if err != nil {
+			return err
+		}
+		checksums[strings.TrimPrefix(file, snapshotName+"/")] = sum
+	}
+	return nil
+}
+
+// fileSHA256 return hex encoded SHA-256 checksum of file
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// readChecksums read checksums manifest file
+func readChecksums(name string) (sums map[string]string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sums = map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		sums[file] = sum
+	}
+	err = scanner.Err()
+	return
+}
+
+// writeChecksums write this run checksums to manifest file and copy it to
+// destinations. Checksums of files created in previous runs are kept in the
+// manifest
+func writeChecksums(output string) error {
+	if len(checksums) == 0 {
+		return nil
+	}
+	path := snapshotPath(checksumsName)
+	name := filepath.Join(output, path)
+	sums, err := readChecksums(name)
+	if err != nil {
+		sums = map[string]string{}
+	}
+	for file, sum := range checksums {
+		sums[file] = sum
+	}
+
+	var files []string
+	for file := range sums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var b strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&b, "%s  %s\n", sums[file], file)
+	}
+	if err := os.WriteFile(name, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return putDests(output, []string{path})
+}
+
+// verifyManifestCmd is 'verify-manifest' command: re-check stored archives and
+// bundles against checksums manifests of output folder and its snapshots
+func verifyManifestCmd(args []string) {
+	fs := flag.NewFlagSet("verify-manifest", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup verify-manifest [-output folder]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dirs := []string{*output}
+	snapshots, _ := listSnapshots(*output)
+	for _, s := range snapshots {
+		dirs = append(dirs, filepath.Join(*output, s.Name))
+	}
+
+	var manifests, checked, failed int
+	for _, dir := range dirs {
+		sums, err := readChecksums(filepath.Join(dir, checksumsName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			logFatal(err)
+		}
+		manifests++
+		var files []string
+		for file := range sums {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			checked++
+			name := filepath.Join(dir, file)
+			sum, err := fileSHA256(name)
+			switch {
+			case os.IsNotExist(err):
+				fmt.Printf("%s: MISSING\n", name)
+			case err != nil:
+				fmt.Printf("%s: %s\n", name, err)
+			case sum != sums[file]:
+				fmt.Printf("%s: FAILED\n", name)
+			default:
+				fmt.Printf("%s: OK\n", name)
+				continue
+			}
+			failed++
+		}
+	}
+	if manifests == 0 {
+		logFatal(fmt.Sprintf("no %s manifests found in %s", checksumsName,
+			*output))
+	}
+	fmt.Printf("checked %d files in %d manifests, %d failed\n", checked,
+		manifests, failed)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
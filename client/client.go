@@ -0,0 +1,199 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client is client of github-backup server orchestration REST api:
+// trigger backup runs on central backup server, wait until runs finish and
+// fetch runs logs and reports.
+//
+//	c := client.New("http://backup.local:8090", os.Getenv("GITHUB_BACKUP_API_TOKEN"))
+//	run, err := c.Trigger(ctx, client.TriggerOptions{Users: "my-org"})
+//	if err == nil {
+//		run, err = c.Wait(ctx, run.ID, 10*time.Second)
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API version prefix of server endpoints
+const apiPrefix = "/api/v1"
+
+// Run statuses
+const (
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+// Run is backup run started by server
+type Run struct {
+	ID       string    `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end,omitempty"`
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exit_code"`
+	Users    string    `json:"users,omitempty"` // Users override
+	Limit    string    `json:"limit,omitempty"` // Limit override
+}
+
+// Status is server status: current run if backup is running, and last run
+type Status struct {
+	Running bool `json:"running"`
+	Current *Run `json:"current,omitempty"`
+	Last    *Run `json:"last,omitempty"`
+}
+
+// TriggerOptions is options of triggered run overriding server backup
+// parameters, empty options keep server parameters
+type TriggerOptions struct {
+	Users string `json:"users,omitempty"` // Users or organisations comma separated list
+	Limit string `json:"limit,omitempty"` // Repositories comma separated list
+}
+
+// Error is server error response
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server: %d %s", e.StatusCode, e.Message)
+}
+
+// Client is github-backup server api client
+type Client struct {
+	URL   string // Server url, e.g. http://backup.local:8090
+	Token string // Server api token
+	HTTP  *http.Client
+}
+
+// New create server api client with server url and api token
+func New(url, token string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Token: token,
+		HTTP: &http.Client{Timeout: time.Minute}}
+}
+
+// Status return server status
+func (c *Client) Status(ctx context.Context) (s Status, err error) {
+	err = c.do(ctx, "GET", "/status", nil, &s)
+	return
+}
+
+// Trigger start backup run. Returns error with 409 status code if backup is
+// already running
+func (c *Client) Trigger(ctx context.Context, opts TriggerOptions) (r Run,
+	err error) {
+	err = c.do(ctx, "POST", "/runs", opts, &r)
+	return
+}
+
+// Runs return runs started by server, newest first
+func (c *Client) Runs(ctx context.Context) (runs []Run, err error) {
+	err = c.do(ctx, "GET", "/runs", nil, &runs)
+	return
+}
+
+// Run return run by id
+func (c *Client) Run(ctx context.Context, id string) (r Run, err error) {
+	err = c.do(ctx, "GET", "/runs/"+id, nil, &r)
+	return
+}
+
+// Wait poll run status every poll interval until the run finishes
+func (c *Client) Wait(ctx context.Context, id string, poll time.Duration) (
+	r Run, err error) {
+	for {
+		if r, err = c.Run(ctx, id); err != nil || r.Status != StatusRunning {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return r, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Report return run json report: run totals and status, timing and bytes of
+// each repository
+func (c *Client) Report(ctx context.Context, id string) (json.RawMessage,
+	error) {
+	var report json.RawMessage
+	err := c.do(ctx, "GET", "/runs/"+id+"/report", nil, &report)
+	return report, err
+}
+
+// Manifest return run manifest json: repositories backed up in run with
+// status, refs, sizes and completeness
+func (c *Client) Manifest(ctx context.Context, id string) (json.RawMessage,
+	error) {
+	var manifest json.RawMessage
+	err := c.do(ctx, "GET", "/runs/"+id+"/manifest", nil, &manifest)
+	return manifest, err
+}
+
+// Log return run log output
+func (c *Client) Log(ctx context.Context, id string) (string, error) {
+	data, err := c.request(ctx, "GET", "/runs/"+id+"/log", nil)
+	return string(data), err
+}
+
+// do execute api request with json body and unmarshal json response to v
+func (c *Client) do(ctx context.Context, method, endpoint string, body,
+	v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	data, err := c.request(ctx, method, endpoint, r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// request execute api request and return response body
+func (c *Client) request(ctx context.Context, method, endpoint string,
+	body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method,
+		c.URL+apiPrefix+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &Error{resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return data, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Partial clone filter set by -filter parameter, e.g. blob:none
+var cloneFilter string
+
+// Shallow clone parameters: history depth in commits set by -depth parameter
+// and history start date set by -shallow-since parameter
+var depth int
+var shallowSince string
+
+// Clone proxy url template set by -clone-proxy parameter, e.g.
+// https://gitea.local/{owner}/{name}.git
+var cloneProxy string
+
+// cloneArgs return additional git clone arguments set by parameters
+func cloneArgs() (args []string) {
+	if len(cloneFilter) != 0 {
+		args = append(args, "--filter="+cloneFilter)
+	}
+	return append(args, shallowArgs()...)
+}
+
+// shallowArgs return git clone and fetch shallow arguments set by parameters
+func shallowArgs() (args []string) {
+	if depth > 0 {
+		args = append(args, "--depth="+strconv.Itoa(depth))
+	}
+	if len(shallowSince) != 0 {
+		args = append(args, "--shallow-since="+shallowSince)
+	}
+	return
+}
+
+// isShallow return true if mirror is shallow clone
+func isShallow(mirror string) bool {
+	_, err := os.Stat(filepath.Join(mirror, "shallow"))
+	return err == nil
+}
+
+// proxyURL return clone proxy url of repository: the {host}, {owner}, {name}
+// and {repo} (owner/name) placeholders of clone proxy template are replaced
+func proxyURL(acc account, repo string) string {
+	return strings.NewReplacer(
+		"{host}", acc.Host,
+		"{owner}", path.Dir(repo),
+		"{name}", path.Base(repo),
+		"{repo}", repo,
+	).Replace(cloneProxy)
+}
+
+// cloneMirror clone mirror of repository to mirror folder with refs
+// included by refs patterns, all refs if patterns are empty. The mirror uses
+// objects of reference repository if it is not empty. Existing mirror is
+// updated from origin. If clone proxy is set the mirror is cloned from the
+// proxy first, and then origin is set to upstream and fetched, so only
+// changes missed by the proxy are transferred from upstream. When clone from
+// the proxy fails the mirror is cloned from upstream
+func cloneMirror(acc account, repo, mirror string, refs []string,
+	reference string) error {
+
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err == nil {
+		if len(reference) != 0 {
+			if err := setAlternate(mirror, reference); err != nil {
+				return err
+			}
+		}
+		return retry(repo+": fetch", func() error {
+			return filterRefs(mirror, refs)
+		})
+	}
+	upstream := acc.gitURL(repo)
+	if len(cloneProxy) == 0 {
+		return retryMirror(repo, upstream, mirror, refs, reference)
+	}
+
+	proxyErr := gitMirror(proxyURL(acc, repo), mirror, refs, reference)
+	if proxyErr == nil {
+		err := run("git", "-C", mirror, "remote", "set-url", "origin", upstream)
+		if err == nil {
+			err = retry(repo+": fetch", func() error {
+				return run("git", "-C", mirror, "fetch", "--prune", "origin")
+			})
+		}
+		if err != nil {
+			logWarn(fmt.Sprintf("%s: can't fetch upstream, mirror is cloned "+
+				"from clone proxy only: %s", repo, err), repoFields(repo)...)
+		}
+		return nil
+	}
+
+	err := retryMirror(repo, upstream, mirror, refs, reference)
+	if err == nil {
+		logWarn(fmt.Sprintf("%s: cloned from upstream, clone proxy failed: %s",
+			repo, proxyErr), repoFields(repo)...)
+	}
+	return err
+}
+
+// retryMirror clone mirror from url and retry clone if it fails transiently.
+// Partial mirror of failed attempt is removed before the next attempt
+func retryMirror(repo, url, mirror string, refs []string,
+	reference string) error {
+	return retry(repo+": clone", func() error {
+		os.RemoveAll(mirror)
+		return gitMirror(url, mirror, refs, reference)
+	})
+}
+
+// gitMirror clone mirror from url with reference repository if it is not
+// empty. The git clone --mirror always fetches all refs, so mirror with refs
+// patterns is created with git init, configured with refspecs of the
+// patterns and fetched
+func gitMirror(url, mirror string, refs []string, reference string) error {
+	if len(refs) == 0 {
+		args := append([]string{"clone", "--mirror"}, cloneArgs()...)
+		if len(reference) != 0 {
+			args = append(args, "--reference", reference)
+		}
+		err := chaosRun("git", append(args, url, mirror)...)
+		if err == nil && len(reference) != 0 {
+			// Replace absolute reference path with relative path
+			os.Remove(filepath.Join(mirror, "objects", "info", "alternates"))
+			err = setAlternate(mirror, reference)
+		}
+		return err
+	}
+
+	if err := run("git", "init", "-q", "--bare", mirror); err != nil {
+		return err
+	}
+	if len(reference) != 0 {
+		if err := setAlternate(mirror, reference); err != nil {
+			return err
+		}
+	}
+	config := [][2]string{
+		{"remote.origin.url", url},
+		{"remote.origin.mirror", "true"},
+	}
+	if len(cloneFilter) != 0 {
+		config = append(config, [][2]string{
+			{"core.repositoryformatversion", "1"},
+			{"extensions.partialclone", "origin"},
+			{"remote.origin.promisor", "true"},
+			{"remote.origin.partialclonefilter", cloneFilter},
+		}...)
+	}
+	for _, kv := range config {
+		if err := run("git", "-C", mirror, "config", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	if err := setRefspecs(mirror, refs); err != nil {
+		return err
+	}
+	args := append([]string{"-C", mirror, "fetch", "-q"}, shallowArgs()...)
+	if len(cloneFilter) != 0 {
+		args = append(args, "--filter="+cloneFilter)
+	}
+	if err := chaosRun("git", append(args, "origin")...); err != nil {
+		return err
+	}
+
+	// Set HEAD to remote default branch like git clone does
+	cmd, cancel := command("git", "-C", mirror, "ls-remote", "--symref",
+		"origin", "HEAD")
+	defer cancel()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	if !strings.HasPrefix(line, "ref: ") {
+		return nil
+	}
+	head, _, _ := strings.Cut(strings.TrimPrefix(line, "ref: "), "\t")
+	return run("git", "-C", mirror, "symbolic-ref", "HEAD", head)
+}
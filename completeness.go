@@ -0,0 +1,194 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Repository part coverage statuses
+const (
+	coverOK      = "ok"      // Backed up
+	coverMissing = "missing" // Exists but not backed up
+	coverNone    = "none"    // Doesn't exist in repository
+	coverUnknown = "unknown" // Not probed
+)
+
+// coverageParts is repository parts counted in completeness score, with
+// pipeline stage which backs up the part and repository capability which
+// shows the part exists (nil if the part always exists)
+var coverageParts = []struct {
+	name  string
+	stage string
+	has   func(c *repoCaps) bool
+}{
+	{"git", "clone", nil},
+	{"wiki", "wiki", func(c *repoCaps) bool { return c.Wiki }},
+	{"lfs", "lfs", func(c *repoCaps) bool { return c.LFS }},
+	{"releases", "releases", func(c *repoCaps) bool { return c.Releases }},
+	{"issues", "issues", func(c *repoCaps) bool { return c.Issues }},
+	{"discussions", "discussions", func(c *repoCaps) bool { return c.Discussions }},
+}
+
+// repoCoverage return coverage of repository parts by pipeline stages
+// results and repository capabilities, nil caps if not probed
+func repoCoverage(caps *repoCaps, stages []stageResult) map[string]string {
+	status := map[string]string{}
+	for _, s := range stages {
+		status[s.Stage] = s.Status
+	}
+	cov := map[string]string{}
+	for _, p := range coverageParts {
+		switch {
+		case status[p.stage] == stageOK:
+			cov[p.name] = coverOK
+		case p.has == nil:
+			cov[p.name] = coverMissing
+		case caps == nil:
+			cov[p.name] = coverUnknown
+		case p.has(caps):
+			cov[p.name] = coverMissing
+		default:
+			cov[p.name] = coverNone
+		}
+	}
+	return cov
+}
+
+// coverageScore return percent of existing repository parts backed up
+func coverageScore(cov map[string]string) int {
+	var ok, total int
+	for _, s := range cov {
+		switch s {
+		case coverOK:
+			ok++
+			total++
+		case coverMissing:
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return ok * 100 / total
+}
+
+// coverageLine return coverage of repository parts with marks: ✓ backed up,
+// ✗ not backed up, – doesn't exist, ? not probed
+func coverageLine(cov map[string]string) string {
+	marks := map[string]string{coverOK: "✓", coverMissing: "✗",
+		coverNone: "–", coverUnknown: "?"}
+	var parts []string
+	for _, p := range coverageParts {
+		if s, ok := cov[p.name]; ok {
+			parts = append(parts, p.name+" "+marks[s])
+		}
+	}
+	return strings.Join(parts, "  ")
+}
+
+// ownerCompleteness is aggregated completeness of owner repositories
+type ownerCompleteness struct {
+	Owner    string         `json:"owner"`
+	Repos    int            `json:"repos"`
+	Score    int            `json:"score"`   // Average repositories score
+	Covered  map[string]int `json:"covered"` // Repositories with part backed up
+	Existing map[string]int `json:"existing"`
+}
+
+// repoCompleteness is completeness of repository backup
+type repoCompleteness struct {
+	Repo     string            `json:"repo"`
+	Score    int               `json:"score"`
+	Coverage map[string]string `json:"coverage"`
+}
+
+// completenessCmd is 'completeness' command: report completeness score of
+// each repository of the last run manifest with coverage of repository parts
+// (git, wiki, LFS, releases, issues, discussions), aggregated per owner
+func completenessCmd(args []string) {
+	fs := flag.NewFlagSet("completeness", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	below := fs.Int("below", 101, "print repositories with score below percent only")
+	jsonOut := fs.Bool("json", false, "print report in json format")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup completeness [-output folder] [-below percent] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cur, _ := manifestFiles(*output)
+	m, err := readManifest(cur)
+	if err != nil {
+		logFatal("can't read run manifest: ", err)
+	}
+
+	var repos []repoCompleteness
+	owners := map[string]*ownerCompleteness{}
+	for _, e := range m.Repos {
+		if e.Coverage == nil {
+			continue
+		}
+		name := path.Dir(e.Repo)
+		o, ok := owners[name]
+		if !ok {
+			o = &ownerCompleteness{Owner: name, Covered: map[string]int{},
+				Existing: map[string]int{}}
+			owners[name] = o
+		}
+		o.Repos++
+		o.Score += e.Score
+		for part, s := range e.Coverage {
+			if s == coverOK || s == coverMissing {
+				o.Existing[part]++
+			}
+			if s == coverOK {
+				o.Covered[part]++
+			}
+		}
+		if e.Score < *below {
+			repos = append(repos, repoCompleteness{e.Repo, e.Score, e.Coverage})
+		}
+	}
+	var list []ownerCompleteness
+	for _, o := range owners {
+		o.Score /= o.Repos
+		list = append(list, *o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Owner < list[j].Owner })
+	sort.SliceStable(repos, func(i, j int) bool {
+		return repos[i].Score < repos[j].Score
+	})
+
+	if *jsonOut {
+		data, _ := json.MarshalIndent(struct {
+			Owners []ownerCompleteness `json:"owners"`
+			Repos  []repoCompleteness  `json:"repos"`
+		}{list, repos}, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Printf("%-40s %6s %6s  %s\n", "OWNER", "REPOS", "SCORE", "COVERED")
+	for _, o := range list {
+		var parts []string
+		for _, p := range coverageParts {
+			if n := o.Existing[p.name]; n != 0 {
+				parts = append(parts, fmt.Sprintf("%s %d/%d", p.name,
+					o.Covered[p.name], n))
+			}
+		}
+		fmt.Printf("%-40s %6d %5d%%  %s\n", o.Owner, o.Repos, o.Score,
+			strings.Join(parts, ", "))
+	}
+	fmt.Printf("\n%-50s %6s  %s\n", "REPOSITORY", "SCORE", "COVERAGE")
+	for _, r := range repos {
+		fmt.Printf("%-50s %5d%%  %s\n", r.Repo, r.Score, coverageLine(r.Coverage))
+	}
+}
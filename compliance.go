@@ -0,0 +1,86 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// headTip return HEAD commit hash of mirror, or empty string if the mirror
+// has no HEAD commit
+func headTip(mirror string) string {
+	out, err := exec.Command("git", "-C", mirror, "rev-parse", "--verify",
+		"-q", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// complianceColumns is compliance report columns
+var complianceColumns = []string{"repository", "window_start_utc",
+	"window_end_utc", "duration_seconds", "upstream_head", "status", "error"}
+
+// complianceRows return compliance report rows of repositories results
+func complianceRows() (rows [][]string) {
+	for _, r := range results {
+		status, errText := "success", ""
+		if r.Err != nil {
+			status = "failed"
+			errText = strings.ReplaceAll(r.Err.Error(), "\n", " ")
+		}
+		rows = append(rows, []string{
+			r.Account + ": " + r.Repo,
+			r.Start.UTC().Format(time.RFC3339),
+			r.Start.Add(r.Duration).UTC().Format(time.RFC3339),
+			fmt.Sprintf("%.0f", r.Duration.Seconds()),
+			r.Tip, status, errText,
+		})
+	}
+	return
+}
+
+// writeCompliance write backup window and captured upstream tip of each
+// repository to csv file, or to markdown file if filename has .md extension
+func writeCompliance(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows := complianceRows()
+	if !strings.HasSuffix(filename, ".md") {
+		w := csv.NewWriter(f)
+		w.Write(complianceColumns)
+		w.WriteAll(rows)
+		if err := w.Error(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	// Markdown report
+	fmt.Fprintf(f, "# Backup evidence report\n\n")
+	fmt.Fprintf(f, "* Generated: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(f, "* Backup host: %s\n", hostname())
+	fmt.Fprintf(f, "* Tool: %s\n", userAgent())
+	fmt.Fprintf(f, "* Repositories: %d, failed: %d\n\n", len(results),
+		failedResults())
+	fmt.Fprintf(f, "| %s |\n", strings.Join(complianceColumns, " | "))
+	fmt.Fprintf(f, "|%s\n", strings.Repeat(" --- |", len(complianceColumns)))
+	for _, row := range rows {
+		for i := range row {
+			row[i] = strings.ReplaceAll(row[i], "|", "\\|")
+		}
+		fmt.Fprintf(f, "| %s |\n", strings.Join(row, " | "))
+	}
+	return f.Close()
+}
@@ -0,0 +1,262 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Daemon mode parameters: daemon flag, interval between runs starts and cron
+// expression schedule
+var daemon bool
+var daemonInterval time.Duration
+var daemonCron string
+
+// Interval of daemon status log between runs
+const daemonStatusInterval = time.Hour
+
+// cronSchedule is parsed cron expression: minute, hour, day of month, month
+// and day of week sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow [60]bool
+	domAny, dowAny                bool // Day of month or week is *
+}
+
+// parseCron parse cron expression of 5 fields: minute hour day-of-month
+// month day-of-week. Fields are *, numbers, ranges 1-5, lists 1,15 and
+// steps */10 or 8-18/2, e.g. "0 2 * * *" or "30 1 * * Mon-Fri"
+func parseCron(expr string) (c *cronSchedule, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("wrong cron expression '%s': 5 fields expected",
+			expr)
+	}
+	c = &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		set      *[60]bool
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12},
+		{&c.dow, 0, 7}} {
+		if err = parseCronField(fields[i], f.min, f.max, f.set); err != nil {
+			return nil, fmt.Errorf("wrong cron expression '%s': %s", expr, err)
+		}
+	}
+	c.dow[0] = c.dow[0] || c.dow[7]
+	return
+}
+
+// parseCronField parse cron expression field values to set
+func parseCronField(field string, min, max int, set *[60]bool) error {
+	value := func(s string) (int, error) {
+		if d, ok := weekDays[strings.ToLower(s)]; ok && max == 7 {
+			return int(d), nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("wrong value '%s'", s)
+		}
+		return n, nil
+	}
+	for _, r := range strings.Split(field, ",") {
+		r, stepStr, hasStep := strings.Cut(r, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return fmt.Errorf("wrong step '%s'", stepStr)
+			}
+		}
+		from, to := min, max
+		if r != "*" {
+			var err error
+			f, t, isRange := strings.Cut(r, "-")
+			if from, err = value(f); err != nil {
+				return err
+			}
+			to = from
+			if isRange {
+				if to, err = value(t); err != nil {
+					return err
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from > to {
+			return fmt.Errorf("wrong range '%s'", r)
+		}
+		for n := from; n <= to; n += step {
+			set[n] = true
+		}
+	}
+	return nil
+}
+
+// next return next time after t matching the schedule. Day of month and day
+// of week match any of them if both are set, like cron does
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if !c.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			t = t.Add(-time.Minute)
+			continue
+		}
+		dom, dow := c.dom[t.Day()], c.dow[t.Weekday()]
+		day := dom && dow
+		if !c.domAny && !c.dowAny {
+			day = dom || dow
+		}
+		if !day {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				t.Location())
+			t = t.Add(-time.Minute)
+			continue
+		}
+		if c.hour[t.Hour()] && c.minute[t.Minute()] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runDaemon run backups on schedule as long-lived service: every interval
+// from previous run start, or at times matching cron expression. Each backup
+// runs as child process with the same parameters except daemon ones, so runs
+// don't share state. Daemon status is logged between runs. Under systemd the
+// daemon reports readiness and status, and sends watchdog keepalives
+func runDaemon() {
+	var cron *cronSchedule
+	if len(daemonCron) != 0 {
+		var err error
+		if cron, err = parseCron(daemonCron); err != nil {
+			logFatal(err)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		logFatal(err)
+	}
+	args := daemonArgs(os.Args[1:])
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	output := backupParam(args, "output")
+	if len(output) == 0 {
+		output = "repos"
+	}
+	if len(metricsListen) != 0 {
+		metrics.seed(output)
+		serveMetrics(metricsListen)
+		logInfo(fmt.Sprintf("daemon: metrics on %s/metrics", metricsListen),
+			"listen", metricsListen)
+	}
+
+	defer sdWatchdog()()
+	sdNotify("READY=1")
+	var last string
+	next := time.Now()
+	if cron != nil {
+		next = cron.next(next)
+		logInfo(fmt.Sprintf("daemon: backup scheduled by cron '%s'",
+			daemonCron), "cron", daemonCron)
+	} else {
+		logInfo(fmt.Sprintf("daemon: backup scheduled every %s",
+			daemonInterval), "interval", daemonInterval)
+	}
+	for {
+		// Wait for next run with status log
+		for wait := time.Until(next); wait > 0; wait = time.Until(next) {
+			logInfo(fmt.Sprintf("daemon: next run at %s%s",
+				next.Format(time.RFC3339), last),
+				"next", next.Format(time.RFC3339))
+			sdNotify("STATUS=next run at " + next.Format(time.RFC3339) + last)
+			if wait > daemonStatusInterval {
+				wait = daemonStatusInterval
+			}
+			select {
+			case sig := <-stop:
+				logInfo(fmt.Sprintf("daemon: %s, stopped", sig),
+					"signal", sig.String())
+				sdNotify("STOPPING=1")
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		// Run backup
+		start := time.Now()
+		logInfo("daemon: run backup")
+		sdNotify("STATUS=backup is running")
+		metrics.runStarted()
+		cmd := exec.Command(exe, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			logFatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case sig := <-stop:
+			logWarn(fmt.Sprintf("daemon: %s, stop running backup", sig),
+				"signal", sig.String())
+			sdNotify("STOPPING=1")
+			cmd.Process.Signal(sig)
+			<-done
+			return
+		}
+		status := "success"
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = fmt.Sprintf("failed, exit code %d", exitErr.ExitCode())
+		} else if err != nil {
+			status = "failed: " + err.Error()
+		}
+		metrics.runFinished(output, start, err == nil)
+		duration := time.Since(start).Round(time.Second)
+		logInfo(fmt.Sprintf("daemon: run finished in %s: %s", duration,
+			status), "duration", duration, "status", status)
+		last = fmt.Sprintf(", last run %s: %s in %s",
+			start.Format(time.RFC3339), status, duration)
+
+		// Schedule next run, the overrun run starts next one immediately
+		if cron != nil {
+			next = cron.next(time.Now())
+		} else if next = start.Add(daemonInterval); next.Before(time.Now()) {
+			next = time.Now()
+		}
+	}
+}
+
+// daemonArgs return backup parameters without daemon mode parameters
+func daemonArgs(args []string) (backup []string) {
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		name, _, hasValue := strings.Cut(name, "=")
+		if !strings.HasPrefix(args[i], "-") {
+			backup = append(backup, args[i])
+			continue
+		}
+		switch name {
+		case "daemon":
+		case "interval", "cron", "metrics-listen":
+			if !hasValue {
+				i++
+			}
+		default:
+			backup = append(backup, args[i])
+		}
+	}
+	return
+}
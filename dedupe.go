@@ -0,0 +1,169 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mirrorIdentity is identity of git mirror content: hash of all refs with its
+// objects, and hash of root commits
+type mirrorIdentity struct {
+	Path  string // Mirror path
+	Name  string // Mirror path relative to output or snapshot folder
+	Refs  string // Hash of refs and its objects, same for identical mirrors
+	Roots string // Hash of root commits, same for mirrors with common history
+	Size  int64
+}
+
+// dedupeCmd is 'dedupe-report' command: find identical repositories backed up
+// under different names and repositories with common history, and suggest
+// consolidation to reclaim space
+func dedupeCmd(args []string) {
+	fs := flag.NewFlagSet("dedupe-report", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup dedupe-report [-output folder]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	mirrors, err := findMirrors(*output)
+	if err != nil {
+		logFatal(err)
+	}
+	var ids []mirrorIdentity
+	for _, mirror := range mirrors {
+		if isObjectStore(*output, mirror) {
+			continue
+		}
+		id, err := getMirrorIdentity(*output, mirror)
+		if err != nil {
+			logWarn(fmt.Sprintf("%s: %s", mirror, err), "mirror", mirror,
+				"error", err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	// Identical mirrors
+	var reclaim int64
+	fmt.Println("Identical repositories:")
+	for _, group := range dedupeGroups(ids, func(id mirrorIdentity) string {
+		return id.Refs
+	}, false) {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Size > group[j].Size
+		})
+		var size int64
+		for _, id := range group[1:] {
+			size += id.Size
+		}
+		reclaim += size
+		fmt.Printf("\n  keep %s, %s can be reclaimed by removing:\n",
+			group[0].Path, formatSize(size))
+		for _, id := range group[1:] {
+			fmt.Printf("    %s (%s)\n", id.Path, formatSize(id.Size))
+		}
+	}
+
+	// Mirrors with common history
+	fmt.Println("\nRepositories with common root commits (forks, renames):")
+	for _, group := range dedupeGroups(ids, func(id mirrorIdentity) string {
+		return id.Roots
+	}, true) {
+		fmt.Println()
+		for _, id := range group {
+			fmt.Printf("    %s (%s)\n", id.Path, formatSize(id.Size))
+		}
+	}
+	fmt.Printf("\nscanned %d mirrors, %s can be reclaimed by removing"+
+		" identical repositories\n", len(ids), formatSize(reclaim))
+}
+
+// getMirrorIdentity return identity of mirror
+func getMirrorIdentity(output, mirror string) (id mirrorIdentity, err error) {
+	id = mirrorIdentity{Path: mirror, Size: dirSize(mirror)}
+	id.Name, _ = filepath.Rel(output, mirror)
+	if snapshot, name, ok := strings.Cut(id.Name, string(filepath.Separator)); ok {
+		if _, err := time.Parse(snapshotLayout, snapshot); err == nil {
+			id.Name = name
+		}
+	}
+
+	refs, err := exec.Command("git", "-C", mirror, "for-each-ref",
+		"--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		err = fmt.Errorf("%s: can't get refs: %s", mirror, err)
+		return
+	}
+	roots, err := exec.Command("git", "-C", mirror, "rev-list",
+		"--max-parents=0", "--all").Output()
+	if err != nil {
+		err = fmt.Errorf("%s: can't get root commits: %s", mirror, err)
+		return
+	}
+	rootList := strings.Fields(string(roots))
+	sort.Strings(rootList)
+
+	if len(refs) != 0 {
+		id.Refs = fmt.Sprintf("%x", sha256.Sum256(refs))
+	}
+	if len(rootList) != 0 {
+		id.Roots = fmt.Sprintf("%x", sha256.Sum256(
+			[]byte(strings.Join(rootList, "\n"))))
+	}
+	return
+}
+
+// dedupeGroups return groups of mirrors with the same not empty key and
+// different names. Mirrors with the same name (the same repository in
+// different snapshots) are not duplicates, so only first of them is added to
+// group. Groups of mirrors with the same key and identical content are
+// skipped if skipIdentical is set
+func dedupeGroups(ids []mirrorIdentity, key func(id mirrorIdentity) string,
+	skipIdentical bool) (groups [][]mirrorIdentity) {
+
+	byKey := map[string][]mirrorIdentity{}
+	names := map[string]map[string]bool{}
+	var keys []string
+	for _, id := range ids {
+		k := key(id)
+		if len(k) == 0 {
+			continue
+		}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+			names[k] = map[string]bool{}
+		}
+		if names[k][id.Name] {
+			continue
+		}
+		names[k][id.Name] = true
+		byKey[k] = append(byKey[k], id)
+	}
+	for _, k := range keys {
+		group := byKey[k]
+		if len(group) < 2 {
+			continue
+		}
+		identical := true
+		for _, id := range group[1:] {
+			identical = identical && id.Refs == group[0].Refs
+		}
+		if identical && skipIdentical {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// describeStage write repository description to mirror 'description' file
+// and homepage, topics, owner and web url to mirror config, so git hosting
+// frontends (gitweb, cgit with enable-git-config) pointed at the backup
+// folder display meaningful information. Repository settings are saved to
+// owner/repo.metadata.json file, and labels and milestones to
+// owner/repo.labels.json and owner/repo.milestones.json files
+func describeStage(j *pipelineJob) error {
+	var data struct {
+		repoMetadata
+		HTMLURL string `json:"html_url"`
+		Owner   struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+		Permissions struct {
+			Admin bool `json:"admin"`
+		} `json:"permissions"`
+	}
+	if err := newAPIClient(j.acc.endpoint).get("/repos/"+j.repo,
+		&data); err != nil {
+		return err
+	}
+	if err := writeMetadata(j, exportMetadata(j, data.repoMetadata,
+		data.Permissions.Admin)); err != nil {
+		return err
+	}
+
+	for _, path := range j.paths {
+		if !strings.HasSuffix(path, ".git") {
+			continue
+		}
+		mirror := filepath.Join(j.dir, path)
+		desc := data.Description
+		if strings.HasSuffix(path, ".wiki.git") {
+			desc = "Wiki of " + j.repo
+		}
+		if len(desc) == 0 {
+			desc = j.repo
+		}
+		err := os.WriteFile(filepath.Join(mirror, "description"),
+			[]byte(desc+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+
+		config := [][2]string{
+			{"gitweb.description", desc},
+			{"gitweb.owner", data.Owner.Login},
+			{"gitweb.homepage", data.Homepage},
+			{"gitweb.url", data.HTMLURL},
+			{"github.topics", strings.Join(data.Topics, ",")},
+		}
+		for _, kv := range config {
+			if len(kv[1]) == 0 {
+				run("git", "-C", mirror, "config", "--unset", kv[0])
+				continue
+			}
+			if err := run("git", "-C", mirror, "config", kv[0],
+				kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, export := range []struct{ name, endpoint string }{
+		{"labels", "/labels?per_page=100"},
+		{"milestones", "/milestones?state=all&per_page=100"},
+	} {
+		if err := exportList(j, export.name, export.endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
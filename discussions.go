@@ -0,0 +1,264 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backup discussions flag
+var discussions bool
+
+// discussionsExport is repository discussions export written to
+// owner/repo.discussions.json file
+type discussionsExport struct {
+	Categories  []discussionCategory `json:"categories"`
+	Discussions []discussion         `json:"discussions"`
+}
+
+// discussionCategory is repository discussion category
+type discussionCategory struct {
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Emoji       string `json:"emoji"`
+	Description string `json:"description"`
+	Answerable  bool   `json:"isAnswerable"`
+}
+
+// discussionAuthor is author of discussion or comment, nil if the account
+// is deleted
+type discussionAuthor struct {
+	Login string `json:"login"`
+}
+
+// discussion is discussion thread with comments
+type discussion struct {
+	ID        string            `json:"id"`
+	Number    int               `json:"number"`
+	Title     string            `json:"title"`
+	Body      string            `json:"body"`
+	URL       string            `json:"url"`
+	Author    *discussionAuthor `json:"author"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	Closed    bool              `json:"closed"`
+	Locked    bool              `json:"locked"`
+	Upvotes   int               `json:"upvoteCount"`
+	Category  struct {
+		Name string `json:"name"`
+	} `json:"category"`
+	Labels struct {
+		Nodes []struct {
+			Name string `json:"name"`
+		} `json:"nodes"`
+	} `json:"labels"`
+	Answer *struct {
+		ID string `json:"id"`
+	} `json:"answer"`
+	Comments discussionComments `json:"comments"`
+}
+
+// discussionComments is discussion comments or comment replies connection.
+// Page info is removed when all pages are read
+type discussionComments struct {
+	PageInfo *graphqlPageInfo    `json:"pageInfo,omitempty"`
+	Nodes    []discussionComment `json:"nodes"`
+}
+
+// discussionComment is discussion comment or reply to comment
+type discussionComment struct {
+	ID        string              `json:"id"`
+	Body      string              `json:"body"`
+	Author    *discussionAuthor   `json:"author"`
+	CreatedAt time.Time           `json:"createdAt"`
+	IsAnswer  bool                `json:"isAnswer"`
+	Upvotes   int                 `json:"upvoteCount"`
+	Replies   *discussionComments `json:"replies,omitempty"`
+}
+
+// GraphQL queries fields of discussions, comments and replies
+const (
+	replyFields   = `id body author { login } createdAt isAnswer upvoteCount`
+	commentFields = replyFields + ` replies(first: 100) { pageInfo ` +
+		`{ hasNextPage endCursor } nodes { ` + replyFields + ` } }`
+	commentsPage = `pageInfo { hasNextPage endCursor } nodes { ` +
+		commentFields + ` }`
+	discussionFields = `id number title body url author { login } createdAt ` +
+		`updatedAt closed locked upvoteCount category { name } ` +
+		`labels(first: 100) { nodes { name } } answer { id } ` +
+		`comments(first: 100) { ` + commentsPage + ` }`
+)
+
+// discussionsStage export repository discussion categories, threads,
+// comments with replies and accepted answers with GraphQL api to
+// owner/repo.discussions.json file, and each thread to Markdown file
+// owner/repo.discussions/<number>.md readable without any tools
+func discussionsStage(j *pipelineJob) error {
+	owner, name, _ := strings.Cut(j.repo, "/")
+	api := newAPIClient(j.acc.endpoint)
+	export := discussionsExport{Discussions: []discussion{}}
+	var cursor interface{}
+	for {
+		var data struct {
+			Repository struct {
+				Categories struct {
+					Nodes []discussionCategory `json:"nodes"`
+				} `json:"discussionCategories"`
+				Discussions struct {
+					PageInfo graphqlPageInfo `json:"pageInfo"`
+					Nodes    []discussion    `json:"nodes"`
+				} `json:"discussions"`
+			} `json:"repository"`
+		}
+		err := api.graphql(`query($owner: String!, $name: String!, `+
+			`$cursor: String) { repository(owner: $owner, name: $name) { `+
+			`discussionCategories(first: 100) { nodes { name slug emoji `+
+			`description isAnswerable } } discussions(first: 25, after: `+
+			`$cursor, orderBy: {field: CREATED_AT, direction: ASC}) { `+
+			`pageInfo { hasNextPage endCursor } nodes { `+discussionFields+
+			` } } } }`, map[string]interface{}{"owner": owner, "name": name,
+			"cursor": cursor}, &data)
+		if err != nil {
+			return err
+		}
+		export.Categories = data.Repository.Categories.Nodes
+		for _, d := range data.Repository.Discussions.Nodes {
+			if err := discussionPages(api, d.ID, &d.Comments); err != nil {
+				return fmt.Errorf("discussion #%d: %w", d.Number, err)
+			}
+			export.Discussions = append(export.Discussions, d)
+		}
+		page := data.Repository.Discussions.PageInfo
+		if !page.HasNextPage {
+			break
+		}
+		cursor = page.EndCursor
+	}
+
+	file := j.path + ".discussions.json"
+	if err := writeJSON(filepath.Join(j.dir, file), export); err != nil {
+		return err
+	}
+	folder := j.path + ".discussions"
+	dir := filepath.Join(j.dir, filepath.FromSlash(folder))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, d := range export.Discussions {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.md", d.Number)),
+			[]byte(discussionMarkdown(d)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	j.paths = append(j.paths, file, folder)
+	j.files = j.paths
+	return nil
+}
+
+// discussionPages read remaining pages of discussion comments and of each
+// comment replies
+func discussionPages(api *apiClient, id string, c *discussionComments) error {
+	if err := commentsPages(api, id, "Discussion", commentFields, c); err != nil {
+		return err
+	}
+	for i := range c.Nodes {
+		if r := c.Nodes[i].Replies; r != nil {
+			err := commentsPages(api, c.Nodes[i].ID, "DiscussionComment",
+				replyFields, r)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commentsPages read remaining pages of comments or replies connection of
+// node with id and type, and remove its page info
+func commentsPages(api *apiClient, id, typ, fields string,
+	c *discussionComments) error {
+
+	conn := "comments"
+	if typ == "DiscussionComment" {
+		conn = "replies"
+	}
+	for c.PageInfo != nil && c.PageInfo.HasNextPage {
+		var data struct {
+			Node map[string]discussionComments `json:"node"`
+		}
+		err := api.graphql(`query($id: ID!, $cursor: String) { node(id: $id) `+
+			`{ ... on `+typ+` { `+conn+`(first: 100, after: $cursor) { `+
+			`pageInfo { hasNextPage endCursor } nodes { `+fields+` } } } } }`,
+			map[string]interface{}{"id": id, "cursor": c.PageInfo.EndCursor},
+			&data)
+		if err != nil {
+			return err
+		}
+		page := data.Node[conn]
+		c.Nodes = append(c.Nodes, page.Nodes...)
+		c.PageInfo = page.PageInfo
+	}
+	c.PageInfo = nil
+	return nil
+}
+
+// discussionMarkdown return discussion thread in Markdown: title, category,
+// author and state, body and comments with replies, accepted answer marked
+func discussionMarkdown(d discussion) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s (#%d)\n\n", d.Title, d.Number)
+	fmt.Fprintf(&b, "Category: %s. Opened by %s on %s", d.Category.Name,
+		discussionLogin(d.Author), d.CreatedAt.Format("2006-01-02 15:04 MST"))
+	if d.Answer != nil {
+		b.WriteString(", answered")
+	}
+	if d.Closed {
+		b.WriteString(", closed")
+	}
+	if d.Locked {
+		b.WriteString(", locked")
+	}
+	var labels []string
+	for _, l := range d.Labels.Nodes {
+		labels = append(labels, l.Name)
+	}
+	if len(labels) != 0 {
+		fmt.Fprintf(&b, ". Labels: %s", strings.Join(labels, ", "))
+	}
+	fmt.Fprintf(&b, ".\n<%s>\n\n%s\n", d.URL, strings.TrimSpace(d.Body))
+	for _, c := range d.Comments.Nodes {
+		b.WriteString("\n---\n\n")
+		fmt.Fprintf(&b, "## %s commented on %s", discussionLogin(c.Author),
+			c.CreatedAt.Format("2006-01-02 15:04 MST"))
+		if c.IsAnswer {
+			b.WriteString(" (accepted answer)")
+		}
+		fmt.Fprintf(&b, "\n\n%s\n", strings.TrimSpace(c.Body))
+		if c.Replies == nil {
+			continue
+		}
+		for _, r := range c.Replies.Nodes {
+			fmt.Fprintf(&b, "\n### %s replied on %s\n\n%s\n",
+				discussionLogin(r.Author),
+				r.CreatedAt.Format("2006-01-02 15:04 MST"),
+				strings.TrimSpace(r.Body))
+		}
+	}
+	return b.String()
+}
+
+// discussionLogin return author login mention, or ghost if the author
+// account is deleted
+func discussionLogin(a *discussionAuthor) string {
+	if a == nil {
+		return "@ghost"
+	}
+	return "@" + a.Login
+}
@@ -0,0 +1,417 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Emergency backup items statuses
+const (
+	itemOK     = "ok"
+	itemFailed = "failed"
+	itemNone   = "none" // Item doesn't exist
+)
+
+// emergencyItem is status of one backed up item of emergency backup
+type emergencyItem struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Count  int    `json:"count,omitempty"` // Number of exported entries
+	Error  string `json:"error,omitempty"`
+}
+
+// emergencyRepo is emergency backup items of repository
+type emergencyRepo struct {
+	Repo  string          `json:"repo"`
+	Items []emergencyItem `json:"items"`
+}
+
+// emergencyReport is completeness report of emergency backup
+type emergencyReport struct {
+	User         string          `json:"user"`
+	Start        time.Time       `json:"start"`
+	End          time.Time       `json:"end"`
+	Account      []emergencyItem `json:"account"`
+	Repos        []emergencyRepo `json:"repos"`
+	Items        int             `json:"items"`
+	Failed       int             `json:"failed"`
+	Completeness float64         `json:"completeness"` // Percent of items backed up
+}
+
+// emergencyCmd is 'emergency' command: backup entire github account in one
+// pass with aggressive parallelism, e.g. when the account gets suspended
+// tomorrow: profile, stars list, gists, all repositories with wikis, issues,
+// pull requests, comments and releases with assets. Prints completeness
+// report and saves it to emergency-report.json
+func emergencyCmd(args []string) {
+	fs := flag.NewFlagSet("emergency", flag.ExitOnError)
+	user := fs.String("user", "", "[host/]user or organisation to backup")
+	output := fs.String("output", "", "local folder name to save backup, default: emergency-<user>")
+	jobs := fs.Int("jobs", 8, "number of repositories backed up in parallel")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup emergency -user [host/]name [-output folder] [-jobs n]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*user) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(*output) == 0 {
+		*output = "emergency-" + filepath.Base(*user)
+	}
+
+	acc := parseAccount(*user, map[string]*endpoint{})
+	setAPICache(*output)
+	r := emergencyBackup(acc, *output, *jobs)
+	printEmergencyReport(r)
+	if r.Failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// emergencyBackup backup account to output folder with jobs repositories in
+// parallel and return completeness report
+func emergencyBackup(acc account, output string, jobs int) *emergencyReport {
+	r := &emergencyReport{User: acc.String(), Start: time.Now().UTC()}
+	api := newAPIClient(acc.endpoint)
+	dir := filepath.Join(output, acc.path(acc.Name))
+
+	// Account items: profile, stars list and gists
+	var profile json.RawMessage
+	err := api.get("/users/"+acc.Name, &profile)
+	if err == nil {
+		err = writeJSON(filepath.Join(dir, "profile.json"), profile)
+	}
+	r.Account = append(r.Account, newEmergencyItem("profile", 1, err))
+
+	starred, err := apiList(api, "/users/"+acc.Name+"/starred?per_page=100")
+	if err == nil {
+		err = writeJSON(filepath.Join(dir, "starred.json"), starred)
+	}
+	r.Account = append(r.Account, newEmergencyItem("starred", len(starred), err))
+	r.Account = append(r.Account, emergencyGists(acc, dir)...)
+
+	// Repositories
+	repos, err := emergencyRepos(acc)
+	r.Account = append(r.Account, newEmergencyItem("repos", len(repos), err))
+	if jobs < 1 {
+		jobs = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan emergencyRepoInfo)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repo := range ch {
+				items := emergencyRepoItems(acc, output, repo)
+				logInfo(fmt.Sprintf("emergency: %s done", repo.FullName),
+					repoFields(repo.FullName)...)
+				mu.Lock()
+				r.Repos = append(r.Repos, emergencyRepo{repo.FullName, items})
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, repo := range repos {
+		ch <- repo
+	}
+	close(ch)
+	wg.Wait()
+	sort.Slice(r.Repos, func(i, j int) bool {
+		return r.Repos[i].Repo < r.Repos[j].Repo
+	})
+
+	// Completeness
+	count := func(items []emergencyItem) {
+		for _, item := range items {
+			switch item.Status {
+			case itemOK:
+				r.Items++
+			case itemFailed:
+				r.Items++
+				r.Failed++
+			}
+		}
+	}
+	count(r.Account)
+	for _, repo := range r.Repos {
+		count(repo.Items)
+	}
+	if r.Items != 0 {
+		r.Completeness = float64(r.Items-r.Failed) * 100 / float64(r.Items)
+	}
+	r.End = time.Now().UTC()
+	if err := writeJSON(filepath.Join(output, "emergency-report.json"),
+		r); err != nil {
+		logError("write emergency report", "error", err)
+	}
+	return r
+}
+
+// emergencyRepoInfo is repository listed in emergency backup
+type emergencyRepoInfo struct {
+	FullName  string `json:"full_name"`
+	HasWiki   bool   `json:"has_wiki"`
+	HasIssues bool   `json:"has_issues"`
+}
+
+// emergencyRepos return all repositories of account. Private repositories
+// are listed when the token belongs to the account user
+func emergencyRepos(acc account) (repos []emergencyRepoInfo, err error) {
+	api := newAPIClient(acc.endpoint)
+	endpoint := "/users/" + acc.Name + "/repos?per_page=100&type=owner"
+	var me struct {
+		Login string `json:"login"`
+	}
+	if api.get("/user", &me) == nil && strings.EqualFold(me.Login, acc.Name) {
+		endpoint = "/user/repos?per_page=100&affiliation=owner"
+	} else if org, _ := isOrg(acc); org {
+		endpoint = "/orgs/" + acc.Name + "/repos?per_page=100&type=all"
+	}
+	list, err := apiList(api, endpoint)
+	for _, data := range list {
+		var repo emergencyRepoInfo
+		if json.Unmarshal(data, &repo) == nil {
+			repos = append(repos, repo)
+		}
+	}
+	return
+}
+
+// emergencyGists clone all gists of account to gists folder and save gists
+// list to gists.json
+func emergencyGists(acc account, dir string) (items []emergencyItem) {
+	api := newAPIClient(acc.endpoint)
+	list, err := apiList(api, "/users/"+acc.Name+"/gists?per_page=100")
+	if err == nil {
+		err = writeJSON(filepath.Join(dir, "gists.json"), list)
+	}
+	items = append(items, newEmergencyItem("gists", len(list), err))
+	for _, data := range list {
+		var gist struct {
+			ID         string `json:"id"`
+			GitPullURL string `json:"git_pull_url"`
+		}
+		if json.Unmarshal(data, &gist) != nil {
+			continue
+		}
+		mirror := filepath.Join(dir, "gists", gist.ID+".git")
+		var err error
+		if _, serr := os.Stat(filepath.Join(mirror, "HEAD")); serr == nil {
+			err = run("git", "-C", mirror, "fetch", "-q", "--prune", "origin")
+		} else {
+			err = run("git", "clone", "-q", "--mirror", gist.GitPullURL, mirror)
+		}
+		items = append(items, newEmergencyItem("gist "+gist.ID, 1, err))
+	}
+	return
+}
+
+// emergencyRepoItems backup repository mirror, wiki, issues, pull requests,
+// comments and releases with assets
+func emergencyRepoItems(acc account, output string,
+	repo emergencyRepoInfo) (items []emergencyItem) {
+
+	name := repo.FullName
+	base := filepath.Join(output, acc.path(name))
+	err := cloneMirror(acc, name, base+".git", nil, "")
+	items = append(items, newEmergencyItem("mirror", 1, err))
+
+	if repo.HasWiki {
+		item := emergencyItem{Name: "wiki", Status: itemOK, Count: 1}
+		if cloneMirror(acc, name+".wiki", base+".wiki.git", nil, "") != nil {
+			item = emergencyItem{Name: "wiki", Status: itemNone}
+		}
+		items = append(items, item)
+	}
+
+	api := newAPIClient(acc.endpoint)
+	for _, export := range []struct {
+		name, endpoint string
+		issues         bool // Exported only if issues are enabled
+	}{
+		{"issues", "/issues?state=all&per_page=100", true},
+		{"pulls", "/pulls?state=all&per_page=100", false},
+		{"comments", "/issues/comments?per_page=100", true},
+		{"review-comments", "/pulls/comments?per_page=100", false},
+		{"labels", "/labels?per_page=100", false},
+		{"milestones", "/milestones?state=all&per_page=100", false},
+	} {
+		if export.issues && !repo.HasIssues {
+			items = append(items, emergencyItem{Name: export.name,
+				Status: itemNone})
+			continue
+		}
+		list, err := apiList(api, "/repos/"+name+export.endpoint)
+		if err == nil {
+			err = writeJSON(base+"."+export.name+".json", list)
+		}
+		items = append(items, newEmergencyItem(export.name, len(list), err))
+	}
+
+	releases, err := apiList(api, "/repos/"+name+"/releases?per_page=100")
+	if err == nil {
+		err = writeJSON(base+".releases.json", releases)
+	}
+	items = append(items, newEmergencyItem("releases", len(releases), err))
+	for _, data := range releases {
+		var release struct {
+			TagName string `json:"tag_name"`
+			ID      int64  `json:"id"`
+			Assets  []struct {
+				Name   string `json:"name"`
+				URL    string `json:"url"`
+				Size   int64  `json:"size"`
+				Digest string `json:"digest"`
+			} `json:"assets"`
+		}
+		if json.Unmarshal(data, &release) != nil {
+			continue
+		}
+		tag := release.TagName
+		if len(tag) == 0 {
+			tag = fmt.Sprint(release.ID)
+		}
+		for _, asset := range release.Assets {
+			name := filepath.Join(base+".releases", filepath.Base(tag),
+				filepath.Base(asset.Name))
+			err := api.download(asset.URL, name)
+			if err == nil {
+				_, err = verifyAsset(name, asset.Size, asset.Digest)
+			}
+			items = append(items, newEmergencyItem("asset "+tag+"/"+
+				asset.Name, 1, err))
+		}
+	}
+	return
+}
+
+// newEmergencyItem return emergency backup item with status of error
+func newEmergencyItem(name string, count int, err error) emergencyItem {
+	item := emergencyItem{Name: name, Status: itemOK, Count: count}
+	if err != nil {
+		item.Status, item.Error, item.Count = itemFailed, err.Error(), 0
+		logWarn(fmt.Sprintf("emergency: %s: %s", name, err), "item", name,
+			"error", err)
+	}
+	return item
+}
+
+// printEmergencyReport print emergency backup completeness report
+func printEmergencyReport(r *emergencyReport) {
+	printItems := func(items []emergencyItem) {
+		for _, item := range items {
+			count := ""
+			if item.Status == itemOK {
+				count = fmt.Sprint(item.Count)
+			}
+			fmt.Printf("  %-40s %-7s %6s %s\n", item.Name, item.Status, count,
+				firstLine(item.Error))
+		}
+	}
+	fmt.Printf("Account %s:\n", r.User)
+	printItems(r.Account)
+	for _, repo := range r.Repos {
+		fmt.Printf("%s:\n", repo.Repo)
+		printItems(repo.Items)
+	}
+	fmt.Printf("\nBacked up %d of %d items, %d failed, completeness %.1f%%, %s\n",
+		r.Items-r.Failed, r.Items, r.Failed, r.Completeness,
+		r.End.Sub(r.Start).Round(time.Second))
+}
+
+// firstLine return first line of text
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
+
+// apiList return all list items of paginated api endpoint. The endpoint
+// should contain query parameters with per_page=100
+func apiList(api *apiClient, endpoint string) (list []json.RawMessage,
+	err error) {
+
+	list = []json.RawMessage{}
+	for p := 1; ; p++ {
+		var page []json.RawMessage
+		if err = api.get(fmt.Sprintf("%s&page=%d", endpoint, p),
+			&page); err != nil {
+			return
+		}
+		list = append(list, page...)
+		if len(page) < 100 {
+			return
+		}
+	}
+}
+
+// download save api asset url content to file
+func (c *apiClient) download(url, name string) error {
+	req, err := c.newRequest("GET", strings.TrimPrefix(url, c.APIURL))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &apiError{resp.StatusCode, fmt.Sprintf("GET %s: %s\n%s", url,
+			resp.Status, body)}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// writeJSON write v to file in indented json format, creating file folder
+func writeJSON(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, out.Bytes(), 0644)
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encryption recipients set by -encrypt-recipient parameter. The recipients
+// are age public keys (age1...), ssh public keys or files with age
+// recipients when encryptAge is true, or GPG key ids, fingerprints or emails
+var encryptRecipients []string
+var encryptAge bool
+
+// Decryption identity set by serve -identity parameter: age identity file
+// used to decrypt .age files. The .gpg files are decrypted with keys of gpg
+// keyring
+var decryptIdentity string
+
+// parseRecipients parse comma separated recipients list. All recipients should
+// be age recipients or all should be GPG keys
+func parseRecipients(list string) error {
+	encryptRecipients = nil
+	var age, gpg int
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if len(r) == 0 {
+			continue
+		}
+		encryptRecipients = append(encryptRecipients, r)
+		if isAgeRecipient(r) {
+			age++
+		} else {
+			gpg++
+		}
+	}
+	if age > 0 && gpg > 0 {
+		return fmt.Errorf("age and gpg recipients can't be mixed: %s", list)
+	}
+	encryptAge = age > 0
+	return nil
+}
+
+// isAgeRecipient return true if recipient is age or ssh public key or age
+// recipients file (prefixed with '@')
+func isAgeRecipient(r string) bool {
+	return strings.HasPrefix(r, "age1") || strings.HasPrefix(r, "ssh-") ||
+		strings.HasPrefix(r, "@")
+}
+
+// encryptExt return encrypted file extension
+func encryptExt() string {
+	switch {
+	case len(encryptRecipients) == 0:
+		return ""
+	case encryptAge:
+		return ".age"
+	}
+	return ".gpg"
+}
+
+// newEncryptor return writer which encrypt data to w with 'age' or 'gpg' cli
+// application. Data is written to w as is if recipients are not set
+func newEncryptor(w io.Writer) (io.WriteCloser, error) {
+	if len(encryptRecipients) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	var args []string
+	if encryptAge {
+		for _, r := range encryptRecipients {
+			if strings.HasPrefix(r, "@") {
+				args = append(args, "-R", r[1:])
+			} else {
+				args = append(args, "-r", r)
+			}
+		}
+		return newCmdWriter(w, "age", args...)
+	}
+	args = []string{"--batch", "--yes", "--trust-model", "always", "--encrypt"}
+	for _, r := range encryptRecipients {
+		args = append(args, "--recipient", r)
+	}
+	return newCmdWriter(w, "gpg", args...)
+}
+
+// isEncrypted return true if file name has encrypted file extension
+func isEncrypted(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".age" || ext == ".gpg"
+}
+
+// newDecryptor return writer which decrypt data of file with ext extension
+// to w with 'age' or 'gpg' cli application
+func newDecryptor(w io.Writer, ext string) (io.WriteCloser, error) {
+	switch {
+	case ext == ".gpg":
+		return newCmdWriter(w, "gpg", "--batch", "--quiet", "--decrypt")
+	case ext != ".age":
+		return nil, fmt.Errorf("unsupported encrypted file extension %s", ext)
+	case len(decryptIdentity) == 0:
+		return nil, fmt.Errorf("age identity file is not set")
+	}
+	return newCmdWriter(w, "age", "--decrypt", "-i", decryptIdentity)
+}
+
+// decryptFile decrypt .age or .gpg file to file without the extension and
+// remove encrypted file. Returns decrypted file name
+func decryptFile(name string) (decrypted string, err error) {
+	ext := filepath.Ext(name)
+	decrypted = strings.TrimSuffix(name, ext)
+
+	in, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(decrypted)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out.Name())
+			return
+		}
+		os.Remove(in.Name())
+	}()
+
+	dw, err := newDecryptor(out, ext)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(dw, in); err != nil {
+		dw.Close()
+		return
+	}
+	err = dw.Close()
+	return
+}
+
+// nopWriteCloser is writer with empty Close method
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,223 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// publisher publish events to message queue
+type publisher interface {
+	publish(data []byte) error
+	String() string
+}
+
+// Event publishers created from -events parameter
+var publishers []publisher
+
+// backupEvent is per-repo or per-run event published to message queues
+type backupEvent struct {
+	Type     string    `json:"type"` // Event type: repo or run
+	Host     string    `json:"host"`
+	Time     time.Time `json:"time"`
+	Repo     string    `json:"repo,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Head     string    `json:"head,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Duration float64   `json:"duration"` // Duration in seconds
+	Error    string    `json:"error,omitempty"`
+	Repos    int       `json:"repos,omitempty"`
+	Failed   int       `json:"failed,omitempty"`
+}
+
+// newPublishers create event publishers from comma separated list of urls:
+//
+//	nats://[user:password@]host[:port]/subject
+//	kafka://broker[:port][;broker...]/topic
+//	amqp[s]://[user:password@]host[:port]/[vhost]?exchange=name&key=routing-key
+func newPublishers(list string) (p []publisher, err error) {
+	for _, rawurl := range strings.Split(list, ",") {
+		rawurl = strings.TrimSpace(rawurl)
+		if len(rawurl) == 0 {
+			continue
+		}
+		scheme, rest, _ := strings.Cut(rawurl, "://")
+		switch scheme {
+		case "nats":
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			host := u.Host
+			if len(u.Port()) == 0 {
+				host += ":4222"
+			}
+			subject := strings.Trim(u.Path, "/")
+			if len(subject) == 0 {
+				return nil, fmt.Errorf("nats subject is not set in '%s'", rawurl)
+			}
+			p = append(p, &natsPublisher{host, subject, u.User})
+		case "kafka":
+			brokers, topic, _ := strings.Cut(rest, "/")
+			if len(topic) == 0 {
+				return nil, fmt.Errorf("kafka topic is not set in '%s'", rawurl)
+			}
+			p = append(p, &kafkaPublisher{strings.ReplaceAll(brokers, ";", ","),
+				topic})
+		case "amqp", "amqps":
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			q := u.Query()
+			u.RawQuery = ""
+			p = append(p, &amqpPublisher{u, q.Get("exchange"), q.Get("key")})
+		default:
+			return nil, fmt.Errorf("unsupported events url '%s'", rawurl)
+		}
+	}
+	return
+}
+
+// publishEvent publish event to all publishers
+func publishEvent(e backupEvent) {
+	if len(publishers) == 0 {
+		return
+	}
+	e.Host, e.Time = hostname(), time.Now().UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		logError("event error", "error", err)
+		return
+	}
+	for _, p := range publishers {
+		if err := p.publish(data); err != nil {
+			logError(fmt.Sprintf("event error: %s", p), "error", err)
+		}
+	}
+}
+
+// publishRepoEvent publish repository backup result event
+func publishRepoEvent(r *repoResult) {
+	e := backupEvent{Type: "repo", Repo: r.Path, Status: "success", Head: r.Tip,
+		Size: r.Size, Duration: r.Duration.Seconds()}
+	if r.Err != nil {
+		e.Status, e.Error = "failed", r.Err.Error()
+	}
+	publishEvent(e)
+}
+
+// publishRunEvent publish run finished event
+func publishRunEvent() {
+	e := backupEvent{Type: "run", Status: "success", Repos: len(results),
+		Failed: failedResults(), Duration: time.Since(runStart).Seconds()}
+	if e.Failed > 0 {
+		e.Status = "failed"
+	}
+	publishEvent(e)
+}
+
+// natsPublisher publish events to NATS subject with NATS text protocol
+type natsPublisher struct {
+	host    string
+	subject string
+	user    *url.Userinfo
+}
+
+func (p *natsPublisher) String() string {
+	return "nats://" + p.host + "/" + p.subject
+}
+
+func (p *natsPublisher) publish(data []byte) error {
+	conn, err := net.DialTimeout("tcp", p.host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// Read server INFO and send CONNECT, PUB and PING
+	if _, err := r.ReadString('\n'); err != nil {
+		return err
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false,
+		"name": "github-backup"}
+	if p.user != nil {
+		opts["user"] = p.user.Username()
+		opts["pass"], _ = p.user.Password()
+	}
+	connect, _ := json.Marshal(opts)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CONNECT %s\r\n", connect)
+	fmt.Fprintf(&b, "PUB %s %d\r\n%s\r\nPING\r\n", p.subject, len(data), data)
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	// Wait PONG which confirms the message is processed
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+	}
+}
+
+// kafkaPublisher publish events to Kafka topic with kcat cli
+type kafkaPublisher struct {
+	brokers string
+	topic   string
+}
+
+func (p *kafkaPublisher) String() string {
+	return "kafka://" + p.brokers + "/" + p.topic
+}
+
+func (p *kafkaPublisher) publish(data []byte) error {
+	cmd := exec.Command("kcat", "-P", "-b", p.brokers, "-t", p.topic)
+	cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("kcat: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// amqpPublisher publish events to AMQP exchange with amqp-publish cli
+type amqpPublisher struct {
+	url      *url.URL
+	exchange string
+	key      string
+}
+
+func (p *amqpPublisher) String() string {
+	return p.url.Redacted()
+}
+
+func (p *amqpPublisher) publish(data []byte) error {
+	out, err := exec.Command("amqp-publish", "--url="+p.url.String(),
+		"--exchange="+p.exchange, "--routing-key="+p.key,
+		"--content-type=application/json", "--body="+string(data),
+	).CombinedOutput()
+	if err != nil {
+		// The url with password is not included to error
+		return fmt.Errorf("amqp-publish: %s\n%s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// failoverDest is primary destination with fallback destination. When the
+// primary destination is unavailable at start of run the fallback
+// destination is used for that run, and files written to the fallback are
+// copied to the primary (reconciled) from the local output folder when the
+// primary returns
+type failoverDest struct {
+	primary, fallback destination
+	active            destination
+	pendingFile       string            // Files written to fallback list
+	pending           map[string]string // Local files by path written to fallback
+}
+
+// newFailoverDest create failover destination from 'primary|fallback' urls
+func newFailoverDest(primary, fallback string) (d *failoverDest, err error) {
+	d = &failoverDest{pending: map[string]string{}}
+	if d.primary, err = newDestination(strings.TrimSpace(primary)); err != nil {
+		return
+	}
+	if d.fallback, err = newDestination(strings.TrimSpace(fallback)); err != nil {
+		return
+	}
+	d.active = d.primary
+	return
+}
+
+func (d *failoverDest) String() string {
+	if d.active == d.fallback {
+		return d.fallback.String() + " (fallback of " + d.primary.String() + ")"
+	}
+	return d.primary.String()
+}
+
+func (d *failoverDest) putFile(local, path string) error {
+	if err := d.active.putFile(local, path); err != nil {
+		return err
+	}
+	return d.addPending(local, path)
+}
+
+func (d *failoverDest) putDir(local, path string) error {
+	if err := d.active.putDir(local, path); err != nil {
+		return err
+	}
+	return d.addPending(local, path)
+}
+
+// addPending add local file and its path written to fallback destination to
+// pending list. The path differs from local file path when destination names
+// rules are set
+func (d *failoverDest) addPending(local, path string) error {
+	if _, ok := d.pending[path]; d.active != d.fallback || ok {
+		return nil
+	}
+	d.pending[path] = local
+	return d.savePending()
+}
+
+// savePending save pending list to file or remove file if list is empty
+func (d *failoverDest) savePending() error {
+	if len(d.pending) == 0 {
+		err := os.Remove(d.pendingFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	var paths []string
+	for path, local := range d.pending {
+		paths = append(paths, path+"\t"+local)
+	}
+	sort.Strings(paths)
+	if err := os.MkdirAll(filepath.Dir(d.pendingFile), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(d.pendingFile,
+		[]byte(strings.Join(paths, "\n")+"\n"), 0644)
+}
+
+// start check primary destination availability by writing probe file. If the
+// primary is available the files written to fallback in previous runs are
+// copied to primary from output folder, otherwise the fallback is activated
+func (d *failoverDest) start(output string) {
+	h := sha1.Sum([]byte(d.primary.String()))
+	d.pendingFile = filepath.Join(output, ".github-backup",
+		fmt.Sprintf("failover-%x.pending", h[:6]))
+	if data, err := os.ReadFile(d.pendingFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			path, local, ok := strings.Cut(line, "\t")
+			if !ok {
+				local = filepath.Join(output, path)
+			}
+			if len(path) != 0 {
+				d.pending[path] = local
+			}
+		}
+	}
+
+	// Probe primary destination
+	probe := filepath.Join(output, ".github-backup", "probe")
+	err := os.MkdirAll(filepath.Dir(probe), 0755)
+	if err == nil {
+		err = os.WriteFile(probe, []byte(hostname()+"\n"), 0644)
+	}
+	if err == nil {
+		err = d.primary.putFile(probe, ".github-backup-probe")
+	}
+	if err != nil {
+		logWarn(fmt.Sprintf("destination %s is unavailable, use fallback %s",
+			d.primary, d.fallback), "destination", fmt.Sprint(d.primary),
+			"fallback", fmt.Sprint(d.fallback), "error", err)
+		sendNotify(notifyWarning, "Github backup destination failover",
+			fmt.Sprintf("destination %s is unavailable, fallback %s is used"+
+				" on %s", d.primary, d.fallback, hostname()))
+		d.active = d.fallback
+		return
+	}
+
+	// Reconcile files written to fallback
+	for path, local := range d.pending {
+		info, err := os.Stat(local)
+		switch {
+		case os.IsNotExist(err):
+			logWarn(fmt.Sprintf("reconcile %s: local copy of %s is removed",
+				d.primary, path), "destination", fmt.Sprint(d.primary),
+				"path", path)
+		case err != nil:
+			logError("reconcile "+fmt.Sprint(d.primary), "path", path,
+				"error", err)
+			continue
+		case info.IsDir():
+			err = d.primary.putDir(local, path)
+		default:
+			err = d.primary.putFile(local, path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logError("reconcile "+fmt.Sprint(d.primary), "path", path,
+				"error", err)
+			continue
+		}
+		delete(d.pending, path)
+	}
+	if err := d.savePending(); err != nil {
+		logError("save fallback pending files", "error", err)
+	}
+}
+
+// startFailover start all failover destinations
+func startFailover(output string) {
+	for _, d := range dests {
+		if f, ok := d.(*failoverDest); ok {
+			f.start(output)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Failure thresholds: maximum number and percent of failed repositories
+// before the remainder of run is aborted, 0 - not limited
+var maxFailures int
+var maxFailureRate float64
+
+// Number of failed repositories allowed, the run is considered failed only
+// when more repositories failed
+var allowedFailures int
+
+// Minimum number of backed up repositories before failure rate is checked
+const failureRateMin = 10
+
+// Exit codes of the run: success (failed repositories don't exceed allowed
+// failures), total failure (fatal error, authentication error, aborted run or
+// all repositories failed) and partial failure of some repositories. The code
+// 2 is reserved for command line usage errors
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitPartial = 3
+)
+
+// Reason of run abort, empty if run is not aborted
+var abortReason string
+
+// parseFailureRate parse failure rate percent like 30% or 30
+func parseFailureRate(s string) (float64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s),
+		"%"), 64)
+	if err != nil || rate < 0 || rate > 100 {
+		return 0, fmt.Errorf("wrong failure rate '%s'", s)
+	}
+	return rate, nil
+}
+
+// runFailed return true if failed repositories exceed allowed failures
+func runFailed(failed int) bool {
+	return failed > allowedFailures
+}
+
+// exitCode return exit code of finished run with failed repositories
+func exitCode(failed int) int {
+	switch {
+	case !runFailed(failed):
+		return exitSuccess
+	case failed >= len(results):
+		return exitFailure
+	}
+	return exitPartial
+}
+
+// runAborted return true if failures of this run exceed failure thresholds,
+// which indicates systemic problem (expired token, dead network), so the
+// remainder of run should be aborted
+func runAborted() bool {
+	if len(abortReason) != 0 {
+		return true
+	}
+	failed := failedResults()
+	switch {
+	case maxFailures > 0 && failed >= maxFailures:
+		abortReason = fmt.Sprintf("%d repositories failed, -max-failures is %d",
+			failed, maxFailures)
+	case maxFailureRate > 0 && len(results) >= failureRateMin &&
+		float64(failed)*100 >= maxFailureRate*float64(len(results)):
+		abortReason = fmt.Sprintf("%d of %d repositories failed, "+
+			"-max-failure-rate is %g%%", failed, len(results), maxFailureRate)
+	default:
+		return false
+	}
+	logError("abort run: " + abortReason)
+	return true
+}
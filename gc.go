@@ -0,0 +1,375 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// gcDest is destination which files may be listed and removed by
+// gc-destination command
+type gcDest interface {
+	destination
+	// listFiles return slash separated paths of all files in destination
+	// folder dir, all files of destination if dir is empty
+	listFiles(dir string) ([]string, error)
+	// removeFile remove file of the path from destination
+	removeFile(path string) error
+}
+
+// gcDestinationCmd is 'gc-destination' command: find files in destination
+// which are not referenced by retained backups of the output folder (left by
+// crashed uploads or pruned backups) and remove them after confirmation
+func gcDestinationCmd(args []string) {
+	fs := flag.NewFlagSet("gc-destination", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	yes := fs.Bool("yes", false, "remove unreferenced files without confirmation")
+	names := fs.String("dest-names", "", "destination paths transformation rules used by backup runs")
+	dryRun := fs.Bool("dry-run", false, "print unreferenced files but does not remove them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup gc-destination [-output folder] [-dest-names rules] [-yes] [-dry-run] destination-url")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if nameRules, err = parseNameRules(*names); err != nil {
+		logFatal(err)
+	}
+	d, err := newDestination(fs.Arg(0))
+	if err != nil {
+		logFatal(err)
+	}
+	gd, ok := d.(gcDest)
+	if !ok {
+		logFatal(fmt.Sprintf("destination %s doesn't support listing files", d))
+	}
+	refs, err := retainedFiles(*output)
+	if err != nil {
+		logFatal(err)
+	}
+	files, err := gd.listFiles("")
+	if err != nil {
+		logFatal(err)
+	}
+	orphans := refs.orphans(files)
+	if len(orphans) == 0 {
+		fmt.Printf("%s: %d files, no unreferenced files found\n", d, len(files))
+		return
+	}
+	for _, file := range orphans {
+		fmt.Println(file)
+	}
+	fmt.Printf("%s: %d of %d files are not referenced by retained backups\n",
+		d, len(orphans), len(files))
+	if *dryRun {
+		return
+	}
+	if !*yes {
+		fmt.Print("Remove them? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" &&
+			a != "yes" {
+			fmt.Println("nothing removed")
+			return
+		}
+	}
+	var failed int
+	for _, file := range orphans {
+		if err := gd.removeFile(file); err != nil {
+			logError("remove "+file, "file", file, "error", err)
+			failed++
+		}
+	}
+	fmt.Printf("%d files removed, %d failed\n", len(orphans)-failed, failed)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// gcRefs is destination paths of files retained in the output folder
+type gcRefs struct {
+	paths map[string]bool
+}
+
+// addFile add file path relative to the output folder. Name rules are
+// applied to uploaded file or folder, so destination path of every parent
+// folder of the file is added
+func (r *gcRefs) addFile(file string) {
+	r.paths[destPath(file)] = true
+	for i := range file {
+		if file[i] == '/' {
+			r.paths[destPath(file[:i])+file[i:]] = true
+		}
+	}
+}
+
+// referenced return true if destination file is retained
+func (r *gcRefs) referenced(file string) bool {
+	return r.paths[file]
+}
+
+// orphans return sorted destination files not referenced by retained
+// backups
+func (r *gcRefs) orphans(files []string) (orphans []string) {
+	for _, file := range files {
+		if !r.referenced(file) {
+			orphans = append(orphans, file)
+		}
+	}
+	sort.Strings(orphans)
+	return
+}
+
+// retainedFiles return files retained in the output folder. The output folder
+// keeps every retained backup copied to destinations (mirrors, archives,
+// bundles and exports), so destination file without local counterpart is
+// left by crashed upload or by backup removed from the output folder
+func retainedFiles(output string) (refs *gcRefs, err error) {
+	refs = &gcRefs{paths: map[string]bool{}}
+	if _, err = os.Stat(output); err != nil {
+		return nil, fmt.Errorf("output folder %s: %w, nothing is known to be "+
+			"retained", output, err)
+	}
+	err = walkFiles(output, func(file, rel string) error {
+		refs.addFile(rel)
+		return nil
+	})
+	if err == nil && len(refs.paths) == 0 {
+		err = fmt.Errorf("output folder %s is empty, nothing is known to be "+
+			"retained", output)
+	}
+	return
+}
+
+// localDest files listing and removal
+
+func (d localDest) listFiles(dir string) (files []string, err error) {
+	root := filepath.Join(string(d), filepath.FromSlash(dir))
+	if _, err = os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+	err = walkFiles(root, func(file, rel string) error {
+		files = append(files, joinPath(dir, rel))
+		return nil
+	})
+	return
+}
+
+func (d localDest) removeFile(path string) error {
+	return os.Remove(filepath.Join(string(d), filepath.FromSlash(path)))
+}
+
+// s3Dest files listing and removal
+
+func (d *s3Dest) listFiles(dir string) (files []string, err error) {
+	out, err := exec.Command("aws", "s3", "ls", "--recursive",
+		"s3://"+d.bucket+"/"+dirPrefix(d.prefix, dir)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws s3 ls %s: %w", d, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// Line format: date time size key, key may contain spaces
+		key := line
+		for i := 0; i < 3; i++ {
+			key = strings.TrimLeft(key, " ")
+			if n := strings.IndexByte(key, ' '); n >= 0 {
+				key = key[n:]
+			} else {
+				key = ""
+			}
+		}
+		if key = strings.TrimLeft(key, " "); len(key) != 0 {
+			files = append(files, strings.TrimPrefix(key,
+				joinPath(d.prefix, "")))
+		}
+	}
+	return
+}
+
+func (d *s3Dest) removeFile(path string) error {
+	return run("aws", "s3", "rm", "--only-show-errors", d.url(path))
+}
+
+// gcsDest files listing and removal
+
+func (d *gcsDest) listFiles(dir string) (files []string, err error) {
+	root := "gs://" + d.bucket + "/" + joinPath(d.prefix, "")
+	out, err := exec.Command("gcloud", "storage", "ls", "gs://"+d.bucket+"/"+
+		dirPrefix(d.prefix, dir)+"**").Output()
+	if err != nil {
+		return nil, fmt.Errorf("gcloud storage ls %s: %w", d, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, root) &&
+			!strings.HasSuffix(line, "/") {
+			files = append(files, strings.TrimPrefix(line, root))
+		}
+	}
+	return
+}
+
+func (d *gcsDest) removeFile(path string) error {
+	return run("gcloud", "storage", "rm", "--quiet", d.url(path))
+}
+
+// azureDest files listing and removal
+
+func (d *azureDest) listFiles(dir string) (files []string, err error) {
+	prefix := joinPath(d.prefix, "")
+	out, err := exec.Command("az", "storage", "blob", "list",
+		"--only-show-errors", "--account-name", d.account, "--container-name",
+		d.container, "--prefix", dirPrefix(d.prefix, dir), "--num-results",
+		"*", "--query", "[].name", "--output", "tsv").Output()
+	if err != nil {
+		return nil, fmt.Errorf("az storage blob list %s: %w", d, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			files = append(files, strings.TrimPrefix(line, prefix))
+		}
+	}
+	return
+}
+
+func (d *azureDest) removeFile(path string) error {
+	return run("az", "storage", "blob", "delete", "--only-show-errors",
+		"--account-name", d.account, "--container-name", d.container,
+		"--name", joinPath(d.prefix, path))
+}
+
+// sftpDest files listing and removal. Files are listed with remote 'find'
+// command over ssh, sftp protocol has no recursive listing
+
+func (d *sftpDest) listFiles(dir string) (files []string, err error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if len(d.port) != 0 {
+		args = append(args, "-p", d.port)
+	}
+	root := d.dir
+	if len(dir) != 0 {
+		root += "/" + dir
+	}
+	quoted := "'" + strings.ReplaceAll(root, "'", `'\''`) + "'"
+	args = append(args, d.host, "find "+quoted+" -type f")
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh %s find: %w", d.host, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if rel := strings.TrimPrefix(line, d.dir+"/"); rel != line {
+			files = append(files, rel)
+		}
+	}
+	return
+}
+
+func (d *sftpDest) removeFile(path string) error {
+	return d.batch([]string{"rm " + sftpQuote(d.dir+"/"+path)})
+}
+
+// webdavDest files listing and removal
+
+// davMultistatus is WebDAV PROPFIND response
+type davMultistatus struct {
+	Responses []struct {
+		Href       string `xml:"href"`
+		Collection *struct {
+		} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+func (d *webdavDest) listFiles(dir string) (files []string, err error) {
+	u, err := url.Parse(d.base)
+	if err != nil {
+		return
+	}
+	base := strings.TrimSuffix(u.Path, "/") + "/"
+	dirs := []string{dirPrefix("", dir)}
+	for len(dirs) != 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		var ms davMultistatus
+		if ms, err = d.propfind(dir); err != nil {
+			return
+		}
+		for _, r := range ms.Responses {
+			href, err := url.Parse(r.Href)
+			if err != nil {
+				return nil, err
+			}
+			rel := strings.TrimPrefix(href.Path, base)
+			if rel == href.Path {
+				continue
+			}
+			rel = strings.TrimSuffix(rel, "/")
+			switch {
+			case rel == strings.TrimSuffix(dir, "/"):
+			case r.Collection != nil:
+				dirs = append(dirs, rel+"/")
+			default:
+				files = append(files, rel)
+			}
+		}
+	}
+	return
+}
+
+// propfind list collection members of dir with PROPFIND request
+func (d *webdavDest) propfind(dir string) (ms davMultistatus, err error) {
+	u := d.base + "/" + (&url.URL{Path: dir}).EscapedPath()
+	req, err := http.NewRequest("PROPFIND", u, strings.NewReader(
+		`<?xml version="1.0"?><propfind xmlns="DAV:"><prop><resourcetype/>`+
+			`</prop></propfind>`))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	if len(d.user) != 0 {
+		req.SetBasicAuth(d.user, d.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return
+	case resp.StatusCode != http.StatusMultiStatus:
+		io.Copy(io.Discard, resp.Body)
+		return ms, fmt.Errorf("PROPFIND %s: %s", u, resp.Status)
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&ms)
+	return
+}
+
+func (d *webdavDest) removeFile(path string) error {
+	status, err := d.request(http.MethodDelete, path, nil, 0)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 && status != http.StatusNotFound {
+		return fmt.Errorf("DELETE %s/%s: %s", d.base, path,
+			http.StatusText(status))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles create files with paths relative to dir folder
+func writeFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		name := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGCDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  []string // Output folder files
+		dest    []string // Destination files
+		orphans []string
+	}{
+		{
+			name: "mirror format",
+			output: []string{"o/a.git/HEAD", "o/a.git/objects/pack/pack-2.pack",
+				"o/a.sbom.json"},
+			dest: []string{"o/a.git/HEAD", "o/a.git/objects/pack/pack-1.pack",
+				"o/a.git/objects/pack/pack-2.pack", "o/a.sbom.json",
+				"o/gone.git/HEAD"},
+			orphans: []string{"o/a.git/objects/pack/pack-1.pack",
+				"o/gone.git/HEAD"},
+		},
+		{
+			name: "archives",
+			output: []string{"o/a-20220101.tar.gz", "o/a-20220102.tar.gz",
+				"repos.json", "index.html"},
+			dest: []string{"o/a-20220101.tar.gz", "o/a-20220102.tar.gz",
+				"o/a-20220103.tar.gz", "repos.json", "index.html"},
+			orphans: []string{"o/a-20220103.tar.gz"},
+		},
+		{
+			// Bundles chain without SHA256SUMS manifest is retained by
+			// chain files of the output folder
+			name: "bundles chain",
+			output: []string{"o/a.bundle", "o/a.bundle.refs",
+				"o/a-20220101T000000.inc.bundle",
+				"o/a-20220102T000000.inc.bundle"},
+			dest: []string{"o/a.bundle", "o/a.bundle.refs",
+				"o/a-20220101T000000.inc.bundle",
+				"o/a-20220102T000000.inc.bundle",
+				"o/gone-20220101T000000.inc.bundle"},
+			orphans: []string{"o/gone-20220101T000000.inc.bundle"},
+		},
+		{
+			name:    "nothing to remove",
+			output:  []string{"o/a.bundle", "o/b.bundle"},
+			dest:    []string{"o/a.bundle"},
+			orphans: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := t.TempDir()
+			writeFiles(t, output, tt.output...)
+			dest := localDest(t.TempDir())
+			writeFiles(t, string(dest), tt.dest...)
+			refs, err := retainedFiles(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := dest.listFiles("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.dest) {
+				t.Fatalf("%d files listed, %d expected", len(files),
+					len(tt.dest))
+			}
+			orphans := refs.orphans(files)
+			if !reflect.DeepEqual(orphans, tt.orphans) {
+				t.Fatalf("orphans:\n%s\nexpected:\n%s",
+					strings.Join(orphans, "\n"), strings.Join(tt.orphans, "\n"))
+			}
+			for _, file := range orphans {
+				if err := dest.removeFile(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if files, _ = dest.listFiles(""); len(files) !=
+				len(tt.dest)-len(tt.orphans) {
+				t.Errorf("%d files left, %d expected", len(files),
+					len(tt.dest)-len(tt.orphans))
+			}
+		})
+	}
+}
+
+func TestGCEmptyOutput(t *testing.T) {
+	for _, output := range []string{t.TempDir(),
+		filepath.Join(t.TempDir(), "missing")} {
+		if _, err := retainedFiles(output); err == nil {
+			t.Errorf("%s: retained files of empty output folder", output)
+		}
+	}
+}
+
+func TestGCDestNames(t *testing.T) {
+	defer func(rules []nameRule) { nameRules = rules }(nameRules)
+	var err error
+	if nameRules, err = parseNameRules("lower,map=my-org/old:archive/new"); err != nil {
+		t.Fatal(err)
+	}
+	output := t.TempDir()
+	writeFiles(t, output, "My-Org/Repo.git/HEAD", "my-org/old.git/HEAD",
+		"my-org/old-20220101.tar.gz")
+	refs, err := retainedFiles(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans := refs.orphans([]string{"my-org/repo.git/HEAD",
+		"archive/new.git/HEAD", "archive/new-20220101.tar.gz",
+		"archive/gone.git/HEAD"})
+	if !reflect.DeepEqual(orphans, []string{"archive/gone.git/HEAD"}) {
+		t.Errorf("orphans: %v", orphans)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// graphqlPageInfo is GraphQL connection page info
+type graphqlPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+// graphqlURL return GraphQL api url of endpoint: api.github.com/graphql for
+// github.com and host/api/graphql for GitHub Enterprise Server
+func (c *apiClient) graphqlURL() string {
+	return strings.TrimSuffix(c.APIURL, "/v3") + "/graphql"
+}
+
+// graphql execute GraphQL query with variables and unmarshal response data
+// to v. Errors of GraphQL response are returned as error
+func (c *apiClient) graphql(query string, vars map[string]interface{},
+	v interface{}) error {
+
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := c.send(http.MethodPost, c.graphqlURL(), map[string]interface{}{
+		"query": query, "variables": vars}, &resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) != 0 {
+		var msgs []string
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("graphql: %s", strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(resp.Data, v)
+}
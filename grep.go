@@ -0,0 +1,129 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// grepCmd is 'grep' command: run git grep against HEAD of every local mirror
+// in parallel and print matches with repository, file and line
+func grepCmd(args []string) {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "number of mirrors searched in parallel")
+	ignoreCase := fs.Bool("i", false, "ignore case")
+	fixed := fs.Bool("F", false, "pattern is fixed string, not regular expression")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup grep [-output folder] [-jobs n] [-i] [-F] <pattern>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	mirrors, err := latestMirrors(*output)
+	if err != nil {
+		logFatal(err)
+	}
+	gitArgs := []string{"grep", "-n", "-I", "--no-color"}
+	if *ignoreCase {
+		gitArgs = append(gitArgs, "-i")
+	}
+	if *fixed {
+		gitArgs = append(gitArgs, "-F")
+	}
+	gitArgs = append(gitArgs, "-e", fs.Arg(0), "HEAD")
+
+	// Search mirrors in parallel and print matches in mirrors order
+	matches := make([][]string, len(mirrors))
+	errs := make([]error, len(mirrors))
+	var wg sync.WaitGroup
+	ch := make(chan int)
+	for w := 0; w < *jobs || w == 0; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				matches[i], errs[i] = grepMirror(mirrors[i], gitArgs)
+			}
+		}()
+	}
+	for i := range mirrors {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	var found int
+	for i, mirror := range mirrors {
+		if errs[i] != nil {
+			logWarn(fmt.Sprintf("%s: %s", mirror, errs[i]), "mirror", mirror,
+				"error", errs[i])
+			continue
+		}
+		repo, _ := filepath.Rel(*output, mirror)
+		repo = strings.TrimSuffix(repo, ".git")
+		for _, m := range matches[i] {
+			fmt.Printf("%s:%s\n", repo, m)
+			found++
+		}
+	}
+	if found == 0 {
+		os.Exit(1)
+	}
+}
+
+// grepMirror run git grep in mirror and return matches in file:line:text
+// form
+func grepMirror(mirror string, args []string) (matches []string, err error) {
+	out, err := exec.Command("git", append([]string{"-C", mirror},
+		args...)...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, nil // No matches
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) != 0 {
+			matches = append(matches, strings.TrimPrefix(line, "HEAD:"))
+		}
+	}
+	return
+}
+
+// latestMirrors return mirrors in output folder and in the newest snapshot,
+// mirrors of older snapshots are skipped
+func latestMirrors(output string) (mirrors []string, err error) {
+	all, err := findMirrors(output)
+	if err != nil {
+		return
+	}
+	snapshots, _ := listSnapshots(output)
+	old := map[string]bool{}
+	for i := 1; i < len(snapshots); i++ {
+		old[snapshots[i].Name] = true
+	}
+	for _, mirror := range all {
+		rel, _ := filepath.Rel(output, mirror)
+		first, _, _ := strings.Cut(rel, string(filepath.Separator))
+		if !old[first] && !isObjectStore(output, mirror) {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return
+}
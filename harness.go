@@ -0,0 +1,495 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// End-to-end local test mode flag set by -e2e-local parameter
+var e2eLocal bool
+
+// Mock github user repositories are restored to
+const mockRestoreOwner = "restored"
+
+// mockRepo is repository served by mock github server
+type mockRepo struct {
+	FullName string `json:"full_name"`
+	Private  bool   `json:"private"`
+	License  *struct {
+		SpdxID string `json:"spdx_id"`
+	} `json:"license"`
+	HasWiki bool `json:"has_wiki"`
+}
+
+// mockGitHub is test harness: mock github rest api server and local bare
+// repositories used as git remotes
+type mockGitHub struct {
+	dir    string // Harness folder with remotes folder
+	repos  []mockRepo
+	server *httptest.Server
+}
+
+// newMockGitHub create mock github with owner repositories in dir folder:
+// bare remotes with commits, tags and wiki, and api server
+func newMockGitHub(dir, owner string) (m *mockGitHub, err error) {
+	m = &mockGitHub{dir: dir}
+	mit := &struct {
+		SpdxID string `json:"spdx_id"`
+	}{"MIT"}
+	m.repos = []mockRepo{
+		{FullName: owner + "/alpha", License: mit, HasWiki: true},
+		{FullName: owner + "/beta", Private: true},
+	}
+	for _, r := range m.repos {
+		if err = m.createRemote(r.FullName, true); err != nil {
+			return
+		}
+		if r.HasWiki {
+			if err = m.createRemote(r.FullName+".wiki", false); err != nil {
+				return
+			}
+		}
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serve))
+	return
+}
+
+// endpoint return mock github endpoint
+func (m *mockGitHub) endpoint() *endpoint {
+	return &endpoint{
+		Host:    "github.mock",
+		APIURL:  m.server.URL,
+		GitHost: "github.mock",
+		GitURL:  "file://" + filepath.Join(m.dir, "remotes"),
+		ListAPI: true,
+	}
+}
+
+// close stop mock api server
+func (m *mockGitHub) close() {
+	m.server.Close()
+}
+
+// git execute git command with harness identity in folder
+func (m *mockGitHub) git(dir string, args ...string) error {
+	args = append([]string{"-C", dir, "-c", "user.name=github-backup",
+		"-c", "user.email=e2e@github-backup.local"}, args...)
+	return run("git", args...)
+}
+
+// createRemote create bare remote repository with commits, and with tag and
+// license file if tagged is set
+func (m *mockGitHub) createRemote(repo string, tagged bool) error {
+	work := filepath.Join(m.dir, "work", repo)
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+	if err := run("git", "init", "-q", work); err != nil {
+		return err
+	}
+	files := map[string]string{"README.md": "# " + repo + "\n"}
+	if tagged {
+		files["LICENSE"] = "MIT License\n\nPermission is hereby granted, " +
+			"free of charge, to any person obtaining a copy\n"
+	}
+	for name, text := range files {
+		err := os.WriteFile(filepath.Join(work, name), []byte(text), 0644)
+		if err != nil {
+			return err
+		}
+		if err := m.git(work, "add", name); err != nil {
+			return err
+		}
+		if err := m.git(work, "commit", "-q", "-m", "Add "+name); err != nil {
+			return err
+		}
+	}
+	if tagged {
+		if err := m.git(work, "tag", "v1.0.0"); err != nil {
+			return err
+		}
+	}
+	bare := filepath.Join(m.dir, "remotes", repo+".git")
+	return run("git", "clone", "-q", "--bare", work, bare)
+}
+
+// addCommit add commit with new file to mock remote repository
+func (m *mockGitHub) addCommit(repo, name string) error {
+	work := filepath.Join(m.dir, "work", repo)
+	err := os.WriteFile(filepath.Join(work, name), []byte(name+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	if err = m.git(work, "add", name); err != nil {
+		return err
+	}
+	if err = m.git(work, "commit", "-q", "-m", "Add "+name); err != nil {
+		return err
+	}
+	return run("git", "-C", filepath.Join(m.dir, "remotes", repo+".git"),
+		"fetch", "-q", work, "+refs/heads/*:refs/heads/*")
+}
+
+// serve mock github api requests used by backup
+func (m *mockGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	path := r.URL.Path
+	var v interface{}
+	switch {
+	case r.Method == http.MethodPost && path == "/user/repos":
+		var req struct {
+			Name    string `json:"name"`
+			HasWiki bool   `json:"has_wiki"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		repo := mockRestoreOwner + "/" + req.Name
+		bare := filepath.Join(m.dir, "remotes", repo+".git")
+		if _, err := os.Stat(bare); err == nil {
+			http.Error(w, `{"message":"name already exists on this account"}`,
+				http.StatusUnprocessableEntity)
+			return
+		}
+		if err := run("git", "init", "-q", "--bare", bare); err != nil {
+			http.Error(w, `{"message":"can't create repository"}`,
+				http.StatusInternalServerError)
+			return
+		}
+		if req.HasWiki {
+			run("git", "init", "-q", "--bare", filepath.Join(m.dir, "remotes",
+				repo+".wiki.git"))
+		}
+		w.WriteHeader(http.StatusCreated)
+		v = map[string]string{"full_name": repo}
+	case r.Method == http.MethodPatch &&
+		strings.HasPrefix(path, "/repos/"+mockRestoreOwner+"/"):
+		v = map[string]string{}
+	case path == "/":
+		w.Header().Set("X-OAuth-Scopes", "repo, read:org")
+		v = map[string]string{}
+	case strings.HasSuffix(path, "/repos") || strings.HasSuffix(path, "/starred"):
+		list := []mockRepo{}
+		if r.URL.Query().Get("page") == "1" && strings.HasSuffix(path, "/repos") {
+			list = m.repos
+		}
+		v = list
+	case strings.HasSuffix(path, "/releases") ||
+		strings.HasSuffix(path, "/milestones"):
+		v = []interface{}{}
+	case strings.HasSuffix(path, "/labels"):
+		v = []map[string]string{{"name": "bug", "color": "d73a4a",
+			"description": "Something isn't working"}}
+	case strings.HasSuffix(path, "/dependency-graph/sbom"):
+		v = map[string]interface{}{"sbom": map[string]string{
+			"spdxVersion": "SPDX-2.3"}}
+	case strings.HasPrefix(path, "/repos/"):
+		name := strings.TrimPrefix(path, "/repos/")
+		for i := range m.repos {
+			if m.repos[i].FullName == name {
+				v = m.repos[i]
+			}
+		}
+	case path == "/users/"+mockRestoreOwner:
+		v = map[string]string{"login": mockRestoreOwner, "type": "User"}
+	}
+	if v == nil {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// remoteTip return HEAD commit hash of mock remote
+func (m *mockGitHub) remoteTip(repo string) string {
+	return headTip(filepath.Join(m.dir, "remotes", repo+".git"))
+}
+
+// runE2E run end-to-end backup and restore cycle against mock github in
+// temporary folder: backup in mirror, archive and bundle formats, verify
+// mirrors and archives, restore from bundles and compare with remotes.
+// Returns process exit code
+func runE2E() int {
+	dir, err := os.MkdirTemp("", "github-backup-e2e-")
+	if err != nil {
+		logError("e2e: create temporary folder", "error", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	const owner = "octo"
+	m, err := newMockGitHub(dir, owner)
+	if err != nil {
+		logError("e2e: create mock github", "error", err)
+		return 1
+	}
+	defer m.close()
+	e := m.endpoint()
+	apiClients.m[e.Host] = &apiClient{endpoint: e, token: "e2e"}
+	acc := account{endpoint: e, Name: owner}
+
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			return
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	check("token scopes", checkScopes([]account{acc}))
+
+	for _, f := range []string{formatMirror, formatArchive, formatBundle} {
+		parseFormats(f)
+		results, checksums = nil, map[string]string{}
+		output := filepath.Join(dir, "backup-"+f)
+		getRepos(output, acc, "1000", nil, false)
+
+		var errs []string
+		for _, r := range results {
+			if r.Err != nil {
+				errs = append(errs, r.Repo+": "+r.Err.Error())
+			}
+		}
+		if len(results) != len(m.repos) {
+			errs = append(errs, fmt.Sprintf("%d repositories backed up, %d"+
+				" expected", len(results), len(m.repos)))
+		}
+		check("backup "+f, e2eErr(errs))
+
+		switch f {
+		case formatMirror:
+			mirrors, err := findMirrors(output)
+			if err == nil && len(mirrors) != len(m.repos)+1 {
+				err = fmt.Errorf("%d mirrors found, %d expected", len(mirrors),
+					len(m.repos)+1)
+			}
+			if err == nil {
+				for mirror, merr := range verifyMirrors(mirrors, 2) {
+					err = fmt.Errorf("%s: %s", mirror, merr)
+				}
+			}
+			check("verify mirrors", err)
+			errs = nil
+			for _, r := range m.repos {
+				meta, err := readMetadata(filepath.Join(output,
+					acc.path(r.FullName)+metadataSuffix))
+				if err == nil && (meta.Private != r.Private ||
+					meta.HasWiki != r.HasWiki) {
+					err = fmt.Errorf("settings mismatch")
+				}
+				var labels []struct {
+					Name string `json:"name"`
+				}
+				if err == nil {
+					_, err = readExport(filepath.Join(output,
+						acc.path(r.FullName))+".labels.json", &labels)
+				}
+				if err == nil && (len(labels) != 1 || labels[0].Name != "bug") {
+					err = fmt.Errorf("labels mismatch")
+				}
+				if err != nil {
+					errs = append(errs, r.FullName+": "+err.Error())
+				}
+			}
+			check("metadata files", e2eErr(errs))
+			check("write manifest", writeManifest(output))
+			check("write report", writeReport(filepath.Join(output,
+				"report.json")))
+			check("write html report", writeHTMLReport(filepath.Join(output,
+				"report.html")))
+			check("restore to github", e2eRestore(m, output))
+
+		case formatArchive:
+			errs = nil
+			for _, r := range m.repos {
+				name := filepath.Join(output, acc.path(r.FullName))
+				archives, _ := filepath.Glob(name + "-*.tar.gz")
+				tip := ""
+				if len(archives) == 1 {
+					tip = archiveTip(archives[0], filepath.Base(r.FullName))
+				}
+				if tip != m.remoteTip(r.FullName) {
+					errs = append(errs, r.FullName+": archive tip mismatch")
+				}
+			}
+			check("archive tips", e2eErr(errs))
+
+			// Extract archives and compare restored mirrors with the
+			// archived mirrors: content, permissions, symlinks and times
+			errs = nil
+			for _, r := range m.repos {
+				// Archive mirror with symlink inside git folder
+				path := acc.path(r.FullName)
+				name := filepath.Join(output, path)
+				os.Symlink("description", filepath.Join(name+".git",
+					"description.link"))
+				if _, err := archiveRepo(output, path,
+					[]string{path + ".git"}); err != nil {
+					errs = append(errs, r.FullName+": "+err.Error())
+					continue
+				}
+				archives, _ := filepath.Glob(name + "-*.tar.gz")
+				if len(archives) != 1 {
+					continue
+				}
+				extracted := filepath.Join(dir, "extract", r.FullName)
+				err := extractArchive(archives[0], extracted)
+				if err == nil {
+					base := filepath.Base(r.FullName) + ".git"
+					err = compareTrees(name+".git",
+						filepath.Join(extracted, base))
+				}
+				if err == nil {
+					mirror := filepath.Join(extracted,
+						filepath.Base(r.FullName)+".git")
+					for _, merr := range verifyMirrors([]string{mirror}, 1) {
+						err = merr
+					}
+				}
+				if err != nil {
+					errs = append(errs, r.FullName+": "+err.Error())
+				}
+			}
+			check("extract archives", e2eErr(errs))
+			check("write checksums", writeChecksums(output))
+
+		case formatBundle:
+			errs = nil
+			for _, r := range m.repos {
+				base := filepath.Join(output, acc.path(r.FullName))
+				restored := filepath.Join(dir, "restore", r.FullName+".git")
+				if err := run("git", "clone", "-q", "--mirror",
+					base+".bundle", restored); err != nil {
+					errs = append(errs, r.FullName+": "+err.Error())
+					continue
+				}
+				if headTip(restored) != m.remoteTip(r.FullName) {
+					errs = append(errs, r.FullName+": restored tip mismatch")
+				}
+			}
+			check("restore from bundles", e2eErr(errs))
+		}
+	}
+
+	// Backup to mirror and bundle destinations from one fetch
+	parseFormats(formatMirror + "," + formatBundle)
+	results = nil
+	destMirror := filepath.Join(dir, "dest-mirror")
+	destBundle := filepath.Join(dir, "dest-bundle")
+	err = newDestinations("mirror:" + destMirror + ",bundle:" + destBundle)
+	if err == nil {
+		getRepos(filepath.Join(dir, "backup-multi"), acc, "1000", nil, false)
+		var errs []string
+		for _, r := range results {
+			if r.Err != nil {
+				errs = append(errs, r.Repo+": "+r.Err.Error())
+			}
+		}
+		mirrors, _ := findMirrors(destMirror)
+		bundles, _ := filepath.Glob(filepath.Join(destBundle, "*", "*",
+			"*.bundle"))
+		if len(mirrors) != len(m.repos)+1 || len(bundles) != len(m.repos)+1 {
+			errs = append(errs, fmt.Sprintf("%d mirrors and %d bundles "+
+				"copied, %d expected", len(mirrors), len(bundles),
+				len(m.repos)+1))
+		}
+		err = e2eErr(errs)
+	}
+	check("backup mirror,bundle", err)
+	dests, destFormats, destStats = nil, nil, nil
+	parseFormats(formatMirror)
+
+	if failed != 0 {
+		fmt.Printf("e2e: %d checks failed\n", failed)
+		return 1
+	}
+	fmt.Println("e2e: all checks passed")
+	return 0
+}
+
+// e2eRestore restore mirrors of output folder to mock github restore owner
+// twice, the second restore updates existing repositories, and compare
+// restored repositories and wikis tips with remotes
+func e2eRestore(m *mockGitHub, output string) error {
+	acc := account{endpoint: m.endpoint(), Name: mockRestoreOwner}
+	repos, err := findRestorable(output, nil)
+	if err != nil {
+		return err
+	}
+	if len(repos) != len(m.repos) {
+		return fmt.Errorf("%d repositories to restore found, %d expected",
+			len(repos), len(m.repos))
+	}
+	var errs []string
+	for i := 0; i < 2; i++ {
+		for _, r := range repos {
+			if err := restoreRepository(acc, output, r, false); err != nil {
+				errs = append(errs, r.path+": "+err.Error())
+			}
+		}
+	}
+	for _, r := range m.repos {
+		name := mockRestoreOwner + "/" + filepath.Base(r.FullName)
+		if m.remoteTip(name) != m.remoteTip(r.FullName) {
+			errs = append(errs, name+": restored tip mismatch")
+		}
+		if r.HasWiki && m.remoteTip(name+".wiki") != m.remoteTip(
+			r.FullName+".wiki") {
+			errs = append(errs, name+": restored wiki tip mismatch")
+		}
+	}
+	return e2eErr(errs)
+}
+
+// compareTrees compare files of restored folder with original folder:
+// content size, portable permissions, symlinks targets and modification times
+func compareTrees(orig, restored string) error {
+	return filepath.Walk(orig, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(orig, p)
+		r, err := os.Lstat(filepath.Join(restored, rel))
+		if err != nil {
+			return err
+		}
+		switch {
+		case portableMode(info) != portableMode(r):
+			return fmt.Errorf("%s: mode %v, restored %v", rel, info.Mode(),
+				r.Mode())
+		case info.Mode().Type() != r.Mode().Type():
+			return fmt.Errorf("%s: type changed", rel)
+		case info.Mode().IsRegular() && info.Size() != r.Size():
+			return fmt.Errorf("%s: size changed", rel)
+		case info.Mode()&os.ModeSymlink == 0 &&
+			info.ModTime().Unix() != r.ModTime().Unix():
+			return fmt.Errorf("%s: mtime %s, restored %s", rel,
+				info.ModTime(), r.ModTime())
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			l1, _ := os.Readlink(p)
+			l2, _ := os.Readlink(filepath.Join(restored, rel))
+			if l1 != l2 {
+				return fmt.Errorf("%s: symlink %s, restored %s", rel, l1, l2)
+			}
+		}
+		return nil
+	})
+}
+
+// e2eErr return error with list of errors or nil if list is empty
+func e2eErr(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chdir change working directory to dir for the test duration
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// newTestGitHub create mock github with octo owner repositories in temporary
+// folder and set api client of its endpoint
+func newTestGitHub(t *testing.T) *mockGitHub {
+	t.Helper()
+	m, err := newMockGitHub(t.TempDir(), "octo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.close)
+	e := m.endpoint()
+	apiClients.m[e.Host] = &apiClient{endpoint: e, token: "test"}
+	return m
+}
+
+// mirrorRemote clone mirror of mock remote repository to dir/path.git
+func mirrorRemote(t *testing.T, m *mockGitHub, repo, dir, path string) {
+	t.Helper()
+	err := run("git", "clone", "-q", "--mirror", filepath.Join(m.dir,
+		"remotes", repo+".git"), filepath.Join(dir, path+".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestE2E(t *testing.T) {
+	if testing.Short() {
+		t.Skip("end-to-end backup and restore cycle in short mode")
+	}
+	defer func(f []string, r []repoResult, c map[string]string) {
+		formats, format, results, checksums = f, f[0], r, c
+	}(formats, results, checksums)
+
+	if code := runE2E(); code != 0 {
+		t.Fatalf("e2e exit code %d", code)
+	}
+}
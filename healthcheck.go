@@ -0,0 +1,60 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Healthcheck ping url, empty if healthcheck is not pinged
+var healthcheckURL string
+
+// Healthcheck start is pinged, so failure should be pinged on fatal error
+var healthcheckStarted bool
+
+// pingHealthcheck ping healthcheck url of healthchecks.io style
+// dead-man's-switch service: signal is start, fail or empty for success,
+// appended to url path. The body is sent as ping log message. Ping errors
+// are logged, so healthcheck service is never a reason of failed run
+func pingHealthcheck(signal, body string) {
+	if len(healthcheckURL) == 0 {
+		return
+	}
+	url := healthcheckURL
+	if len(signal) != 0 {
+		base, query, _ := strings.Cut(url, "?")
+		url = strings.TrimSuffix(base, "/") + "/" + signal
+		if len(query) != 0 {
+			url += "?" + query
+		}
+	}
+	if signal == "start" {
+		healthcheckStarted = true
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var resp *http.Response
+		resp, err = client.Post(url, "text/plain; charset=utf-8",
+			strings.NewReader(body))
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return
+		}
+		err = fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	logError("ping healthcheck", "signal", signal, "error", err)
+}
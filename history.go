@@ -0,0 +1,230 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyEntry is retained point-in-time of repository backup
+type historyEntry struct {
+	Kind string    // Kind of backup: mirror, archive, bundle, inc-bundle
+	Time time.Time // Backup time
+	Size int64     // Size in bytes
+	Tip  string    // HEAD commit hash, empty if unknown
+	Path string    // Path in output folder
+}
+
+// historyCmd is 'history' command: list every retained point-in-time of
+// repository (mirror, archives, bundle, snapshots) with sizes and tips
+func historyCmd(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup history [-output folder] [host/]owner/repo")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	entries, err := repoHistory(*output, fs.Arg(0))
+	if err != nil {
+		logFatal(err)
+	}
+	if len(entries) == 0 {
+		logFatal(fmt.Sprintf("no backups of %s found in %s", fs.Arg(0),
+			*output))
+	}
+
+	fmt.Printf("%-10s %-20s %10s %-12s %s\n", "KIND", "TIME", "SIZE", "TIP", "PATH")
+	for _, e := range entries {
+		tip := "-"
+		if len(e.Tip) != 0 {
+			tip = e.Tip[:min(len(e.Tip), 12)]
+		}
+		fmt.Printf("%-10s %-20s %10s %-12s %s\n", e.Kind,
+			e.Time.Format("2006-01-02 15:04:05"), formatSize(e.Size), tip, e.Path)
+	}
+}
+
+// repoHistory return retained backups of repository in output folder and in
+// snapshots folders sorted by time
+func repoHistory(output, repo string) (entries []historyEntry, err error) {
+	dirs := []string{output}
+	snapshots, _ := listSnapshots(output)
+	for _, s := range snapshots {
+		dirs = append(dirs, filepath.Join(output, s.Name))
+	}
+	for _, dir := range dirs {
+		e, err := repoHistoryDir(dir, repo)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return
+}
+
+// repoHistoryDir return backups of repository in folder
+func repoHistoryDir(output, repo string) (entries []historyEntry, err error) {
+	// Live mirror
+	mirror := filepath.Join(output, repo+".git")
+	if info, err := os.Stat(mirror); err == nil && info.IsDir() {
+		e := historyEntry{Kind: "mirror", Time: info.ModTime(), Path: mirror,
+			Size: dirSize(mirror)}
+		if fi, err := os.Stat(filepath.Join(mirror, "FETCH_HEAD")); err == nil {
+			e.Time = fi.ModTime()
+		}
+		e.Tip = headTip(mirror)
+		entries = append(entries, e)
+	}
+
+	// Archives: repo-YYYYMMDD.tar.*
+	archives, err := filepath.Glob(filepath.Join(output, repo+"-*.tar.*"))
+	if err != nil {
+		return
+	}
+	base := filepath.Base(repo) + "-"
+	for _, name := range archives {
+		date := strings.TrimPrefix(filepath.Base(name), base)
+		t, err := time.ParseInLocation("20060102", date[:min(len(date), 8)],
+			time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Before(t) {
+			t = info.ModTime()
+		}
+		entries = append(entries, historyEntry{Kind: "archive", Time: t,
+			Size: info.Size(), Tip: archiveTip(name, filepath.Base(repo)),
+			Path: name})
+	}
+
+	// Bundles: repo.bundle and incremental repo-*.inc.bundle
+	bundles, _ := chainFiles(filepath.Join(output, repo))
+	for i, bundle := range bundles {
+		info, err := os.Stat(bundle)
+		if err != nil {
+			continue
+		}
+		e := historyEntry{Kind: "bundle", Time: info.ModTime(),
+			Size: info.Size(), Path: bundle}
+		if i > 0 {
+			e.Kind = "inc-bundle"
+		}
+		if out, err := exec.Command("git", "bundle", "list-heads", bundle,
+			"HEAD").Output(); err == nil {
+			e.Tip, _, _ = strings.Cut(string(out), " ")
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// archiveTip return HEAD commit hash of repository mirror stored in not
+// encrypted archive, or empty string if it can't be read
+func archiveTip(name, repo string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	r, closeReader, err := archiveReader(name, f)
+	if err != nil {
+		return ""
+	}
+	defer closeReader()
+
+	// Read HEAD, loose refs and packed-refs of the mirror
+	prefix := repo + ".git/"
+	var head string
+	refs := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(hdr.Name, prefix)
+		switch {
+		case name == "HEAD":
+			data, _ := io.ReadAll(tr)
+			head = strings.TrimSpace(string(data))
+		case name == "packed-refs":
+			scanner := bufio.NewScanner(tr)
+			for scanner.Scan() {
+				hash, ref, ok := strings.Cut(scanner.Text(), " ")
+				if ok {
+					refs[ref] = hash
+				}
+			}
+		case strings.HasPrefix(name, "refs/"):
+			data, _ := io.ReadAll(tr)
+			refs[name] = strings.TrimSpace(string(data))
+		}
+	}
+	if ref := strings.TrimPrefix(head, "ref: "); ref != head {
+		return refs[ref]
+	}
+	return head
+}
+
+// dirSize return size of all files in folder
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// formatSize return human readable size
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// min return minimum of two integers
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTML run report file name, empty if html report is not written
+var reportHTMLFile string
+
+// Number of last runs of size trend in html report
+const trendRuns = 10
+
+// htmlReport is html report page data: run report with repositories rows
+// and size trends from catalog
+type htmlReport struct {
+	runReport
+	Rows      []htmlReportRow
+	BytesText string
+	Trends    bool // Size trends are read from catalog
+}
+
+// htmlReportRow is repository row of html report
+type htmlReportRow struct {
+	reportRepo
+	DurationText string
+	SizeText     string
+	BytesText    string
+	Trend        string // Sparkline polyline points, empty if no trend
+	Change       string // Size change since previous run
+}
+
+// writeHTMLReport write run report to standalone html page with sortable
+// repositories table, failures highlighted and size trends of last runs if
+// catalog is recorded
+func writeHTMLReport(filename string) error {
+	page := htmlReport{runReport: newRunReport()}
+	page.BytesText = formatSize(page.Bytes)
+	var trends map[string][]int64
+	if len(catalogFile) != 0 {
+		var err error
+		if trends, err = sizeTrends(catalogFile); err != nil {
+			logWarn("html report: can't read size trends from catalog",
+				"error", err)
+		}
+		page.Trends = trends != nil
+	}
+	for _, r := range page.Repos {
+		row := htmlReportRow{reportRepo: r,
+			DurationText: time.Duration(r.Duration * float64(time.Second)).
+				Round(time.Millisecond).String(),
+			SizeText:  formatSize(r.Size),
+			BytesText: formatSize(r.Bytes)}
+		if sizes := trends[r.Repo]; len(sizes) > 1 {
+			row.Trend = sparkline(sizes)
+			prev, last := sizes[len(sizes)-2], sizes[len(sizes)-1]
+			switch {
+			case last > prev:
+				row.Change = "+" + formatSize(last-prev)
+			case last < prev:
+				row.Change = "-" + formatSize(prev-last)
+			}
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	var b bytes.Buffer
+	if err := reportTemplate.Execute(&b, page); err != nil {
+		return err
+	}
+	return writeReportFile(filename, b.Bytes())
+}
+
+// sizeTrends return sizes of successful backups of repositories in last runs
+// recorded in catalog, oldest first
+func sizeTrends(filename string) (map[string][]int64, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	out, err := sqlite(filename, fmt.Sprintf("SELECT repo, size FROM repos "+
+		"WHERE status = 'success' AND run_id IN (SELECT id FROM runs "+
+		"ORDER BY id DESC LIMIT %d) ORDER BY run_id;\n", trendRuns), "-json")
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Repo string `json:"repo"`
+		Size int64  `json:"size"`
+	}
+	if len(bytes.TrimSpace(out)) != 0 {
+		if err := json.Unmarshal(out, &rows); err != nil {
+			return nil, err
+		}
+	}
+	trends := map[string][]int64{}
+	for _, r := range rows {
+		trends[r.Repo] = append(trends[r.Repo], r.Size)
+	}
+	return trends, nil
+}
+
+// sparkline return svg polyline points of sizes in 100x20 box
+func sparkline(sizes []int64) string {
+	min, max := sizes[0], sizes[0]
+	for _, s := range sizes {
+		if s < min {
+			min = s
+		}
+		if s > max {
+			max = s
+		}
+	}
+	var points []string
+	for i, s := range sizes {
+		y := 10.0
+		if max > min {
+			y = 19 - 18*float64(s-min)/float64(max-min)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f",
+			100*float64(i)/float64(len(sizes)-1), y))
+	}
+	return strings.Join(points, " ")
+}
+
+// reportTemplate is html report page template
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Github backup {{.Start.Format "2006-01-02 15:04"}} {{.Status}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 1em; text-align: left; vertical-align: top; border-bottom: 1px solid #e0e0e0; }
+th { cursor: pointer; background: #f4f4f4; user-select: none; }
+td.num { text-align: right; }
+tr.failed { background: #fde0e0; }
+tr.blocked { background: #fff4d0; }
+.status-success { color: #1a7f37; }
+.status-failed, .status-aborted { color: #cf222e; }
+.error { font-family: monospace; font-size: 0.85em; white-space: pre-wrap; }
+polyline { fill: none; stroke: #0969da; stroke-width: 1.5; }
+</style>
+</head>
+<body>
+<h1>Github backup <span class="status-{{.Status}}">{{.Status}}</span></h1>
+<p>Host {{.Host}}, {{.Start.Format "2006-01-02 15:04:05 MST"}} - {{.End.Format "15:04:05 MST"}}{{if .Aborted}}, aborted: {{.Aborted}}{{end}}<br>
+{{.Tool}}</p>
+<p>{{.Totals.Repos}} repositories: {{.Totals.Cloned}} cloned, {{.Totals.Updated}} updated, {{.Totals.Skipped}} skipped, <b>{{.Totals.Failed}} failed</b>, {{.Totals.Blocked}} blocked; {{.BytesText}} transferred</p>
+<table id="repos">
+<thead><tr><th>Repository</th><th>Status</th><th>Start</th><th>Duration</th><th>Transferred</th><th>Size</th>{{if .Trends}}<th>Size trend</th>{{end}}<th>Error</th></tr></thead>
+<tbody>
+{{range .Rows}}<tr class="{{.Status}}">
+<td>{{.Repo}}</td>
+<td>{{.Status}}</td>
+<td data-sort="{{.Start.Unix}}">{{.Start.Format "15:04:05"}}</td>
+<td class="num" data-sort="{{.Duration}}">{{.DurationText}}</td>
+<td class="num" data-sort="{{.Bytes}}">{{.BytesText}}</td>
+<td class="num" data-sort="{{.Size}}">{{.SizeText}}</td>
+{{if $.Trends}}<td>{{if .Trend}}<svg width="100" height="20"><polyline points="{{.Trend}}"/></svg> {{.Change}}{{end}}</td>
+{{end}}<td class="error">{{.Error}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+document.querySelectorAll("#repos th").forEach(function(th, col) {
+	var asc = true;
+	th.addEventListener("click", function() {
+		var tbody = document.querySelector("#repos tbody");
+		var rows = Array.from(tbody.rows);
+		var key = function(row) {
+			var cell = row.cells[col];
+			var v = cell.dataset.sort;
+			return v === undefined ? cell.textContent : parseFloat(v);
+		};
+		rows.sort(function(a, b) {
+			var x = key(a), y = key(b);
+			return (x < y ? -1 : x > y ? 1 : 0) * (asc ? 1 : -1);
+		});
+		asc = !asc;
+		rows.forEach(function(row) { tbody.appendChild(row); });
+	});
+});
+</script>
+</body>
+</html>
+`))
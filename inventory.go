@@ -0,0 +1,156 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inventory is SBOM-style report of backed up repositories licenses
+type inventory struct {
+	Created  time.Time        `json:"created"`
+	Licenses map[string]int   `json:"licenses"` // Number of repos by license
+	Repos    []inventoryEntry `json:"repos"`
+}
+
+// inventoryEntry is repository licenses found by github api and in license
+// files of the mirror HEAD
+type inventoryEntry struct {
+	Repo         string        `json:"repo"`
+	License      string        `json:"license"` // Resulting SPDX id
+	APILicense   string        `json:"api_license,omitempty"`
+	LicenseFiles []licenseFile `json:"license_files,omitempty"`
+}
+
+// licenseFile is license file found in repository
+type licenseFile struct {
+	Path   string `json:"path"`
+	SpdxID string `json:"spdx_id"`
+}
+
+// Inventory of this run, nil if -inventory parameter is not set
+var inv *inventory
+
+// addInventory get repository licenses and add it to inventory
+func addInventory(acc account, repo, mirror string) error {
+	entry := inventoryEntry{Repo: acc.path(repo)}
+
+	// Get license from github api
+	var data struct {
+		License *struct {
+			SpdxID string `json:"spdx_id"`
+		} `json:"license"`
+	}
+	if err := newAPIClient(acc.endpoint).get("/repos/"+repo, &data); err != nil {
+		return err
+	}
+	if data.License != nil {
+		entry.APILicense = data.License.SpdxID
+	}
+
+	// Get license files from mirror HEAD
+	entry.LicenseFiles = findLicenseFiles(mirror)
+
+	// Resulting license: api license if it is detected by github or first
+	// detected license file
+	entry.License = entry.APILicense
+	if len(entry.License) == 0 || entry.License == "NOASSERTION" {
+		for _, f := range entry.LicenseFiles {
+			if f.SpdxID != "NOASSERTION" {
+				entry.License = f.SpdxID
+				break
+			}
+		}
+	}
+	if len(entry.License) == 0 {
+		entry.License = "NONE"
+	}
+
+	inv.Repos = append(inv.Repos, entry)
+	inv.Licenses[entry.License]++
+	return nil
+}
+
+// findLicenseFiles return license files in root of mirror HEAD tree
+func findLicenseFiles(mirror string) (files []licenseFile) {
+	out, err := exec.Command("git", "-C", mirror, "ls-tree", "--name-only",
+		"HEAD").Output()
+	if err != nil {
+		return
+	}
+	for _, name := range strings.Split(string(out), "\n") {
+		upper := strings.ToUpper(name)
+		if !strings.HasPrefix(upper, "LICENSE") &&
+			!strings.HasPrefix(upper, "LICENCE") &&
+			!strings.HasPrefix(upper, "COPYING") {
+			continue
+		}
+		text, err := exec.Command("git", "-C", mirror, "cat-file", "-p",
+			"HEAD:"+name).Output()
+		if err != nil {
+			continue
+		}
+		files = append(files, licenseFile{name, detectLicense(string(text))})
+	}
+	return
+}
+
+// licensePatterns is list of SPDX ids and phrases to detect license text.
+// More specific licenses are placed before licenses they contain
+var licensePatterns = []struct {
+	spdxID  string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"GNU AFFERO GENERAL PUBLIC LICENSE"}},
+	{"LGPL-3.0", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"LGPL-2.1", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 2.1"}},
+	{"GPL-3.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"GPL-2.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 2"}},
+	{"Apache-2.0", []string{"Apache License", "Version 2.0"}},
+	{"MPL-2.0", []string{"Mozilla Public License", "2.0"}},
+	{"BSD-3-Clause", []string{"Redistribution and use in source and binary forms",
+		"Neither the name"}},
+	{"BSD-2-Clause", []string{"Redistribution and use in source and binary forms"}},
+	{"MIT", []string{"Permission is hereby granted, free of charge"}},
+	{"ISC", []string{"Permission to use, copy, modify, and/or distribute this software"}},
+	{"Unlicense", []string{"This is free and unencumbered software"}},
+	{"CC0-1.0", []string{"CC0 1.0 Universal"}},
+}
+
+// detectLicense return SPDX id of license text or NOASSERTION if license is
+// not detected
+func detectLicense(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	for _, p := range licensePatterns {
+		found := true
+		for _, phrase := range p.phrases {
+			if !strings.Contains(text, phrase) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return p.spdxID
+		}
+	}
+	return "NOASSERTION"
+}
+
+// writeInventory write inventory to json file
+func writeInventory(filename string) error {
+	sort.Slice(inv.Repos, func(i, j int) bool {
+		return inv.Repos[i].Repo < inv.Repos[j].Repo
+	})
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+)
+
+// JUnit xml report types. Each account is a test suite and each repository is
+// a test case, so CI (GitLab, Jenkins, ...) shows which repositories failed
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"` // Stages status
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit write repositories backup results to JUnit xml file
+func writeJUnit(filename string) error {
+	report := junitTestSuites{Name: "github-backup"}
+	suites := map[string]int{}
+	for _, r := range results {
+		i, ok := suites[r.Account]
+		if !ok {
+			i = len(report.Suites)
+			suites[r.Account] = i
+			report.Suites = append(report.Suites, junitTestSuite{
+				Name:      r.Account,
+				Timestamp: r.Start.UTC().Format("2006-01-02T15:04:05"),
+			})
+		}
+		suite := &report.Suites[i]
+
+		tc := junitTestCase{
+			Name:      r.Repo,
+			ClassName: r.Account,
+			Time:      r.Duration.Seconds(),
+			SystemOut: stagesSummary(r.Stages),
+		}
+		if r.Err != nil {
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("backup of %s failed", r.Repo),
+				Text:    r.Err.Error(),
+			}
+			suite.Failures++
+			report.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+		suite.Tests++
+		suite.Time += tc.Time
+		report.Tests++
+		report.Time += tc.Time
+	}
+
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
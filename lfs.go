@@ -0,0 +1,68 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Git LFS objects backup flag set by -lfs parameter
+var lfs bool
+
+// lfsStage fetch Git LFS objects of all refs to mirror and check all LFS
+// objects referenced by the mirror were retrieved. Mirror clones don't fetch
+// LFS content, so without it backups of LFS repositories are incomplete
+func lfsStage(j *pipelineJob) error {
+	mirror := filepath.Join(j.dir, j.path+".git")
+	fetchErr := run("git", "-C", mirror, "lfs", "fetch", "--all")
+
+	missing, total, err := lfsMissing(mirror)
+	if err != nil {
+		if fetchErr != nil {
+			return fetchErr
+		}
+		return err
+	}
+	if len(missing) != 0 {
+		err = fmt.Errorf("%d of %d lfs objects could not be retrieved: %s",
+			len(missing), total, strings.Join(missing[:min(len(missing), 5)],
+				", "))
+		if fetchErr != nil {
+			err = fmt.Errorf("%s\n%s", err, fetchErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// lfsMissing return LFS objects referenced by all refs of mirror which are
+// absent in mirror lfs storage, and total number of referenced objects
+func lfsMissing(mirror string) (missing []string, total int, err error) {
+	out, err := exec.Command("git", "-C", mirror, "lfs", "ls-files", "--all",
+		"--long").Output()
+	if err != nil {
+		return nil, 0, fmt.Errorf("git lfs ls-files: %s", err)
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// Line format: <oid> <*|-> <path>
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || len(fields[0]) < 5 || seen[fields[0]] {
+			continue
+		}
+		oid := fields[0]
+		seen[oid] = true
+		total++
+		object := filepath.Join(mirror, "lfs", "objects", oid[0:2], oid[2:4], oid)
+		if _, err := os.Stat(object); err != nil {
+			missing = append(missing, fields[2])
+		}
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Output folder lock modes
+const (
+	lockExit = "exit" // Exit immediately if output folder is locked
+	lockWait = "wait" // Wait until output folder lock is released
+	lockOff  = "off"  // Don't lock output folder
+)
+
+// Output folder lock mode
+var lockMode = lockExit
+
+// Lock heartbeat interval: the lock file modification time is updated by the
+// running backup, and lock of other host not updated for lockStale is stale
+const lockHeartbeat = time.Minute
+const lockStale = 10 * lockHeartbeat
+
+// outputLock is output folder lock file content
+type outputLock struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Start time.Time `json:"start"`
+}
+
+// Lock file name of locked output folder and heartbeat stop channel
+var lockName string
+var lockDone chan struct{}
+
+// lockFile return lock file name in output folder
+func lockFile(output string) string {
+	return filepath.Join(output, ".github-backup", "lock")
+}
+
+// lockOutput lock output folder to prevent overlapping backup runs fighting
+// over the same mirrors. If the folder is locked by running backup it returns
+// error in exit mode or waits until the lock is released in wait mode. Stale
+// lock of crashed backup is removed
+func lockOutput(output string) error {
+	if lockMode == lockOff {
+		return nil
+	}
+	name := lockFile(output)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(outputLock{os.Getpid(), hostname(), runStart})
+	var waiting bool
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(append(data, '\n'))
+			f.Close()
+			if err != nil {
+				os.Remove(name)
+				return err
+			}
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		l, stale := readLock(name)
+		switch {
+		case stale:
+			logWarn(fmt.Sprintf("remove stale lock of backup pid %d on %s "+
+				"started %s", l.PID, l.Host, l.Start.Format(time.RFC3339)),
+				"pid", l.PID, "host", l.Host)
+			os.Remove(name)
+			continue
+		case lockMode != lockWait:
+			return fmt.Errorf("output folder %s is locked by backup pid %d on "+
+				"%s started %s", output, l.PID, l.Host,
+				l.Start.Format(time.RFC3339))
+		case !waiting:
+			logInfo(fmt.Sprintf("output folder is locked by backup pid %d on "+
+				"%s started %s, waiting", l.PID, l.Host,
+				l.Start.Format(time.RFC3339)), "pid", l.PID, "host", l.Host)
+			waiting = true
+		}
+		time.Sleep(10 * time.Second)
+	}
+
+	lockName, lockDone = name, make(chan struct{})
+	go func(done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(lockHeartbeat):
+				now := time.Now()
+				os.Chtimes(name, now, now)
+			}
+		}
+	}(lockDone)
+	return nil
+}
+
+// readLock read lock file and return lock and true if the lock is stale: its
+// process is not running on this host, or lock of other host is not updated
+func readLock(name string) (l outputLock, stale bool) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(name)
+	if err != nil || json.Unmarshal(data, &l) != nil {
+		// Lock is being written or damaged
+		return l, time.Since(info.ModTime()) > lockStale
+	}
+	if l.Host == hostname() {
+		return l, !processRunning(l.PID)
+	}
+	return l, time.Since(info.ModTime()) > lockStale
+}
+
+// processRunning return true if process with pid is running
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// unlockOutput release output folder lock
+func unlockOutput() {
+	if len(lockName) == 0 {
+		return
+	}
+	close(lockDone)
+	if err := os.Remove(lockName); err != nil {
+		logError("remove output folder lock", "error", err)
+	}
+	lockName = ""
+}
@@ -0,0 +1,190 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames is log levels names in level order
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Log parameters: minimum level of written records and records format: text
+// or json
+var logLevel = "info"
+var logFormat = "text"
+var minLevel = levelInfo
+
+// logMu serializes log records written by concurrent stages
+var logMu sync.Mutex
+
+// setupLogging check log parameters and route messages of standard logger
+// through leveled logger, so all messages have the same format
+func setupLogging() error {
+	minLevel = -1
+	for i, name := range levelNames {
+		if strings.EqualFold(logLevel, name) {
+			minLevel = i
+		}
+	}
+	if minLevel < 0 {
+		return fmt.Errorf("wrong log level '%s', should be one of: %s",
+			logLevel, strings.Join(levelNames, ", "))
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("wrong log format '%s', should be text or json",
+			logFormat)
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// stdLogWriter is standard logger output writing messages as info records,
+// or warn records if message starts with "warning:"
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	level := levelInfo
+	if s := strings.TrimPrefix(msg, "warning: "); s != msg {
+		msg, level = s, levelWarn
+	}
+	logRecord(level, msg)
+	return len(p), nil
+}
+
+// logDebug write debug record with message and key-value pairs fields
+func logDebug(msg string, fields ...interface{}) {
+	logRecord(levelDebug, msg, fields...)
+}
+
+// logInfo write info record with message and key-value pairs fields
+func logInfo(msg string, fields ...interface{}) {
+	logRecord(levelInfo, msg, fields...)
+}
+
+// logWarn write warn record with message and key-value pairs fields
+func logWarn(msg string, fields ...interface{}) {
+	logRecord(levelWarn, msg, fields...)
+}
+
+// logError write error record with message and key-value pairs fields
+func logError(msg string, fields ...interface{}) {
+	logRecord(levelError, msg, fields...)
+}
+
+// logFatal write error record, release output folder lock and exit with
+// status 1. The os.Exit doesn't run deferred calls, so the lock is released
+// here
+func logFatal(v ...interface{}) {
+	stopProgress()
+	logRecord(levelError, fmt.Sprint(v...))
+	if healthcheckStarted {
+		pingHealthcheck("fail", fmt.Sprint(v...))
+	}
+	unlockOutput()
+	os.Exit(exitFailure)
+}
+
+// repoFields return owner and repo fields of repository full name
+func repoFields(repo string) []interface{} {
+	owner, name, _ := strings.Cut(repo, "/")
+	return []interface{}{"owner", owner, "repo", name}
+}
+
+// logRecord write log record to stderr if its level is not less than minimum
+// level. Text record is "time LEVEL message key=value...", json record is
+// object with time, level, msg and fields keys. Durations are written in
+// seconds in json and errors as strings
+func logRecord(level int, msg string, fields ...interface{}) {
+	if level < minLevel {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	if logFormat == "json" {
+		b.WriteString(`{"time":`)
+		jsonValue(&b, now.Format(time.RFC3339Nano))
+		b.WriteString(`,"level":`)
+		jsonValue(&b, levelNames[level])
+		b.WriteString(`,"msg":`)
+		jsonValue(&b, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteString(",")
+			jsonValue(&b, fmt.Sprint(fields[i]))
+			b.WriteString(":")
+			switch v := fields[i+1].(type) {
+			case time.Duration:
+				jsonValue(&b, v.Seconds())
+			case error:
+				jsonValue(&b, v.Error())
+			default:
+				jsonValue(&b, v)
+			}
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(strings.ToUpper(levelNames[level]))
+		b.WriteString(" ")
+		b.WriteString(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			v := fields[i+1]
+			if d, ok := v.(time.Duration); ok {
+				v = d.Round(time.Millisecond)
+			}
+			s := fmt.Sprint(v)
+			if len(s) == 0 || strings.ContainsAny(s, " \"=\n") {
+				s = fmt.Sprintf("%q", s)
+			}
+			fmt.Fprintf(&b, " %v=%s", fields[i], s)
+		}
+		b.WriteString("\n")
+	}
+	logMu.Lock()
+	progress.clear()
+	os.Stderr.WriteString(b.String())
+	progress.draw()
+	logMu.Unlock()
+}
+
+// jsonValue write json encoded value, or its string if it can't be encoded
+func jsonValue(b *strings.Builder, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// logRepo write record of repository backup result with owner, repo,
+// duration, fetched bytes and backup size fields
+func logRepo(r *repoResult) {
+	fields := append(repoFields(r.Repo), "duration", r.Duration,
+		"bytes", r.Fetched, "size", r.Size)
+	switch {
+	case len(r.Blocked) != 0:
+		logWarn(r.Repo+": blocked", append(fields, "reason", r.Blocked)...)
+	case r.Err != nil:
+		logWarn(r.Repo+": failed", append(fields, "error", r.Err)...)
+	default:
+		logInfo(r.Repo+": done", fields...)
+	}
+}
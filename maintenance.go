@@ -0,0 +1,68 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Maintenance levels
+const (
+	maintenanceAuto       = "auto"
+	maintenanceRepack     = "repack"
+	maintenanceGC         = "gc"
+	maintenanceAggressive = "aggressive"
+)
+
+// Mirrors maintenance level set by -maintenance parameter, time budget of
+// maintenance per run set by -maintenance-budget parameter, and time spent
+// for maintenance in this run
+var maintenance string
+var maintenanceBudget time.Duration
+var maintenanceSpent time.Duration
+
+// maintenanceArgs return git command arguments of maintenance level
+func maintenanceArgs(level string) ([]string, error) {
+	switch level {
+	case maintenanceAuto:
+		return []string{"gc", "--auto", "--quiet"}, nil
+	case maintenanceRepack:
+		return []string{"repack", "-a", "-d", "-q"}, nil
+	case maintenanceGC:
+		return []string{"gc", "--quiet"}, nil
+	case maintenanceAggressive:
+		return []string{"gc", "--aggressive", "--quiet"}, nil
+	}
+	return nil, fmt.Errorf("wrong maintenance level '%s'", level)
+}
+
+// maintenanceStage run git gc or repack in repository mirrors to remove
+// loose objects and redundant packs accumulated by updates. Mirrors are not
+// maintained when maintenance time budget of this run is spent
+func maintenanceStage(j *pipelineJob) error {
+	args, err := maintenanceArgs(maintenance)
+	if err != nil {
+		return err
+	}
+	for _, path := range j.paths {
+		if !strings.HasSuffix(path, ".git") {
+			continue
+		}
+		if maintenanceBudget > 0 && maintenanceSpent >= maintenanceBudget {
+			logInfo(fmt.Sprintf("%s: maintenance skipped, time budget %s is "+
+				"spent", j.repo, maintenanceBudget), repoFields(j.repo)...)
+			return nil
+		}
+		start := time.Now()
+		err := run("git", append([]string{"-C", j.dir + "/" + path}, args...)...)
+		maintenanceSpent += time.Since(start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
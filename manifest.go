@@ -0,0 +1,177 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestName is run manifest file name. The manifest is written to output
+// folder, or to snapshot folder in snapshot mode
+const manifestName = "manifest.json"
+
+// runManifest is machine-readable index of repositories processed in run
+type runManifest struct {
+	Tool     string          `json:"tool"`
+	Host     string          `json:"host"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Snapshot string          `json:"snapshot,omitempty"`
+	Format   string          `json:"format"`
+	Filter   string          `json:"filter,omitempty"` // Partial clone filter
+	Depth    int             `json:"depth,omitempty"`  // Shallow clone depth
+	Since    string          `json:"shallow_since,omitempty"`
+	Repos    []manifestEntry `json:"repos"`
+}
+
+// manifestEntry is repository entry of run manifest
+type manifestEntry struct {
+	Repo       string            `json:"repo"` // Full name with host prefix
+	Path       string            `json:"path,omitempty"`
+	Head       string            `json:"head,omitempty"`
+	Refs       map[string]string `json:"refs,omitempty"`
+	Wiki       bool              `json:"wiki"`
+	Visibility string            `json:"visibility,omitempty"` // public, private, internal
+	Fork       bool              `json:"fork"`
+	Archived   bool              `json:"archived"`
+	LFS        string            `json:"lfs,omitempty"` // LFS stage status: ok, failed
+	Tier       string            `json:"tier,omitempty"`
+	Shallow    bool              `json:"shallow,omitempty"` // History is truncated
+	Size       int64             `json:"size"`              // Size of backup files in bytes
+	Files      []string          `json:"files,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Coverage   map[string]string `json:"coverage,omitempty"` // Parts status: ok, missing, none, unknown
+	Score      int               `json:"score"`              // Completeness percent
+	Blocked    string            `json:"blocked,omitempty"`  // Block reason: dmca, legal, disabled
+	Fetched    int64             `json:"fetched,omitempty"`  // Bytes of new objects fetched to mirrors
+}
+
+// prevManifestFile return previous run manifest file name in output folder
+func prevManifestFile(output string) string {
+	return filepath.Join(output, ".github-backup", "manifest.prev.json")
+}
+
+// readManifest read run manifest file
+func readManifest(name string) (m runManifest, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &m)
+	return
+}
+
+// mirrorRefs return refs of mirror with its objects hashes
+func mirrorRefs(mirror string) map[string]string {
+	out, err := exec.Command("git", "-C", mirror, "for-each-ref",
+		"--format=%(objectname) %(refname)").Output()
+	if err != nil {
+		return nil
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if hash, ref, ok := strings.Cut(line, " "); ok {
+			refs[ref] = hash
+		}
+	}
+	return refs
+}
+
+// filesSize return size of files and folders (paths relative to dir folder)
+func filesSize(dir string, files []string) (size int64) {
+	for _, file := range files {
+		size += dirSize(filepath.Join(dir, file))
+	}
+	return
+}
+
+// writeManifest write manifest of repositories processed in this run and copy
+// it to destinations
+func writeManifest(output string) error {
+	m := runManifest{
+		Tool:     userAgent(),
+		Host:     hostname(),
+		Start:    runStart.UTC(),
+		End:      time.Now().UTC(),
+		Snapshot: snapshotName,
+		Format:   strings.Join(formats, ","),
+		Filter:   cloneFilter,
+		Depth:    depth,
+		Since:    shallowSince,
+		Repos:    []manifestEntry{},
+	}
+	for _, r := range results {
+		e := manifestEntry{
+			Repo:     r.Path,
+			Head:     r.Tip,
+			Wiki:     r.Wiki,
+			Refs:     r.Refs,
+			Size:     r.Size,
+			Files:    r.Files,
+			Tier:     r.Tier,
+			Shallow:  r.Shallow,
+			Start:    r.Start.UTC(),
+			End:      r.Start.Add(r.Duration).UTC(),
+			Status:   "success",
+			Coverage: r.Coverage,
+			Score:    coverageScore(r.Coverage),
+			Fetched:  r.Fetched,
+		}
+		if len(r.Files) != 0 {
+			e.Path = snapshotPath(r.Path)
+		}
+		for _, s := range r.Stages {
+			if s.Stage == "lfs" {
+				e.LFS = s.Status
+			}
+		}
+		if a, ok := repoAttrs[r.Path]; ok {
+			e.Visibility, e.Fork, e.Archived = a.Visibility, a.Fork, a.Archived
+		}
+		if r.Err != nil {
+			e.Status = "failed"
+			e.Error = r.Err.Error()
+		}
+		if len(r.Blocked) != 0 {
+			e.Status, e.Blocked = "blocked", r.Blocked
+		}
+		m.Repos = append(m.Repos, e)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := snapshotPath(manifestName)
+	name := filepath.Join(output, path)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// Keep previous run manifest
+	if len(snapshotName) == 0 {
+		if _, err := os.Stat(name); err == nil {
+			prev := prevManifestFile(output)
+			if err := os.MkdirAll(filepath.Dir(prev), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(name, prev); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.WriteFile(name, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return putDests(output, []string{path})
+}
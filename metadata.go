@@ -0,0 +1,471 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metadataSuffix is suffix of repository settings metadata file
+// owner/repo.metadata.json
+const metadataSuffix = ".metadata.json"
+
+// repoMetadata is repository settings saved to metadata file, so restore can
+// reconstruct repository configuration. Fields have github api names. Merge
+// settings are reported by github to users with push access only, missing
+// settings are omitted
+type repoMetadata struct {
+	Description    string   `json:"description"`
+	Homepage       string   `json:"homepage"`
+	Topics         []string `json:"topics"`
+	DefaultBranch  string   `json:"default_branch"`
+	Visibility     string   `json:"visibility"`
+	Private        bool     `json:"private"`
+	Archived       bool     `json:"archived"`
+	IsTemplate     bool     `json:"is_template"`
+	HasIssues      bool     `json:"has_issues"`
+	HasProjects    bool     `json:"has_projects"`
+	HasWiki        bool     `json:"has_wiki"`
+	HasDiscussions bool     `json:"has_discussions"`
+
+	AllowMergeCommit         *bool   `json:"allow_merge_commit,omitempty"`
+	AllowSquashMerge         *bool   `json:"allow_squash_merge,omitempty"`
+	AllowRebaseMerge         *bool   `json:"allow_rebase_merge,omitempty"`
+	AllowAutoMerge           *bool   `json:"allow_auto_merge,omitempty"`
+	AllowUpdateBranch        *bool   `json:"allow_update_branch,omitempty"`
+	DeleteBranchOnMerge      *bool   `json:"delete_branch_on_merge,omitempty"`
+	SquashMergeCommitTitle   *string `json:"squash_merge_commit_title,omitempty"`
+	SquashMergeCommitMessage *string `json:"squash_merge_commit_message,omitempty"`
+	MergeCommitTitle         *string `json:"merge_commit_title,omitempty"`
+	MergeCommitMessage       *string `json:"merge_commit_message,omitempty"`
+	AllowForking             *bool   `json:"allow_forking,omitempty"`
+	WebCommitSignoffRequired *bool   `json:"web_commit_signoff_required,omitempty"`
+}
+
+// metadataFile is repository metadata file: settings and configuration
+// exported with repository admin access. Sections which can't be read with
+// the token are listed as unavailable, so gaps are identified
+type metadataFile struct {
+	repoMetadata
+	BranchProtection map[string]json.RawMessage `json:"branch_protection,omitempty"` // Protection by branch
+	Rulesets         []json.RawMessage          `json:"rulesets,omitempty"`
+	Webhooks         []json.RawMessage          `json:"webhooks,omitempty"`
+	DeployKeys       []deployKey                `json:"deploy_keys,omitempty"`
+	Actions          *repoActions               `json:"actions,omitempty"`
+	Collaborators    []collaborator             `json:"collaborators,omitempty"`
+	Unavailable      []string                   `json:"unavailable,omitempty"` // Sections not exported
+}
+
+// exportMetadata return metadata file of repository settings with
+// configuration sections exported with admin access. Sections are not
+// read without admin access
+func exportMetadata(j *pipelineJob, m repoMetadata, admin bool) metadataFile {
+	f := metadataFile{repoMetadata: m}
+	api := newAPIClient(j.acc.endpoint)
+	for _, s := range []struct {
+		name   string
+		export func() error
+	}{
+		{"branch_protection", func() (err error) {
+			f.BranchProtection, err = exportProtection(api, j.repo)
+			return
+		}},
+		{"rulesets", func() (err error) {
+			f.Rulesets, err = exportRulesets(api, j.repo)
+			return
+		}},
+		{"webhooks", func() (err error) {
+			f.Webhooks, err = exportWebhooks(api, j.repo)
+			return
+		}},
+		{"deploy_keys", func() (err error) {
+			f.DeployKeys, err = exportDeployKeys(api, j.repo)
+			return
+		}},
+		{"actions", func() (err error) {
+			f.Actions, err = exportActions(api, j.repo)
+			return
+		}},
+		{"collaborators", func() (err error) {
+			f.Collaborators, err = exportCollaborators(api, j.repo)
+			return
+		}},
+	} {
+		if !admin {
+			f.Unavailable = append(f.Unavailable, s.name)
+			continue
+		}
+		if err := s.export(); err != nil {
+			if !notAvailable(err) {
+				logWarn(fmt.Sprintf("%s: can't export %s: %s", j.repo, s.name,
+					firstLine(err.Error())), repoFields(j.repo)...)
+			}
+			f.Unavailable = append(f.Unavailable, s.name)
+		}
+	}
+	return f
+}
+
+// notAvailable return true if api error means that feature is not available
+// for repository or token: not found, forbidden or not upgraded plan
+func notAvailable(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && (e.code == http.StatusNotFound ||
+		e.code == http.StatusForbidden)
+}
+
+// exportProtection return branch protection rules of protected branches
+func exportProtection(api *apiClient, repo string) (
+	protection map[string]json.RawMessage, err error) {
+
+	branches, err := apiList(api, "/repos/"+repo+
+		"/branches?protected=true&per_page=100")
+	if err != nil {
+		return
+	}
+	protection = map[string]json.RawMessage{}
+	for _, data := range branches {
+		var b struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(data, &b); err != nil {
+			return
+		}
+		var rule json.RawMessage
+		err = api.get("/repos/"+repo+"/branches/"+url.PathEscape(b.Name)+
+			"/protection", &rule)
+		if err != nil {
+			return
+		}
+		protection[b.Name] = rule
+	}
+	return
+}
+
+// Redacted value of webhook secret
+const redacted = "REDACTED"
+
+// exportWebhooks return repository webhooks: url, content type, events and
+// active state. Secrets are redacted, github returns them masked anyway, and
+// webhook urls user info and query values which may hold tokens are redacted
+// too
+func exportWebhooks(api *apiClient, repo string) (hooks []json.RawMessage,
+	err error) {
+
+	list, err := apiList(api, "/repos/"+repo+"/hooks?per_page=100")
+	if err != nil {
+		return
+	}
+	for _, data := range list {
+		var hook map[string]interface{}
+		if err = json.Unmarshal(data, &hook); err != nil {
+			return
+		}
+		if config, ok := hook["config"].(map[string]interface{}); ok {
+			if _, ok := config["secret"]; ok {
+				config["secret"] = redacted
+			}
+			if s, ok := config["url"].(string); ok {
+				config["url"] = redactURL(s)
+			}
+		}
+		var out []byte
+		if out, err = json.Marshal(hook); err != nil {
+			return
+		}
+		hooks = append(hooks, out)
+	}
+	return
+}
+
+// redactURL return url with password and query values redacted
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	var query []string
+	for key := range u.Query() {
+		query = append(query, url.QueryEscape(key)+"="+redacted)
+	}
+	sort.Strings(query)
+	u.RawQuery = strings.Join(query, "&")
+	return u.String()
+}
+
+// deployKey is repository deploy key with its permission
+type deployKey struct {
+	ID          int64      `json:"id"`
+	Title       string     `json:"title"`
+	Key         string     `json:"key"`         // Public key
+	Fingerprint string     `json:"fingerprint"` // SHA256 fingerprint of public key
+	ReadOnly    bool       `json:"read_only"`
+	Verified    bool       `json:"verified"`
+	Created     time.Time  `json:"created_at"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	AddedBy     string     `json:"added_by,omitempty"`
+}
+
+// exportDeployKeys return repository deploy keys with read-only or
+// read-write permission and fingerprints, which github api doesn't report
+func exportDeployKeys(api *apiClient, repo string) (keys []deployKey,
+	err error) {
+
+	list, err := apiList(api, "/repos/"+repo+"/keys?per_page=100")
+	if err != nil {
+		return
+	}
+	for _, data := range list {
+		var k deployKey
+		if err = json.Unmarshal(data, &k); err != nil {
+			return
+		}
+		k.Fingerprint = keyFingerprint(k.Key)
+		keys = append(keys, k)
+	}
+	return
+}
+
+// collaborator is repository direct collaborator with permission level
+type collaborator struct {
+	Login      string `json:"login"`
+	Permission string `json:"permission"` // Role name: admin, maintain, write, triage, read or custom role
+	Outside    bool   `json:"outside"`    // Outside collaborator, not organization member
+}
+
+// exportCollaborators return repository direct collaborators with their
+// permission levels, outside collaborators of organization repository are
+// flagged. Collaborators with access through organization teams or base
+// permission are not listed
+func exportCollaborators(api *apiClient, repo string) (
+	collaborators []collaborator, err error) {
+
+	outside := map[string]bool{}
+	owner, _, _ := strings.Cut(repo, "/")
+	var data struct {
+		Type string `json:"type"`
+	}
+	if err = api.get("/users/"+owner, &data); err != nil {
+		return
+	}
+	if data.Type == "Organization" {
+		var logins []string
+		logins, err = userLogins(api, "/repos/"+repo+
+			"/collaborators?affiliation=outside&per_page=100")
+		if err != nil {
+			return
+		}
+		for _, login := range logins {
+			outside[login] = true
+		}
+	}
+	list, err := apiList(api, "/repos/"+repo+
+		"/collaborators?affiliation=direct&per_page=100")
+	if err != nil {
+		return
+	}
+	collaborators = []collaborator{}
+	for _, data := range list {
+		var c struct {
+			Login    string `json:"login"`
+			RoleName string `json:"role_name"`
+		}
+		if err = json.Unmarshal(data, &c); err != nil {
+			return
+		}
+		collaborators = append(collaborators, collaborator{Login: c.Login,
+			Permission: c.RoleName, Outside: outside[c.Login]})
+	}
+	return
+}
+
+// keyFingerprint return SHA256 fingerprint of ssh public key in the
+// ssh-keygen -l format, empty if key can't be parsed
+func keyFingerprint(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return ""
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// repoActions is repository Actions configuration: secrets names,
+// variables and environments. Secrets values can't be read with api
+type repoActions struct {
+	Secrets      []actionsItem        `json:"secrets"`
+	Variables    []actionsVariable    `json:"variables"`
+	Environments []actionsEnvironment `json:"environments"`
+}
+
+// actionsVariable is Actions variable with value
+type actionsVariable struct {
+	actionsItem
+	Value string `json:"value"`
+}
+
+// actionsEnvironment is deployment environment with protection rules,
+// deployment branch policies, secrets names and variables
+type actionsEnvironment struct {
+	Name      string            `json:"name"`
+	Config    json.RawMessage   `json:"config"` // Protection rules and deployment branch policy
+	Policies  []json.RawMessage `json:"deployment_branch_policies,omitempty"`
+	Secrets   []actionsItem     `json:"secrets"`
+	Variables []actionsVariable `json:"variables"`
+}
+
+// exportActions return repository Actions secrets names, variables and
+// environments
+func exportActions(api *apiClient, repo string) (a *repoActions, err error) {
+	a = &repoActions{}
+	if a.Secrets, a.Variables, err = actionsNames(api, "/repos/"+repo+
+		"/actions"); err != nil {
+		return
+	}
+	list, err := wrappedList(api, "/repos/"+repo+"/environments?per_page=100",
+		"environments")
+	if err != nil {
+		return
+	}
+	a.Environments = []actionsEnvironment{}
+	for _, data := range list {
+		var env struct {
+			Name   string `json:"name"`
+			Policy *struct {
+				Custom bool `json:"custom_branch_policies"`
+			} `json:"deployment_branch_policy"`
+		}
+		if err = json.Unmarshal(data, &env); err != nil {
+			return
+		}
+		e := actionsEnvironment{Name: env.Name, Config: data}
+		prefix := "/repos/" + repo + "/environments/" + url.PathEscape(env.Name)
+		if env.Policy != nil && env.Policy.Custom {
+			if e.Policies, err = wrappedList(api, prefix+
+				"/deployment-branch-policies?per_page=100",
+				"branch_policies"); err != nil {
+				return
+			}
+		}
+		if e.Secrets, e.Variables, err = actionsNames(api, prefix); err != nil {
+			return
+		}
+		a.Environments = append(a.Environments, e)
+	}
+	return
+}
+
+// actionsNames return secrets names and variables of repository or
+// environment api prefix
+func actionsNames(api *apiClient, prefix string) (secrets []actionsItem,
+	variables []actionsVariable, err error) {
+
+	list, err := wrappedList(api, prefix+"/secrets?per_page=100", "secrets")
+	if err == nil {
+		err = unmarshalList(list, &secrets)
+	}
+	if err != nil {
+		return
+	}
+	if list, err = wrappedList(api, prefix+"/variables?per_page=100",
+		"variables"); err == nil {
+		err = unmarshalList(list, &variables)
+	}
+	return
+}
+
+// exportRulesets return repository rulesets with its rules and conditions.
+// Rulesets inherited from organization are not included
+func exportRulesets(api *apiClient, repo string) (rulesets []json.RawMessage,
+	err error) {
+
+	list, err := apiList(api, "/repos/"+repo+
+		"/rulesets?includes_parents=false&per_page=100")
+	if err != nil {
+		return
+	}
+	for _, data := range list {
+		var r struct {
+			ID int64 `json:"id"`
+		}
+		if err = json.Unmarshal(data, &r); err != nil {
+			return
+		}
+		var ruleset json.RawMessage
+		err = api.get(fmt.Sprintf("/repos/%s/rulesets/%d", repo, r.ID),
+			&ruleset)
+		if err != nil {
+			return
+		}
+		rulesets = append(rulesets, ruleset)
+	}
+	return
+}
+
+// writeMetadata write repository settings metadata file and add it to job
+// exported files. The file contains admin settings and is not published in
+// public mirror mode
+func writeMetadata(j *pipelineJob, m metadataFile) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := j.path + metadataSuffix
+	err = os.WriteFile(filepath.Join(j.dir, name), append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	j.addPrivate(name)
+	return nil
+}
+
+// exportList save all items of paginated repository api endpoint to
+// owner/repo.<name>.json file in the format of emergency command export,
+// so restore command recreates them
+func exportList(j *pipelineJob, name, endpoint string) error {
+	list, err := apiList(newAPIClient(j.acc.endpoint), "/repos/"+j.repo+
+		endpoint)
+	if err != nil {
+		return fmt.Errorf("export %s: %w", name, err)
+	}
+	if list == nil {
+		list = []json.RawMessage{}
+	}
+	file := j.path + "." + name + ".json"
+	if err = writeJSON(filepath.Join(j.dir, file), list); err != nil {
+		return err
+	}
+	j.paths = append(j.paths, file)
+	j.files = j.paths
+	return nil
+}
+
+// readMetadata read repository settings metadata file
+func readMetadata(name string) (m metadataFile, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &m)
+	return
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics listen address of daemon mode, empty if metrics endpoint is off
+var metricsListen string
+
+// Prometheus Pushgateway url the run summary metrics are pushed to on exit
+var pushgatewayURL string
+
+// backupMetrics is backup runs metrics of daemon and server modes exposed in
+// Prometheus text format
+type backupMetrics struct {
+	mu          sync.Mutex
+	running     bool
+	runs        map[string]int64 // Runs by status: success, failed
+	repos       map[string]int64 // Repositories by status: success, failed, blocked
+	fetched     int64            // Bytes of new objects fetched to mirrors
+	duration    time.Duration    // Last run duration
+	lastRun     time.Time
+	lastOK      bool
+	lastSuccess map[string]time.Time // Last successful backup by user
+}
+
+// metrics is backup runs metrics of this process
+var metrics = newMetrics()
+
+// newMetrics create empty backup runs metrics
+func newMetrics() *backupMetrics {
+	return &backupMetrics{runs: map[string]int64{}, repos: map[string]int64{},
+		lastSuccess: map[string]time.Time{}}
+}
+
+// seed fill last success timestamps from current manifest of output folder,
+// so restarted service doesn't report users as never backed up
+func (m *backupMetrics) seed(output string) {
+	cur, _ := manifestFiles(output)
+	manifest, err := readManifest(cur)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addSuccess(manifest)
+}
+
+// runStarted mark backup run started
+func (m *backupMetrics) runStarted() {
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+}
+
+// runFinished count finished backup run started at start with repositories
+// of manifest written by the run
+func (m *backupMetrics) runFinished(output string, start time.Time, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := "success"
+	if !ok {
+		status = "failed"
+	}
+	m.running, m.lastOK, m.lastRun = false, ok, time.Now()
+	m.duration = m.lastRun.Sub(start)
+	m.runs[status]++
+
+	cur, _ := manifestFiles(output)
+	manifest, err := readManifest(cur)
+	if err != nil || manifest.End.Before(start) {
+		return
+	}
+	for _, e := range manifest.Repos {
+		m.repos[e.Status]++
+		m.fetched += e.Fetched
+	}
+	m.addSuccess(manifest)
+}
+
+// pushMetrics push this run summary metrics to Pushgateway, grouped by job
+// github-backup and instance host name. The push replaces metrics of previous
+// run, so last success timestamps of users are taken from backup state which
+// keeps last successful backup of each repository between runs
+func pushMetrics(output string, ok bool) error {
+	m := newMetrics()
+	m.runFinished(output, runStart, ok)
+	for path, t := range state.Repos {
+		user := path
+		if i := strings.LastIndex(user, "/"); i > 0 {
+			user = user[:i]
+		}
+		if t.After(m.lastSuccess[user]) {
+			m.lastSuccess[user] = t
+		}
+	}
+	var body bytes.Buffer
+	m.write(&body)
+
+	url := strings.TrimSuffix(pushgatewayURL, "/") +
+		"/metrics/job/github-backup/instance/" + neturl.PathEscape(hostname())
+	req, err := http.NewRequest(http.MethodPut, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("PUT %s: %s\n%s", url, resp.Status, data)
+	}
+	return nil
+}
+
+// addSuccess set last success timestamps of users with successfully backed
+// up repositories in manifest
+func (m *backupMetrics) addSuccess(manifest runManifest) {
+	for _, e := range manifest.Repos {
+		if e.Status != "success" {
+			continue
+		}
+		user := e.Repo
+		if i := strings.LastIndex(user, "/"); i > 0 {
+			user = user[:i]
+		}
+		if manifest.End.After(m.lastSuccess[user]) {
+			m.lastSuccess[user] = manifest.End
+		}
+	}
+}
+
+// ServeHTTP serve metrics in Prometheus text exposition format
+func (m *backupMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// write metrics in Prometheus text exposition format
+func (m *backupMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	labeled := func(name, label string, values map[string]int64) {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+		}
+	}
+	seconds := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+	boolean := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	metric("github_backup_running", "gauge", "Backup run is in progress.")
+	fmt.Fprintf(w, "github_backup_running %d\n", boolean(m.running))
+	metric("github_backup_runs_total", "counter", "Backup runs by status.")
+	labeled("github_backup_runs_total", "status", m.runs)
+	metric("github_backup_repos_total", "counter", "Repositories processed by status.")
+	labeled("github_backup_repos_total", "status", m.repos)
+	metric("github_backup_fetched_bytes_total", "counter", "Bytes of new objects fetched to mirrors.")
+	fmt.Fprintf(w, "github_backup_fetched_bytes_total %d\n", m.fetched)
+	metric("github_backup_run_duration_seconds", "gauge", "Duration of last backup run.")
+	fmt.Fprintf(w, "github_backup_run_duration_seconds %.3f\n", m.duration.Seconds())
+	metric("github_backup_last_run_timestamp_seconds", "gauge", "Time of last backup run end.")
+	fmt.Fprintf(w, "github_backup_last_run_timestamp_seconds %.3f\n", seconds(m.lastRun))
+	metric("github_backup_last_run_success", "gauge", "Last backup run succeeded.")
+	fmt.Fprintf(w, "github_backup_last_run_success %d\n", boolean(m.lastOK))
+	metric("github_backup_last_success_timestamp_seconds", "gauge", "Time of last successful backup of user repositories.")
+	users := make([]string, 0, len(m.lastSuccess))
+	for u := range m.lastSuccess {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		fmt.Fprintf(w, "github_backup_last_success_timestamp_seconds{user=%q} %.3f\n",
+			u, seconds(m.lastSuccess[u]))
+	}
+}
+
+// serveMetrics start metrics endpoint /metrics on listen address
+func serveMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			logError("metrics endpoint", "listen", listen, "error", err)
+		}
+	}()
+}
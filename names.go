@@ -0,0 +1,82 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nameRule is repository name transformation rule applied to destination
+// paths
+type nameRule struct {
+	kind string // lower, strip-prefix, replace or map
+	old  string
+	new  string
+}
+
+// Destination paths transformation rules set by -dest-names parameter
+var nameRules []nameRule
+
+// parseNameRules parse comma separated list of name transformation rules:
+//
+//	lower                  - lowercase path
+//	strip-prefix=prefix    - remove path prefix, e.g. github.com/ or my-org-
+//	replace=old:new        - replace all old substrings with new
+//	map=owner/repo:path    - rename repository path
+func parseNameRules(list string) (rules []nameRule, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		kind, val, _ := strings.Cut(s, "=")
+		r := nameRule{kind: kind}
+		switch kind {
+		case "lower":
+		case "strip-prefix":
+			r.old = val
+		case "replace", "map":
+			var ok bool
+			if r.old, r.new, ok = strings.Cut(val, ":"); !ok || len(r.old) == 0 {
+				return nil, fmt.Errorf("wrong name rule '%s', should be %s=old:new",
+					s, kind)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported name rule '%s'", s)
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+// repoSuffix return true if s is suffix of repository file name: empty,
+// .git, .wiki.git, .sbom.json, /path or archive -YYYYMMDD date suffix
+func repoSuffix(s string) bool {
+	return len(s) == 0 || s[0] == '.' || s[0] == '/' ||
+		len(s) > 1 && s[0] == '-' && s[1] >= '0' && s[1] <= '9'
+}
+
+// destPath return destination path of file or folder path relative to the
+// output folder transformed by name rules in rules order. The map rule
+// renames repository path keeping its .git, .wiki.git and other suffixes
+func destPath(path string) string {
+	for _, r := range nameRules {
+		switch r.kind {
+		case "lower":
+			path = strings.ToLower(path)
+		case "strip-prefix":
+			path = strings.TrimPrefix(path, r.old)
+		case "replace":
+			path = strings.ReplaceAll(path, r.old, r.new)
+		case "map":
+			if rest := strings.TrimPrefix(path, r.old); rest != path &&
+				repoSuffix(rest) {
+				path = r.new + rest
+			}
+		}
+	}
+	return path
+}
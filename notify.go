@@ -0,0 +1,159 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Notification types
+const (
+	notifyInfo    = "info"
+	notifySuccess = "success"
+	notifyWarning = "warning"
+	notifyFailure = "failure"
+)
+
+// notification is message sent to notifiers
+type notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Type  string `json:"type"`
+}
+
+// notifier send notifications to some service
+type notifier interface {
+	notify(n notification) error
+}
+
+// Notifiers created from -notify parameter
+var notifiers []notifier
+
+// newNotifiers create notifiers from comma separated notification urls list:
+//
+//	apprise://host[:port]/key, apprises://host[:port]/key - Apprise API
+//	  persistent configuration key, apprises use https
+//	smtp://user@host[:port]?to=addr, smtps://...            - email sent
+//	  with SMTP server, see newSMTPNotifier
+//	https://hooks.slack.com/services/...                    - Slack and
+//	https://discord.com/api/webhooks/...                      Discord
+//	  incoming webhooks, messages are formatted by notification type
+//	any other url (slack://, tgram://, mailto://, ...)    - Apprise service
+//	  url, sent with stateless Apprise API set in appriseAPI parameter
+func newNotifiers(notifylist, appriseAPI string) (n []notifier, err error) {
+	var urls []string
+	for _, rawurl := range strings.Split(notifylist, ",") {
+		rawurl = strings.TrimSpace(rawurl)
+		if len(rawurl) == 0 {
+			continue
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "apprise", "apprises":
+			scheme := "http"
+			if u.Scheme == "apprises" {
+				scheme = "https"
+			}
+			key := strings.Trim(u.Path, "/")
+			n = append(n, &appriseNotifier{
+				endpoint: scheme + "://" + u.Host + "/notify/" + key,
+			})
+		case "https":
+			switch chatWebhook(u) {
+			case "slack":
+				n = append(n, &slackNotifier{url: rawurl})
+			case "discord":
+				n = append(n, &discordNotifier{url: rawurl})
+			default:
+				urls = append(urls, rawurl)
+			}
+		case "smtp", "smtps":
+			nt, err := newSMTPNotifier(u)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nt)
+		default:
+			urls = append(urls, rawurl)
+		}
+	}
+
+	// Service urls are sent with one stateless Apprise API request
+	if len(urls) != 0 {
+		if len(appriseAPI) == 0 {
+			return nil, fmt.Errorf("the -apprise-api parameter is required"+
+				" to send notifications to: %s", strings.Join(urls, ", "))
+		}
+		n = append(n, &appriseNotifier{
+			endpoint: strings.TrimSuffix(appriseAPI, "/") + "/notify",
+			urls:     strings.Join(urls, ","),
+		})
+	}
+	return
+}
+
+// sendNotify send notification to all notifiers, errors are logged
+func sendNotify(typ, title, body string) {
+	n := notification{Title: title, Body: body, Type: typ}
+	for _, nt := range notifiers {
+		if err := nt.notify(n); err != nil {
+			logError("notify error", "error", err)
+		}
+	}
+}
+
+// fatal send failure notification and exit with logFatal
+func fatal(v ...interface{}) {
+	sendNotify(notifyFailure, "Github backup failed", fmt.Sprint(v...))
+	logFatal(v...)
+}
+
+// appriseNotifier send notifications with Apprise API. If urls is empty the
+// persistent configuration key endpoint is used
+type appriseNotifier struct {
+	endpoint string
+	urls     string
+}
+
+func (a *appriseNotifier) notify(n notification) error {
+	data, err := json.Marshal(struct {
+		URLs string `json:"urls,omitempty"`
+		notification
+	}{a.urls, n})
+	if err != nil {
+		return err
+	}
+	return postJSON(a.endpoint, data)
+}
+
+// postJSON send http POST request with json body and check response status
+func postJSON(url string, data []byte) error {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: %s\n%s", url, resp.Status, body)
+	}
+	return nil
+}
+
+// hostname return host name used in notifications
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Export organization Actions configuration flag set by -org-actions
+// parameter
+var orgActions bool
+
+// orgActionsConfig is organization level Actions configuration. Secrets
+// values can't be read with api, so only names are exported
+type orgActionsConfig struct {
+	Org          string          `json:"org"`
+	Exported     time.Time       `json:"exported"`
+	Secrets      []actionsItem   `json:"secrets"`
+	Variables    []actionsItem   `json:"variables"`
+	RunnerGroups json.RawMessage `json:"runner_groups,omitempty"`
+	Permissions  json.RawMessage `json:"permissions,omitempty"`
+	Selected     json.RawMessage `json:"selected_actions,omitempty"`
+}
+
+// actionsItem is Actions secret or variable name
+type actionsItem struct {
+	Name       string    `json:"name"`
+	Visibility string    `json:"visibility,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// accountExports is account level exports saved before account repositories
+// backup. Export returns file path relative to output folder, or empty name
+// if there is nothing to export
+var accountExports = []struct {
+	name    string
+	enabled func() bool
+	export  func(acc account, dir string) (string, error)
+}{
+	{"org actions", func() bool { return orgActions }, exportOrgActions},
+	{"org teams", func() bool { return orgTeams }, exportOrgTeams},
+	{"org profile", func() bool { return orgProfile }, exportOrgProfile},
+	{"projects", func() bool { return projects }, exportProjects},
+}
+
+// isOrg return true if account is organization
+func isOrg(acc account) (bool, error) {
+	var data struct {
+		Type string `json:"type"`
+	}
+	if err := newAPIClient(acc.endpoint).get("/users/"+acc.Name,
+		&data); err != nil {
+		return false, err
+	}
+	return data.Type == "Organization", nil
+}
+
+// actionsItems return all Actions secrets or variables names of organization
+// from paginated api endpoint ('secrets' or 'variables')
+func actionsItems(acc account, kind string) (items []actionsItem, err error) {
+	list, err := wrappedList(newAPIClient(acc.endpoint), "/orgs/"+acc.Name+
+		"/actions/"+kind+"?per_page=100", kind)
+	if err != nil {
+		return
+	}
+	err = unmarshalList(list, &items)
+	return
+}
+
+// wrappedList return all list items of paginated api endpoint which wraps
+// items list in object with total count and key field, e.g. {"total_count":
+// 2, "secrets": [...]}. The endpoint should contain query parameters with
+// per_page=100
+func wrappedList(api *apiClient, endpoint, key string) (
+	list []json.RawMessage, err error) {
+
+	for p := 1; ; p++ {
+		var data map[string]json.RawMessage
+		if err = api.get(fmt.Sprintf("%s&page=%d", endpoint, p),
+			&data); err != nil {
+			return
+		}
+		var page []json.RawMessage
+		if err = json.Unmarshal(data[key], &page); err != nil {
+			return
+		}
+		list = append(list, page...)
+		if len(page) < 100 {
+			return
+		}
+	}
+}
+
+// unmarshalList unmarshal list items to slice v
+func unmarshalList(list []json.RawMessage, v interface{}) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// exportOrgActions save organization Actions secrets and variables names,
+// runner groups and allowed actions policy to the [host/]org/org-actions.json
+// file. Returns file path relative to dir folder, or empty name if account is
+// not organization
+func exportOrgActions(acc account, dir string) (name string, err error) {
+	org, err := isOrg(acc)
+	if err != nil || !org {
+		return
+	}
+	api := newAPIClient(acc.endpoint)
+	c := orgActionsConfig{Org: acc.String(), Exported: time.Now().UTC()}
+	if c.Secrets, err = actionsItems(acc, "secrets"); err != nil {
+		return
+	}
+	if c.Variables, err = actionsItems(acc, "variables"); err != nil {
+		return
+	}
+	if err = api.get("/orgs/"+acc.Name+"/actions/runner-groups?per_page=100",
+		&c.RunnerGroups); err != nil {
+		return
+	}
+	if err = api.get("/orgs/"+acc.Name+"/actions/permissions",
+		&c.Permissions); err != nil {
+		return
+	}
+	var perm struct {
+		AllowedActions string `json:"allowed_actions"`
+	}
+	json.Unmarshal(c.Permissions, &perm)
+	if perm.AllowedActions == "selected" {
+		if err = api.get("/orgs/"+acc.Name+
+			"/actions/permissions/selected-actions", &c.Selected); err != nil {
+			return
+		}
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+	name = snapshotPath(acc.path(acc.Name + "/org-actions.json"))
+	local := filepath.Join(dir, name)
+	if err = os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return
+	}
+	err = os.WriteFile(local, append(data, '\n'), 0644)
+	return
+}
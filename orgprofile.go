@@ -0,0 +1,113 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Export organization profile flag set by -org-profile parameter
+var orgProfile bool
+
+// orgProfileExport is organization profile and settings snapshot written to
+// [host/]org/org-profile.json file
+type orgProfileExport struct {
+	Org           string            `json:"org"`
+	Exported      time.Time         `json:"exported"`
+	Profile       json.RawMessage   `json:"profile"` // Profile and settings
+	Members       []orgMember       `json:"members,omitempty"`
+	Outside       []string          `json:"outside_collaborators,omitempty"`
+	Installations []json.RawMessage `json:"installations,omitempty"`
+	Unavailable   []string          `json:"unavailable,omitempty"` // Sections not exported
+}
+
+// orgMember is organization member login with role: admin or member
+type orgMember struct {
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+// exportOrgProfile save organization profile with settings (default
+// repository permission, members privileges, two-factor requirement; github
+// reports settings to owners only), members with roles, outside
+// collaborators and installed GitHub Apps to the [host/]org/org-profile.json
+// file. Sections which can't be read with the token are listed in
+// unavailable. Returns file path relative to dir folder, or empty name if
+// account is not organization
+func exportOrgProfile(acc account, dir string) (name string, err error) {
+	org, err := isOrg(acc)
+	if err != nil || !org {
+		return
+	}
+	api := newAPIClient(acc.endpoint)
+	prefix := "/orgs/" + acc.Name
+	export := orgProfileExport{Org: acc.String(), Exported: time.Now().UTC()}
+	if err = api.get(prefix, &export.Profile); err != nil {
+		return
+	}
+	for _, s := range []struct {
+		name   string
+		export func() error
+	}{
+		{"members", func() error {
+			for _, role := range []string{"admin", "member"} {
+				logins, err := userLogins(api, prefix+"/members?role="+role+
+					"&per_page=100")
+				if err != nil {
+					return err
+				}
+				for _, login := range logins {
+					export.Members = append(export.Members,
+						orgMember{Login: login, Role: role})
+				}
+			}
+			return nil
+		}},
+		{"outside_collaborators", func() (err error) {
+			export.Outside, err = userLogins(api, prefix+
+				"/outside_collaborators?per_page=100")
+			return
+		}},
+		{"installations", func() (err error) {
+			export.Installations, err = wrappedList(api, prefix+
+				"/installations?per_page=100", "installations")
+			return
+		}},
+	} {
+		if err := s.export(); err != nil {
+			if !notAvailable(err) {
+				logWarn(fmt.Sprintf("%s: can't export %s: %s", acc, s.name,
+					firstLine(err.Error())), "user", acc.Name)
+			}
+			export.Unavailable = append(export.Unavailable, s.name)
+		}
+	}
+
+	name = snapshotPath(acc.path(acc.Name + "/org-profile.json"))
+	err = writeJSON(filepath.Join(dir, name), export)
+	return
+}
+
+// userLogins return logins of users list of paginated api endpoint
+func userLogins(api *apiClient, endpoint string) (logins []string, err error) {
+	list, err := apiList(api, endpoint)
+	if err != nil {
+		return
+	}
+	var users []struct {
+		Login string `json:"login"`
+	}
+	if err = unmarshalList(list, &users); err != nil {
+		return
+	}
+	logins = []string{}
+	for _, u := range users {
+		logins = append(logins, u.Login)
+	}
+	return
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+)
+
+// Export organization teams flag set by -org-teams parameter
+var orgTeams bool
+
+// orgTeamsExport is organization teams export written to
+// [host/]org/org-teams.json file
+type orgTeamsExport struct {
+	Org      string    `json:"org"`
+	Exported time.Time `json:"exported"`
+	Teams    []orgTeam `json:"teams"`
+}
+
+// orgTeam is organization team with parent team, members with roles and
+// repositories with team permissions
+type orgTeam struct {
+	Name        string       `json:"name"`
+	Slug        string       `json:"slug"`
+	Description string       `json:"description"`
+	Privacy     string       `json:"privacy"`
+	Permission  string       `json:"permission"`
+	Parent      string       `json:"parent,omitempty"` // Parent team slug
+	Members     []teamMember `json:"members"`
+	Repos       []teamRepo   `json:"repos"`
+}
+
+// teamMember is team member login with team role: member or maintainer
+type teamMember struct {
+	Login string `json:"login"`
+	Role  string `json:"role"`
+}
+
+// teamRepo is team repository with team permission level
+type teamRepo struct {
+	Repo       string `json:"repo"`
+	Permission string `json:"permission"`
+}
+
+// exportOrgTeams save organization teams with hierarchy (parent team),
+// members with roles and repositories with team permissions to the
+// [host/]org/org-teams.json file. Returns file path relative to dir folder,
+// or empty name if account is not organization
+func exportOrgTeams(acc account, dir string) (name string, err error) {
+	org, err := isOrg(acc)
+	if err != nil || !org {
+		return
+	}
+	api := newAPIClient(acc.endpoint)
+	prefix := "/orgs/" + acc.Name + "/teams"
+	list, err := apiList(api, prefix+"?per_page=100")
+	if err != nil {
+		return
+	}
+	export := orgTeamsExport{Org: acc.String(), Exported: time.Now().UTC(),
+		Teams: []orgTeam{}}
+	for _, data := range list {
+		var t struct {
+			orgTeam
+			Parent *struct {
+				Slug string `json:"slug"`
+			} `json:"parent"`
+		}
+		if err = json.Unmarshal(data, &t); err != nil {
+			return
+		}
+		team := t.orgTeam
+		if t.Parent != nil {
+			team.Parent = t.Parent.Slug
+		}
+		team.Members = []teamMember{}
+		for _, role := range []string{"maintainer", "member"} {
+			var members []struct {
+				Login string `json:"login"`
+			}
+			list, err := apiList(api, prefix+"/"+team.Slug+
+				"/members?role="+role+"&per_page=100")
+			if err == nil {
+				err = unmarshalList(list, &members)
+			}
+			if err != nil {
+				return "", err
+			}
+			for _, m := range members {
+				team.Members = append(team.Members,
+					teamMember{Login: m.Login, Role: role})
+			}
+		}
+		if team.Repos, err = teamRepos(api, prefix+"/"+team.Slug); err != nil {
+			return
+		}
+		export.Teams = append(export.Teams, team)
+	}
+
+	name = snapshotPath(acc.path(acc.Name + "/org-teams.json"))
+	err = writeJSON(filepath.Join(dir, name), export)
+	return
+}
+
+// teamRepos return repositories of team with team permission level: role
+// name (custom repository role or admin, maintain, write, triage, read)
+func teamRepos(api *apiClient, team string) (repos []teamRepo, err error) {
+	list, err := apiList(api, team+"/repos?per_page=100")
+	if err != nil {
+		return
+	}
+	repos = []teamRepo{}
+	for _, data := range list {
+		var r struct {
+			FullName string `json:"full_name"`
+			RoleName string `json:"role_name"`
+		}
+		if err = json.Unmarshal(data, &r); err != nil {
+			return
+		}
+		repos = append(repos, teamRepo{Repo: r.FullName,
+			Permission: r.RoleName})
+	}
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Number of backup passes set by -passes parameter: repositories failed in
+// main pass are backed up again in next passes, 1 - failures are not retried
+var backupPasses = 2
+
+// Pause before next backup pass, so transient github problems may pass
+const passDelay = 10 * time.Second
+
+// failedRepo is repository failed in backup pass, to retry in next pass
+type failedRepo struct {
+	acc  account
+	repo string
+	dir  string
+	meta publicRepo
+}
+
+// Repositories failed in current backup pass
+var failedRepos []failedRepo
+
+// retryFailed back up repositories failed in main pass again in next passes,
+// until they succeed or passes are over, and return cloned repositories.
+// Result of retried repository replaces its failed result, so only
+// repositories failed in all passes are reported failed
+func retryFailed() (cloned []string) {
+	for pass := 2; pass <= backupPasses && len(failedRepos) != 0; pass++ {
+		if runAborted() {
+			break
+		}
+		queue := failedRepos
+		failedRepos = nil
+		logInfo(fmt.Sprintf("backup pass %d: retry %d failed repositories",
+			pass, len(queue)), "pass", pass, "repos", len(queue))
+		time.Sleep(passDelay)
+		progress.addTotal(len(queue))
+		for _, f := range queue {
+			if runAborted() {
+				break
+			}
+			prev, ok := removeResult(f.acc.path(f.repo))
+			logInfo(fmt.Sprintf("retry repo: %s", f.repo),
+				repoFields(f.repo)...)
+			waitBlackout()
+			r, c := backupRepo(f.acc, f.repo, f.dir, f.meta, time.Now())
+			cloned = append(cloned, c...)
+			if ok {
+				r.Cloned = r.Cloned || prev.Cloned
+				r.Fetched += prev.Fetched
+			}
+			if r.Err == nil {
+				logInfo(fmt.Sprintf("repo %s backed up in pass %d", f.repo,
+					pass), repoFields(f.repo)...)
+			}
+		}
+	}
+	failedRepos = nil
+	return
+}
+
+// removeResult remove repository result by path and return removed result
+func removeResult(path string) (r repoResult, ok bool) {
+	for i := range results {
+		if results[i].Path == path {
+			r = results[i]
+			results = append(results[:i], results[i+1:]...)
+			return r, true
+		}
+	}
+	return
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pipelineJob is state of repository backup passed through pipeline stages
+type pipelineJob struct {
+	acc     account
+	repo    string
+	dir     string              // Output folder
+	path    string              // Repository path relative to output folder
+	paths   []string            // Mirrors and exported files relative to output folder
+	files   []string            // Files to copy to destinations
+	meta    publicRepo          // Public metadata in public mirror mode
+	tip     string              // Upstream HEAD commit hash captured
+	cloned  []string            // Cloned repositories names
+	policy  *repoPolicy         // Repository backup policy, nil if not set
+	shallow bool                // Mirror is shallow clone
+	caps    *repoCaps           // Repository capabilities, nil if not probed
+	store   string              // Fork family object store, empty if not used
+	outputs map[string][]string // Files of each output format
+}
+
+// addPrivate add exported file or folder with private data (e.g. admin
+// settings) to job paths and files. In public mirror mode it is kept in the
+// output folder only and not copied to destinations
+func (j *pipelineJob) addPrivate(name string) {
+	if publicMirror {
+		return
+	}
+	j.paths = append(j.paths, name)
+	j.files = j.paths
+}
+
+// stage is repository backup pipeline stage. Failure of required stage stops
+// the pipeline and fails the repository backup. Failure of not required stage
+// is reported and the pipeline continues
+type stage struct {
+	name     string
+	required bool
+	enabled  func() bool // Stage is enabled by parameters, nil - always
+	run      func(j *pipelineJob) error
+}
+
+// Stage statuses
+const (
+	stageOK     = "ok"
+	stageFailed = "failed"
+)
+
+// stageResult is result of pipeline stage
+type stageResult struct {
+	Stage    string
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// stages is all pipeline stages in default order
+var stages = []stage{
+	{"clone", true, nil, cloneStage},
+	{"probe", false, nil, probeStage},
+	{"lfs", false, func() bool { return lfs }, lfsStage},
+	{"wiki", false, nil, wikiStage},
+	{"releases", false, func() bool { return releaseAssets }, releasesStage},
+	{"workflows", false, func() bool { return len(workflowLogs) != 0 }, workflowsStage},
+	{"discussions", false, func() bool { return discussions }, discussionsStage},
+	{"projects", false, func() bool { return projects }, projectsStage},
+	{"stargazers", false, func() bool { return stargazers }, stargazersStage},
+	{"alternates", false, func() bool { return forkAlternates }, alternatesStage},
+	{"describe", false, nil, describeStage},
+	{"maintenance", false, func() bool { return len(maintenance) != 0 }, maintenanceStage},
+	{"hardlink", false, func() bool { return hardlink }, hardlinkStage},
+	{"sbom", false, func() bool { return sbom }, sbomStage},
+	{"inventory", false, func() bool { return inv != nil }, inventoryStage},
+	{"publish", true, func() bool { return publicMirror }, publishStage},
+	{"package", true, packaged, packageStage},
+	{"checksum", false, packaged, checksumStage},
+	{"upload", true, nil, uploadStage},
+}
+
+// pipeline is stages of this run set by -pipeline parameter
+var pipeline = stages
+
+// parsePipeline set pipeline from comma separated list of stages names. The
+// stages are executed in list order and stages not listed are disabled. The
+// clone stage is required and should be first
+func parsePipeline(list string) error {
+	if len(strings.TrimSpace(list)) == 0 {
+		return nil
+	}
+	pipeline = nil
+	used := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		var found bool
+		for _, s := range stages {
+			if s.name == name {
+				pipeline = append(pipeline, s)
+				found = true
+				break
+			}
+		}
+		switch {
+		case !found:
+			return fmt.Errorf("wrong pipeline stage '%s'", name)
+		case used[name]:
+			return fmt.Errorf("pipeline stage '%s' is duplicated", name)
+		}
+		used[name] = true
+	}
+	if pipeline[0].name != "clone" {
+		return fmt.Errorf("pipeline should start with clone stage")
+	}
+	return nil
+}
+
+// runPipeline execute enabled pipeline stages for repository and return
+// stages results and error of failed required stage
+func runPipeline(j *pipelineJob) (results []stageResult, err error) {
+	defer startRepoTimeout()()
+	for _, s := range pipeline {
+		enabled := s.enabled == nil || s.enabled()
+		enabled = j.policy.stageEnabled(s.name, enabled)
+		if !j.caps.stageEnabled(s.name, enabled) {
+			continue
+		}
+		start := time.Now()
+		serr := s.run(j)
+		r := stageResult{Stage: s.name, Status: stageOK,
+			Duration: time.Since(start), Err: serr}
+		if serr != nil {
+			r.Status = stageFailed
+			logWarn(fmt.Sprintf("%s: %s stage: %s", j.repo, s.name, serr),
+				append(repoFields(j.repo), "stage", s.name, "error", serr)...)
+		} else {
+			logDebug(fmt.Sprintf("%s: %s stage done", j.repo, s.name),
+				append(repoFields(j.repo), "stage", s.name,
+					"duration", r.Duration)...)
+		}
+		results = append(results, r)
+		if serr != nil && s.required {
+			err = fmt.Errorf("%s stage: %w", s.name, serr)
+			return
+		}
+
+		// Remaining stages are not run when repository timeout is exceeded
+		if repoTimedOut() {
+			err = fmt.Errorf("%s stage: %w", s.name, errRepoTimeout)
+			return
+		}
+	}
+	return
+}
+
+// cloneStage clone repository mirror
+func cloneStage(j *pipelineJob) error {
+	refs := refPatterns
+	if p := ownerPolicy(j.acc); p != nil && p.Refs != nil {
+		refs = p.Refs
+	}
+	mirror := j.dir + "/" + j.path + ".git"
+	var reference string
+	if forkAlternates {
+		reference = forkReference(j)
+	}
+	if err := cloneMirror(j.acc, j.repo, mirror, refs, reference); err != nil {
+		return err
+	}
+	j.cloned = append(j.cloned, j.repo)
+	j.paths = []string{j.path + ".git"}
+	j.files = j.paths
+	j.policy = loadPolicy(j)
+
+	// Repository policy refs patterns are known after clone only
+	if j.policy != nil && j.policy.Refs != nil &&
+		strings.Join(j.policy.Refs, ",") != strings.Join(refs, ",") {
+		if err := filterRefs(mirror, j.policy.Refs); err != nil {
+			return err
+		}
+	}
+	j.tip = headTip(mirror)
+	j.shallow = isShallow(mirror)
+	return nil
+}
+
+// wikiStage clone repository wiki mirror if the wiki exists
+func wikiStage(j *pipelineJob) error {
+	err := cloneMirror(j.acc, j.repo+".wiki", j.dir+"/"+j.path+".wiki.git",
+		nil, "")
+	if err == nil {
+		j.cloned = append(j.cloned, j.repo+".wiki")
+		j.paths = append(j.paths, j.path+".wiki.git")
+		j.files = j.paths
+	}
+	return nil
+}
+
+// hardlinkStage hardlink unchanged files against previous snapshot
+func hardlinkStage(j *pipelineJob) error {
+	n, saved, err := linkSnapshot(j.dir, j.paths)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logInfo(fmt.Sprintf("%s: %d files hardlinked to snapshot %s, %s saved",
+			j.repo, n, prevSnapshot, formatSize(saved)),
+			append(repoFields(j.repo), "files", n, "bytes", saved)...)
+	}
+	return nil
+}
+
+// sbomStage export dependency graph SBOM
+func sbomStage(j *pipelineJob) error {
+	name, err := exportSBOM(j.acc, j.repo, j.dir, j.path)
+	if err != nil {
+		return err
+	}
+	j.paths = append(j.paths, name)
+	j.files = j.paths
+	return nil
+}
+
+// inventoryStage add repository licenses to inventory
+func inventoryStage(j *pipelineJob) error {
+	return addInventory(j.acc, j.repo, j.dir+"/"+j.path+".git")
+}
+
+// publishStage prepare cloned repository and its wiki to publish in public
+// mirror mode
+func publishStage(j *pipelineJob) error {
+	j.meta.Wiki = len(j.paths) > 1 && j.paths[1] == j.path+".wiki.git"
+	return publishRepo(j.dir, j.paths, j.meta)
+}
+
+// packageStage pack mirrors to archive in archive format and create bundles
+// in bundle format, for each output format from the same mirrors. Archives
+// and bundles are encrypted if encryption recipients are set
+func packageStage(j *pipelineJob) (err error) {
+	j.outputs = map[string][]string{}
+	j.files = nil
+	for _, f := range formats {
+		var files []string
+		switch f {
+		case formatMirror:
+			files = j.paths
+		case formatArchive:
+			var archive string
+			if archive, err = archiveRepo(j.dir, j.path, j.paths); err != nil {
+				return
+			}
+			files = []string{archive}
+		case formatBundle:
+			if files, err = bundleRepo(j.dir, j.paths); err != nil {
+				return
+			}
+		}
+		j.outputs[f] = files
+		j.files = append(j.files, files...)
+	}
+	return
+}
+
+// uploadStage copy repository files to destinations, files of each output
+// format to destinations of the format
+func uploadStage(j *pipelineJob) error {
+	if j.outputs == nil {
+		return putDests(j.dir, j.files)
+	}
+	return putOutputs(j.dir, j.outputs)
+}
+
+// stageNames return comma separated list of all stages names
+func stageNames() string {
+	var names []string
+	for _, s := range stages {
+		names = append(names, s.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// stagesSummary return short description of stages results
+func stagesSummary(results []stageResult) string {
+	var list []string
+	for _, r := range results {
+		list = append(list, r.Stage+":"+r.Status)
+	}
+	return strings.Join(list, " ")
+}
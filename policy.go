@@ -0,0 +1,173 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// policyFile is repository backup policy file name. The file is read from
+// HEAD of repository, or from the owner '.github' repository as default for
+// all owner repositories
+const policyFile = ".github-backup.yml"
+
+// repoPolicy is repository backup policy set by repository maintainers:
+//
+//	metadata: false   # opt out of metadata export (describe, sbom, inventory)
+//	lfs: true         # request Git LFS objects backup
+//	tier: critical    # repository tier reported in manifest
+//	refs: ^refs/pull/* # refs patterns of mirror, or all
+type repoPolicy struct {
+	Metadata *bool
+	LFS      *bool
+	Tier     string
+	Refs     []string // Refs patterns, empty - all refs, nil - not set
+}
+
+// metadataStages is pipeline stages exporting repository metadata
+var metadataStages = map[string]bool{"describe": true, "sbom": true,
+	"inventory": true}
+
+// Owners default policies read from '.github' repositories by account
+var ownerPolicies = struct {
+	sync.Mutex
+	m map[string]*repoPolicy
+}{m: map[string]*repoPolicy{}}
+
+// parsePolicy parse policy file. The file is simple YAML with 'key: value'
+// lines, comments and unknown keys are ignored
+func parsePolicy(data string) (p *repoPolicy, err error) {
+	p = &repoPolicy{}
+	for i, line := range strings.Split(data, "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		if len(strings.TrimSpace(line)) == 0 || line == "---" {
+			continue
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s line %d: wrong line '%s'", policyFile,
+				i+1, line)
+		}
+		key = strings.TrimSpace(key)
+		val = strings.Trim(strings.TrimSpace(val), `"'`)
+		switch key {
+		case "metadata", "lfs":
+			var b bool
+			switch strings.ToLower(val) {
+			case "true", "yes", "on":
+				b = true
+			case "false", "no", "off":
+			default:
+				return nil, fmt.Errorf("%s line %d: wrong %s value '%s'",
+					policyFile, i+1, key, val)
+			}
+			if key == "metadata" {
+				p.Metadata = &b
+			} else {
+				p.LFS = &b
+			}
+		case "tier":
+			p.Tier = val
+		case "refs":
+			p.Refs = []string{}
+			if val == "all" {
+				break
+			}
+			if p.Refs, err = parseRefs(val); err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", policyFile, i+1, err)
+			}
+		}
+	}
+	return
+}
+
+// merge return policy with unset values taken from default policy
+func (p *repoPolicy) merge(def *repoPolicy) *repoPolicy {
+	if def == nil {
+		return p
+	}
+	if p == nil {
+		return def
+	}
+	r := *p
+	if r.Metadata == nil {
+		r.Metadata = def.Metadata
+	}
+	if r.LFS == nil {
+		r.LFS = def.LFS
+	}
+	if len(r.Tier) == 0 {
+		r.Tier = def.Tier
+	}
+	if r.Refs == nil {
+		r.Refs = def.Refs
+	}
+	return &r
+}
+
+// stageEnabled return stage enabled state changed by policy
+func (p *repoPolicy) stageEnabled(stage string, enabled bool) bool {
+	switch {
+	case p == nil:
+	case metadataStages[stage] && p.Metadata != nil && !*p.Metadata:
+		return false
+	case stage == "lfs" && p.LFS != nil:
+		return *p.LFS
+	}
+	return enabled
+}
+
+// ownerPolicy return default policy of account from '.github' repository,
+// or nil if it is not set
+func ownerPolicy(acc account) *repoPolicy {
+	ownerPolicies.Lock()
+	defer ownerPolicies.Unlock()
+	if p, ok := ownerPolicies.m[acc.String()]; ok {
+		return p
+	}
+	var data struct {
+		Content string `json:"content"`
+	}
+	var p *repoPolicy
+	err := newAPIClient(acc.endpoint).get(
+		"/repos/"+acc.Name+"/.github/contents/"+policyFile, &data)
+	if err == nil {
+		var text []byte
+		text, err = base64.StdEncoding.DecodeString(
+			strings.ReplaceAll(data.Content, "\n", ""))
+		if err == nil {
+			p, err = parsePolicy(string(text))
+		}
+		if err != nil {
+			logWarn(fmt.Sprintf("%s/.github: %s", acc.Name, err),
+				append(repoFields(acc.Name+"/.github"), "error", err)...)
+		}
+	}
+	ownerPolicies.m[acc.String()] = p
+	return p
+}
+
+// loadPolicy return policy of cloned repository from policy file in mirror
+// HEAD merged with owner default policy
+func loadPolicy(j *pipelineJob) *repoPolicy {
+	var p *repoPolicy
+	mirror := filepath.Join(j.dir, j.path+".git")
+	text, err := exec.Command("git", "-C", mirror, "show",
+		"HEAD:"+policyFile).Output()
+	if err == nil {
+		if p, err = parsePolicy(string(text)); err != nil {
+			logWarn(fmt.Sprintf("%s: %s", j.repo, err),
+				append(repoFields(j.repo), "error", err)...)
+		}
+	}
+	return p.merge(ownerPolicy(j.acc))
+}
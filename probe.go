@@ -0,0 +1,84 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// repoCaps is repository capabilities detected by probe stage and saved in
+// backup state
+type repoCaps struct {
+	Wiki        bool      `json:"wiki"`
+	LFS         bool      `json:"lfs"`
+	Submodules  bool      `json:"submodules"`
+	Releases    bool      `json:"releases"`
+	Issues      bool      `json:"issues"`
+	Discussions bool      `json:"discussions"`
+	Probed      time.Time `json:"probed"`
+}
+
+// probeStage detect repository capabilities with github api and cheap checks
+// of cloned mirror HEAD: wiki, issues and discussions are enabled, releases exist,
+// LFS files and submodules are used. The capabilities are saved to backup
+// state and disable stages which have nothing to backup. When github api
+// request fails the api capabilities are taken from previous probe
+func probeStage(j *pipelineJob) (err error) {
+	caps := &repoCaps{Probed: time.Now().UTC()}
+	prev := state.Caps[j.acc.path(j.repo)]
+	defer func() {
+		if err != nil && prev == nil {
+			return
+		}
+		state.Caps[j.acc.path(j.repo)] = caps
+		j.caps = caps
+	}()
+
+	mirror := j.dir + "/" + j.path + ".git"
+	if out, e := exec.Command("git", "-C", mirror, "show",
+		"HEAD:.gitattributes").Output(); e == nil {
+		caps.LFS = strings.Contains(string(out), "filter=lfs")
+	}
+	caps.Submodules = exec.Command("git", "-C", mirror, "cat-file", "-e",
+		"HEAD:.gitmodules").Run() == nil
+
+	var repo struct {
+		HasWiki        bool `json:"has_wiki"`
+		HasIssues      bool `json:"has_issues"`
+		HasDiscussions bool `json:"has_discussions"`
+	}
+	var releases []struct{}
+	c := newAPIClient(j.acc.endpoint)
+	if err = c.get("/repos/"+j.repo, &repo); err == nil {
+		err = c.get("/repos/"+j.repo+"/releases?per_page=1", &releases)
+	}
+	if err != nil {
+		if prev != nil {
+			caps.Wiki, caps.Releases = prev.Wiki, prev.Releases
+			caps.Issues, caps.Discussions = prev.Issues, prev.Discussions
+		}
+		return
+	}
+	caps.Wiki, caps.Discussions = repo.HasWiki, repo.HasDiscussions
+	caps.Issues = repo.HasIssues
+	caps.Releases = len(releases) != 0
+	return
+}
+
+// stageEnabled return stage enabled state changed by repository capabilities:
+// wiki, LFS, releases and discussions stages are disabled if repository has
+// no wiki, LFS files, releases or discussions
+func (c *repoCaps) stageEnabled(stage string, enabled bool) bool {
+	switch {
+	case c == nil:
+	case stage == "wiki" && !c.Wiki, stage == "lfs" && !c.LFS,
+		stage == "releases" && !c.Releases,
+		stage == "discussions" && !c.Discussions:
+		return false
+	}
+	return enabled
+}
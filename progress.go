@@ -0,0 +1,276 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress display mode: auto (progress bar when stderr is terminal, plain
+// progress lines otherwise), bar, plain or off
+var progressMode = "auto"
+
+// Interval of plain progress lines and of progress bar redraw
+const (
+	progressInterval    = 30 * time.Second
+	progressBarInterval = 250 * time.Millisecond
+)
+
+// progressDisplay is run progress: repositories done of known total,
+// current repository and its git transfer progress
+type progressDisplay struct {
+	mu        sync.Mutex
+	mode      string // Resolved mode: bar or plain, empty if display is off
+	total     int    // Repositories to backup in listed accounts
+	done      int
+	start     time.Time
+	repo      string // Current repository
+	repoStart time.Time
+	phase     string // Last git progress line of current repository
+	drawn     bool   // Progress bar is drawn on the last terminal line
+	stopped   chan struct{}
+}
+
+// progress is run progress display
+var progress = &progressDisplay{}
+
+// checkProgressMode check progress display mode parameter
+func checkProgressMode() error {
+	switch progressMode {
+	case "auto", "bar", "plain", "off":
+		return nil
+	}
+	return fmt.Errorf("wrong progress mode '%s', should be auto, bar, plain "+
+		"or off", progressMode)
+}
+
+// startProgress start progress display of the run
+func startProgress() {
+	mode := progressMode
+	if mode == "auto" {
+		mode = "plain"
+		if info, err := os.Stderr.Stat(); err == nil &&
+			info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb" {
+			mode = "bar"
+		}
+	}
+	if mode == "off" {
+		return
+	}
+	p := progress
+	p.mu.Lock()
+	p.mode, p.start, p.stopped = mode, time.Now(), make(chan struct{})
+	p.total, p.done = 0, 0
+	p.mu.Unlock()
+	interval := progressInterval
+	if mode == "bar" {
+		interval = progressBarInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopped:
+				return
+			case <-ticker.C:
+			}
+			if mode == "bar" {
+				logMu.Lock()
+				p.draw()
+				logMu.Unlock()
+				continue
+			}
+			if line, ok := p.line(); ok {
+				done, total := p.counts()
+				logInfo("progress: "+line, "done", done, "total", total)
+			}
+		}
+	}()
+}
+
+// stopProgress stop progress display and clear progress bar
+func stopProgress() {
+	p := progress
+	p.mu.Lock()
+	if len(p.mode) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.mode = ""
+	close(p.stopped)
+	p.mu.Unlock()
+	logMu.Lock()
+	p.clear()
+	logMu.Unlock()
+}
+
+// addTotal add number of repositories to backup in listed account
+func (p *progressDisplay) addTotal(n int) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// startRepo set current repository
+func (p *progressDisplay) startRepo(repo string) {
+	p.mu.Lock()
+	p.repo, p.repoStart, p.phase = repo, time.Now(), ""
+	p.mu.Unlock()
+}
+
+// finishRepo count current repository done
+func (p *progressDisplay) finishRepo() {
+	p.mu.Lock()
+	p.done++
+	p.repo, p.phase = "", ""
+	p.mu.Unlock()
+}
+
+// setPhase set git progress line of current repository
+func (p *progressDisplay) setPhase(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.mu.Unlock()
+}
+
+// counts return number of repositories done and total
+func (p *progressDisplay) counts() (done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done, p.total
+}
+
+// line return progress line: repositories done of total, run ETA estimated
+// by average repository backup time, and current repository with git
+// transfer progress: phase, percent, transferred size and rate. Returns false
+// if there is nothing to show
+func (p *progressDisplay) line() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total == 0 {
+		return "", false
+	}
+	current := p.done
+	if len(p.repo) != 0 {
+		current++
+	}
+	line := fmt.Sprintf("%d of %d", current, p.total)
+	if p.done > 0 && p.done < p.total {
+		avg := time.Since(p.start) / time.Duration(p.done)
+		line += fmt.Sprintf(", ETA %s",
+			(avg * time.Duration(p.total-p.done)).Round(time.Second))
+	}
+	if len(p.repo) != 0 {
+		line += ", " + p.repo
+		if len(p.phase) != 0 {
+			line += ": " + p.phase
+		} else {
+			line += fmt.Sprintf(" %s", time.Since(p.repoStart).Round(time.Second))
+		}
+	}
+	return line, true
+}
+
+// draw draw progress bar on the last terminal line, should be called with
+// logMu locked
+func (p *progressDisplay) draw() {
+	line, ok := p.line()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ok || p.mode != "bar" {
+		return
+	}
+	const barWidth = 20
+	filled := barWidth * p.done / p.total
+	bar := "[" + strings.Repeat("=", filled) +
+		strings.Repeat(" ", barWidth-filled) + "] " + line
+	width := 80
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		width = n
+	}
+	if len(bar) >= width {
+		bar = bar[:width-1]
+	}
+	os.Stderr.WriteString("\r\033[K" + bar)
+	p.drawn = true
+}
+
+// clear clear progress bar before log message is written, should be called
+// with logMu locked
+func (p *progressDisplay) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drawn {
+		os.Stderr.WriteString("\r\033[K")
+		p.drawn = false
+	}
+}
+
+// progressWriter is git command output writer: git progress lines, split by
+// carriage returns, are set as current repository phase, and other lines
+// are kept for error message
+type progressWriter struct {
+	line []byte
+	out  bytes.Buffer
+}
+
+func (w *progressWriter) Write(data []byte) (int, error) {
+	for _, c := range data {
+		if c != '\r' && c != '\n' {
+			w.line = append(w.line, c)
+			continue
+		}
+		line := strings.TrimSpace(string(w.line))
+		w.line = w.line[:0]
+		switch {
+		case len(line) == 0:
+		case strings.Contains(line, "objects:") || strings.Contains(line,
+			"deltas:"):
+			progress.setPhase(strings.TrimPrefix(line, "remote: "))
+		default:
+			w.out.WriteString(line + "\n")
+		}
+	}
+	return len(data), nil
+}
+
+// transferRun run git clone or fetch command streaming git progress to
+// progress display, or run command if progress display is off
+func transferRun(name string, args ...string) error {
+	progress.mu.Lock()
+	on := len(progress.mode) != 0
+	progress.mu.Unlock()
+	if !on {
+		return run(name, args...)
+	}
+
+	// Force progress output of clone or fetch command
+	for i, arg := range args {
+		if arg == "clone" || arg == "fetch" {
+			args = append(args[:i+1:i+1], append([]string{"--progress"},
+				args[i+1:]...)...)
+			break
+		}
+	}
+	cmd, cancel := command(name, args...)
+	defer cancel()
+	w := &progressWriter{}
+	cmd.Stdout, cmd.Stderr = w, w
+	err := commandErr(cmd.Run())
+	w.Write([]byte{'\n'})
+	progress.setPhase("")
+	if err != nil {
+		return fmt.Errorf("%s %s: %s\n%s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(w.out.String()))
+	}
+	return nil
+}
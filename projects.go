@@ -0,0 +1,224 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export Projects (v2) flag set by -projects parameter
+var projects bool
+
+// projectsExport is account Projects export written to
+// [host/]owner/projects.json file
+type projectsExport struct {
+	Owner    string      `json:"owner"`
+	Exported time.Time   `json:"exported"`
+	Projects []projectV2 `json:"projects"`
+}
+
+// projectV2 is project with fields, views and items with field values
+type projectV2 struct {
+	ID          string            `json:"id"`
+	Number      int               `json:"number"`
+	Title       string            `json:"title"`
+	Description string            `json:"shortDescription"`
+	Readme      string            `json:"readme"`
+	URL         string            `json:"url"`
+	Public      bool              `json:"public"`
+	Closed      bool              `json:"closed"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	Fields      []json.RawMessage `json:"fields"`
+	Views       []json.RawMessage `json:"views"`
+	Items       []json.RawMessage `json:"items"`
+}
+
+// GraphQL queries fields of projects, fields, views and items
+const (
+	projectFieldName = `... on ProjectV2FieldCommon { name }`
+	projectFields    = `id number title shortDescription readme url public ` +
+		`closed createdAt updatedAt fields(first: 100) { nodes { ` +
+		`... on ProjectV2FieldCommon { id name dataType } ` +
+		`... on ProjectV2SingleSelectField { options { id name color ` +
+		`description } } ... on ProjectV2IterationField { configuration { ` +
+		`duration startDay iterations { id title startDate duration } ` +
+		`completedIterations { id title startDate duration } } } } } ` +
+		`views(first: 100) { nodes { id number name layout filter ` +
+		`fields(first: 100) { nodes { ` + projectFieldName + ` } } ` +
+		`groupByFields(first: 20) { nodes { ` + projectFieldName + ` } } ` +
+		`verticalGroupByFields(first: 20) { nodes { ` + projectFieldName +
+		` } } sortByFields(first: 20) { nodes { direction field { ` +
+		projectFieldName + ` } } } } }`
+	projectValueField = `field { ` + projectFieldName + ` }`
+	projectItemFields = `id type isArchived createdAt updatedAt content { ` +
+		`__typename ... on Issue { number title url repository { ` +
+		`nameWithOwner } } ... on PullRequest { number title url ` +
+		`repository { nameWithOwner } } ... on DraftIssue { title body } } ` +
+		`fieldValues(first: 100) { nodes { __typename ` +
+		`... on ProjectV2ItemFieldTextValue { text ` + projectValueField + ` } ` +
+		`... on ProjectV2ItemFieldNumberValue { number ` + projectValueField +
+		` } ... on ProjectV2ItemFieldDateValue { date ` + projectValueField +
+		` } ... on ProjectV2ItemFieldSingleSelectValue { name optionId ` +
+		projectValueField + ` } ... on ProjectV2ItemFieldIterationValue { ` +
+		`title iterationId startDate duration ` + projectValueField + ` } ` +
+		`... on ProjectV2ItemFieldLabelValue { labels(first: 100) { nodes { ` +
+		`name } } ` + projectValueField + ` } ` +
+		`... on ProjectV2ItemFieldMilestoneValue { milestone { title } ` +
+		projectValueField + ` } ... on ProjectV2ItemFieldUserValue { ` +
+		`users(first: 100) { nodes { login } } ` + projectValueField + ` } ` +
+		`... on ProjectV2ItemFieldRepositoryValue { repository { ` +
+		`nameWithOwner } ` + projectValueField + ` } } }`
+)
+
+// exportProjects save organization or user Projects (v2) with fields, views
+// and items with their field values to the [host/]owner/projects.json file.
+// Returns file path relative to dir folder, or empty name if account has no
+// projects
+func exportProjects(acc account, dir string) (name string, err error) {
+	org, err := isOrg(acc)
+	if err != nil {
+		return
+	}
+	owner := "user"
+	if org {
+		owner = "organization"
+	}
+	api := newAPIClient(acc.endpoint)
+	export := projectsExport{Owner: acc.String(), Exported: time.Now().UTC()}
+	var cursor interface{}
+	for {
+		var data map[string]struct {
+			Projects struct {
+				PageInfo graphqlPageInfo   `json:"pageInfo"`
+				Nodes    []json.RawMessage `json:"nodes"`
+			} `json:"projectsV2"`
+		}
+		err = api.graphql(`query($login: String!, $cursor: String) { `+owner+
+			`(login: $login) { projectsV2(first: 10, after: $cursor) { `+
+			`pageInfo { hasNextPage endCursor } nodes { `+projectFields+
+			` } } } }`, map[string]interface{}{"login": acc.Name,
+			"cursor": cursor}, &data)
+		if err != nil {
+			return
+		}
+		page := data[owner].Projects
+		for _, node := range page.Nodes {
+			var p projectV2
+			if p, err = newProject(node); err != nil {
+				return
+			}
+			if p.Items, err = projectItems(api, p.ID); err != nil {
+				return
+			}
+			export.Projects = append(export.Projects, p)
+		}
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		cursor = page.PageInfo.EndCursor
+	}
+	if len(export.Projects) == 0 {
+		return
+	}
+
+	name = snapshotPath(acc.path(acc.Name + "/projects.json"))
+	err = writeJSON(filepath.Join(dir, name), export)
+	return
+}
+
+// newProject return project of GraphQL project node with fields and views
+// lists unwrapped from connections
+func newProject(node json.RawMessage) (p projectV2, err error) {
+	var conn struct {
+		projectV2
+		Fields struct {
+			Nodes []json.RawMessage `json:"nodes"`
+		} `json:"fields"`
+		Views struct {
+			Nodes []json.RawMessage `json:"nodes"`
+		} `json:"views"`
+	}
+	if err = json.Unmarshal(node, &conn); err != nil {
+		return
+	}
+	p = conn.projectV2
+	p.Fields, p.Views = conn.Fields.Nodes, conn.Views.Nodes
+	p.Items = []json.RawMessage{}
+	return
+}
+
+// projectItems return all items of project with their field values
+func projectItems(api *apiClient, id string) (items []json.RawMessage,
+	err error) {
+
+	items = []json.RawMessage{}
+	var cursor interface{}
+	for {
+		var data struct {
+			Node struct {
+				Items struct {
+					PageInfo graphqlPageInfo   `json:"pageInfo"`
+					Nodes    []json.RawMessage `json:"nodes"`
+				} `json:"items"`
+			} `json:"node"`
+		}
+		err = api.graphql(`query($id: ID!, $cursor: String) { node(id: $id) `+
+			`{ ... on ProjectV2 { items(first: 100, after: $cursor) { `+
+			`pageInfo { hasNextPage endCursor } nodes { `+projectItemFields+
+			` } } } } }`, map[string]interface{}{"id": id, "cursor": cursor},
+			&data)
+		if err != nil {
+			return
+		}
+		items = append(items, data.Node.Items.Nodes...)
+		if !data.Node.Items.PageInfo.HasNextPage {
+			return
+		}
+		cursor = data.Node.Items.PageInfo.EndCursor
+	}
+}
+
+// projectsStage save references of Projects (v2) linked to repository to
+// owner/repo.projects.json file: owner, number, title and url. The projects
+// data is exported with projects of their owner account
+func projectsStage(j *pipelineJob) error {
+	owner, name, _ := strings.Cut(j.repo, "/")
+	var data struct {
+		Repository struct {
+			Projects struct {
+				Nodes []struct {
+					Owner struct {
+						Login string `json:"login"`
+					} `json:"owner"`
+					Number int    `json:"number"`
+					Title  string `json:"title"`
+					URL    string `json:"url"`
+				} `json:"nodes"`
+			} `json:"projectsV2"`
+		} `json:"repository"`
+	}
+	err := newAPIClient(j.acc.endpoint).graphql(`query($owner: String!, `+
+		`$name: String!) { repository(owner: $owner, name: $name) { `+
+		`projectsV2(first: 100) { nodes { owner { ... on Organization `+
+		`{ login } ... on User { login } } number title url } } } }`,
+		map[string]interface{}{"owner": owner, "name": name}, &data)
+	if err != nil {
+		return err
+	}
+	list := data.Repository.Projects.Nodes
+	if len(list) == 0 {
+		return nil
+	}
+	file := j.path + ".projects.json"
+	if err := writeJSON(filepath.Join(j.dir, file), list); err != nil {
+		return err
+	}
+	j.addPrivate(file)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prune local mirrors flag set by -prune-local parameter
+var pruneLocal bool
+
+// Quarantine parameters: move pruned mirrors to deleted/YYYY-MM-DD folder
+// instead of removing, and number of days to keep quarantined mirrors (0 -
+// keep forever)
+var quarantine bool
+var quarantineDays int
+
+// quarantineDir is folder in output folder with quarantined mirrors
+const quarantineDir = "deleted"
+
+// Repositories listed upstream in this run by path relative to the output
+// folder, and accounts which listing may be incomplete
+var listed = map[string]bool{}
+var listIncomplete = map[string]bool{}
+
+// addListed add listed repositories of account
+func addListed(acc account, repos []string, complete bool) {
+	for _, repo := range repos {
+		listed[acc.path(repo)] = true
+	}
+	if !complete {
+		listIncomplete[acc.String()] = true
+	}
+}
+
+// staleMirrors return mirrors (paths relative to the output folder) of
+// accounts repositories which were not listed upstream in this run. Accounts
+// with incomplete listing are skipped
+func staleMirrors(output string, accounts []account) (stale []string) {
+	for _, acc := range accounts {
+		if listIncomplete[acc.String()] {
+			logWarn(fmt.Sprintf("prune: listing of %s may be incomplete, "+
+				"skipped", acc), "user", acc.Name)
+			continue
+		}
+		owner := acc.path(acc.Name)
+		mirrors, err := filepath.Glob(filepath.Join(output, owner, "*.git"))
+		if err != nil {
+			continue
+		}
+		for _, mirror := range mirrors {
+			if info, err := os.Stat(mirror); err != nil || !info.IsDir() {
+				continue
+			}
+			name := strings.TrimSuffix(filepath.Base(mirror), ".git")
+			name = strings.TrimSuffix(name, ".wiki")
+			if _, blocked := state.Blocked[owner+"/"+name]; blocked {
+				continue
+			}
+			if !listed[owner+"/"+name] {
+				stale = append(stale, owner+"/"+filepath.Base(mirror))
+			}
+		}
+	}
+	return
+}
+
+// pruneMirrors remove or quarantine local mirrors of accounts repositories
+// which no longer exist upstream. Stale mirrors are only printed if printonly
+// is set
+func pruneMirrors(output string, accounts []account, printonly bool) {
+	date := time.Now().Format("2006-01-02")
+	for _, path := range staleMirrors(output, accounts) {
+		switch {
+		case printonly:
+			logInfo("prune: stale mirror "+path, "path", path)
+		case quarantine:
+			to := filepath.Join(output, quarantineDir, date, path)
+			logInfo(fmt.Sprintf("prune: quarantine stale mirror %s to %s", path,
+				to), "path", path)
+			err := os.MkdirAll(filepath.Dir(to), 0755)
+			if err == nil {
+				if _, serr := os.Stat(to); serr == nil {
+					// The same mirror is quarantined today already
+					to += "." + time.Now().Format("150405")
+				}
+				err = os.Rename(filepath.Join(output, path), to)
+			}
+			if err != nil {
+				logError("prune: quarantine stale mirror", "path", path,
+					"error", err)
+			}
+		default:
+			logInfo("prune: remove stale mirror "+path, "path", path)
+			if err := os.RemoveAll(filepath.Join(output, path)); err != nil {
+				logError("prune: remove stale mirror", "path", path, "error", err)
+			}
+		}
+	}
+}
+
+// pruneQuarantine remove quarantined mirrors older than quarantineDays
+func pruneQuarantine(output string) error {
+	if quarantineDays <= 0 {
+		return nil
+	}
+	dir := filepath.Join(output, quarantineDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	expire := time.Now().AddDate(0, 0, -quarantineDays)
+	for _, e := range entries {
+		t, err := time.ParseInLocation("2006-01-02", e.Name(), time.Local)
+		if err != nil || !t.Before(expire) {
+			continue
+		}
+		logInfo("prune: remove expired quarantine "+e.Name(), "date", e.Name())
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
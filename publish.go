@@ -0,0 +1,135 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// publicRepo is repository metadata published in public mirror mode. It
+// contains only public fields of github repository, all other fields of the
+// github api response are stripped
+type publicRepo struct {
+	FullName      string   `json:"full_name"`
+	Description   string   `json:"description"`
+	Homepage      string   `json:"homepage"`
+	HTMLURL       string   `json:"html_url"`
+	DefaultBranch string   `json:"default_branch"`
+	Language      string   `json:"language"`
+	Topics        []string `json:"topics"`
+	Fork          bool     `json:"fork"`
+	Archived      bool     `json:"archived"`
+	PushedAt      string   `json:"pushed_at"`
+	Wiki          bool     `json:"wiki"`
+	License       *struct {
+		SpdxID string `json:"spdx_id"`
+		Name   string `json:"name"`
+	} `json:"license"`
+}
+
+// published contains metadata of repositories published in public mirror
+// mode during this run
+var published []publicRepo
+
+// getPublicRepo get repository metadata from github api. Returns false if the
+// repository is not public
+func getPublicRepo(acc account, repo string) (meta publicRepo, ok bool,
+	err error) {
+
+	var data struct {
+		publicRepo
+		Private    bool   `json:"private"`
+		Visibility string `json:"visibility"`
+	}
+	err = newAPIClient(acc.endpoint).get("/repos/"+repo, &data)
+	if err != nil || data.Private || data.Visibility != "public" {
+		return
+	}
+	return data.publicRepo, true, nil
+}
+
+// publishRepo prepare local mirrors to be served by dumb http protocol from
+// static site and add repository metadata to the published list
+func publishRepo(dir string, paths []string, meta publicRepo) error {
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".git") {
+			continue
+		}
+		err := run("git", "-C", filepath.Join(dir, path), "update-server-info")
+		if err != nil {
+			return err
+		}
+	}
+	published = append(published, meta)
+	return nil
+}
+
+// publishIndex render metadata of published repositories to the index.html
+// and repos.json files in the output folder and copy it to destinations
+func publishIndex(output string) (err error) {
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].FullName < published[j].FullName
+	})
+
+	// Write repos.json
+	data, err := json.MarshalIndent(published, "", "  ")
+	if err != nil {
+		return
+	}
+	jsonFile := filepath.Join(output, "repos.json")
+	if err = os.WriteFile(jsonFile, data, 0644); err != nil {
+		return
+	}
+
+	// Write index.html
+	htmlFile := filepath.Join(output, "index.html")
+	f, err := os.Create(htmlFile)
+	if err != nil {
+		return
+	}
+	if err = indexTemplate.Execute(f, published); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	// Copy to destinations
+	return putDests(output, []string{"repos.json", "index.html"})
+}
+
+// indexTemplate is public mirror index page template
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Repositories mirror</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 0.3em 1em; text-align: left; vertical-align: top; }
+code { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>Repositories mirror</h1>
+<p>Clone repositories with: <code>git clone &lt;this-site-url&gt;/owner/repo.git</code></p>
+<table>
+<tr><th>Repository</th><th>Description</th><th>License</th><th>Clone</th></tr>
+{{range .}}<tr>
+<td><a href="{{.HTMLURL}}">{{.FullName}}</a>{{if .Archived}} (archived){{end}}{{if .Fork}} (fork){{end}}</td>
+<td>{{.Description}}{{if .Homepage}} <a href="{{.Homepage}}">{{.Homepage}}</a>{{end}}</td>
+<td>{{with .License}}{{.SpdxID}}{{end}}</td>
+<td><a href="{{.FullName}}.git/">{{.FullName}}.git</a>{{if .Wiki}}<br><a href="{{.FullName}}.wiki.git/">{{.FullName}}.wiki.git</a>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,112 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// catalogQueries is 'query' command queries: description of arguments and
+// function returning SQL query from arguments
+var catalogQueries = map[string]struct {
+	usage string
+	query func(args []string) (string, error)
+}{
+	"stale": {"stale <days> - repositories which HEAD is not changed in days",
+		func(args []string) (string, error) {
+			days, err := queryInt(args, 30)
+			return fmt.Sprintf(`WITH last AS (
+	SELECT repo, head, max(started) AS last_backup FROM repos
+	WHERE status = 'success' GROUP BY repo),
+changed AS (
+	SELECT r.repo, min(r.started) AS head_since FROM repos r
+	JOIN last l ON r.repo = l.repo AND r.head = l.head
+	WHERE r.status = 'success' GROUP BY r.repo)
+SELECT l.repo, l.head, c.head_since, l.last_backup FROM last l
+JOIN changed c ON c.repo = l.repo
+WHERE c.head_since < strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', 'now', '-%d days')
+ORDER BY c.head_since;`, days), err
+		}},
+	"failed": {"failed - repositories failed in the last run",
+		func(args []string) (string, error) {
+			return `SELECT repo, started, error FROM repos
+WHERE run_id = (SELECT max(id) FROM runs) AND status = 'failed'
+ORDER BY repo;`, nil
+		}},
+	"largest": {"largest <n> - largest repositories by last backup size",
+		func(args []string) (string, error) {
+			n, err := queryInt(args, 10)
+			return fmt.Sprintf(`SELECT repo, size, max(started) AS last_backup
+FROM repos WHERE status = 'success' GROUP BY repo
+ORDER BY size DESC LIMIT %d;`, n), err
+		}},
+	"history": {"history <[host/]owner/repo> - all backups of repository",
+		func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("repository name is required")
+			}
+			return fmt.Sprintf(`SELECT started, duration, head, size, status,
+error FROM repos WHERE repo = %s ORDER BY started;`, sqlQuote(args[0])), nil
+		}},
+}
+
+// queryInt return integer query argument or default value if argument is
+// not set
+func queryInt(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("wrong number '%s'", args[0])
+	}
+	return n, nil
+}
+
+// queryCmd is 'query' command: query backup catalog and print result as
+// table or json
+func queryCmd(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	catalog := fs.String("catalog", "catalog.db", "SQLite catalog database file")
+	jsonOut := fs.Bool("json", false, "print result in json format")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup query [-catalog file] [-json] <query> [args]")
+		fmt.Fprintln(fs.Output(), "Queries:")
+		for _, name := range []string{"stale", "failed", "largest", "history"} {
+			fmt.Fprintln(fs.Output(), "  "+catalogQueries[name].usage)
+		}
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	q, ok := catalogQueries[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*catalog); err != nil {
+		logFatal(err)
+	}
+
+	query, err := q.query(fs.Args()[1:])
+	if err != nil {
+		logFatal(err)
+	}
+	mode := []string{"-header", "-column"}
+	if *jsonOut {
+		mode = []string{"-json"}
+	}
+	out, err := sqlite(*catalog, query, mode...)
+	if err != nil {
+		logFatal(err)
+	}
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// apiRateLimit is github api rate limit state of api client got from
+// X-RateLimit-* response headers
+type apiRateLimit struct {
+	mu        sync.Mutex
+	limit     int       // Requests per hour
+	remaining int       // Remaining requests, -1 if unknown
+	reset     time.Time // Time when the limit is reset
+	pacing    bool      // Requests are paced
+}
+
+// Part of rate limit from which requests are paced to stay under the limit
+const ratePaceFraction = 10
+
+// do execute api request with rate limit awareness: requests are paced when
+// few requests remain before the limit reset, and when the limit is
+// exhausted the request waits for the reset and is repeated
+func (c *apiClient) do(req *http.Request) (*http.Response, error) {
+	for {
+		c.rate.pace()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		wait, exhausted := c.rate.update(resp)
+		if !exhausted {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		logWarn(fmt.Sprintf("api rate limit of %s exhausted, waiting %s "+
+			"until reset", c.Host, wait.Round(time.Second)), "host", c.Host,
+			"wait", wait)
+		time.Sleep(wait)
+	}
+}
+
+// pace wait before request to spread remaining requests until the limit
+// reset
+func (r *apiRateLimit) pace() {
+	r.mu.Lock()
+	if r.limit == 0 || r.remaining > r.limit/ratePaceFraction {
+		r.pacing = false
+		r.mu.Unlock()
+		return
+	}
+	untilReset := time.Until(r.reset)
+	if untilReset <= 0 {
+		r.mu.Unlock()
+		return
+	}
+	delay := untilReset / time.Duration(r.remaining+1)
+	if !r.pacing {
+		r.pacing = true
+		logInfo(fmt.Sprintf("api rate limit: %d requests remaining until %s, "+
+			"pacing requests every %s", r.remaining, r.reset.Format("15:04:05"),
+			delay.Round(time.Millisecond)), "remaining", r.remaining,
+			"delay", delay)
+	}
+	if r.remaining > 0 {
+		r.remaining--
+	}
+	r.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// update rate limit state from response headers and return wait duration if
+// the rate limit is exhausted: primary limit with 403 or 429 status and no
+// remaining requests, or secondary limit with Retry-After header
+func (r *apiRateLimit) update(resp *http.Response) (wait time.Duration,
+	exhausted bool) {
+
+	h := resp.Header
+	limit, err1 := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 == nil && err2 == nil && err3 == nil {
+		r.mu.Lock()
+		r.limit, r.remaining = limit, remaining
+		r.reset = time.Unix(reset, 0)
+		r.mu.Unlock()
+	}
+
+	if resp.StatusCode != http.StatusForbidden &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if after, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		return time.Duration(after) * time.Second, true
+	}
+	if err2 == nil && err3 == nil && remaining == 0 {
+		wait = time.Until(time.Unix(reset, 0)) + time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return wait, true
+	}
+	return
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Refs patterns of mirrors set by -refs parameter, all refs if empty
+var refPatterns []string
+
+// parseRefs parse comma or space separated list of refs patterns. The pattern
+// is ref name or ref name with one '*', patterns prefixed with '^' exclude
+// refs: ^refs/pull/* exclude pull requests refs, refs/heads/*,refs/tags/*
+// include branches and tags only
+func parseRefs(list string) (patterns []string, err error) {
+	patterns = strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	for _, p := range patterns {
+		name := strings.TrimPrefix(p, "^")
+		if !strings.HasPrefix(name, "refs/") || strings.Count(name, "*") > 1 {
+			return nil, fmt.Errorf("wrong refs pattern '%s'", p)
+		}
+	}
+	return
+}
+
+// refspecs return mirror fetch refspecs of refs patterns
+func refspecs(patterns []string) (specs []string) {
+	include := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "^") {
+			specs = append(specs, p)
+			continue
+		}
+		specs = append(specs, "+"+p+":"+p)
+		include = true
+	}
+	if !include {
+		specs = append([]string{"+refs/*:refs/*"}, specs...)
+	}
+	return
+}
+
+// matchRef return true if ref is included by refs patterns
+func matchRef(patterns []string, ref string) bool {
+	match := func(p string) bool {
+		prefix, suffix, glob := strings.Cut(p, "*")
+		if !glob {
+			return p == ref
+		}
+		return len(ref) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(ref, prefix) && strings.HasSuffix(ref, suffix)
+	}
+	included := true
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "^") {
+			included = false
+			break
+		}
+	}
+	for _, p := range patterns {
+		if exclude := strings.TrimPrefix(p, "^"); exclude != p {
+			if match(exclude) {
+				return false
+			}
+		} else if match(p) {
+			included = true
+		}
+	}
+	return included
+}
+
+// filterRefs set refs patterns as mirror fetch refspecs, fetch refs included
+// by the patterns, and remove refs not included and unreachable objects
+func filterRefs(mirror string, patterns []string) error {
+	if err := setRefspecs(mirror, patterns); err != nil {
+		return err
+	}
+	args := append([]string{"-C", mirror, "fetch", "-q", "--prune"},
+		shallowArgs()...)
+	if err := transferRun("git", append(args, "origin")...); err != nil {
+		return err
+	}
+
+	out, err := exec.Command("git", "-C", mirror, "for-each-ref",
+		"--format=%(refname)").Output()
+	if err != nil {
+		return err
+	}
+	var del bytes.Buffer
+	for _, ref := range strings.Fields(string(out)) {
+		if !matchRef(patterns, ref) {
+			fmt.Fprintf(&del, "delete %s\n", ref)
+		}
+	}
+	if del.Len() != 0 {
+		cmd := exec.Command("git", "-C", mirror, "update-ref", "--stdin")
+		cmd.Stdin = &del
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git update-ref: %s\n%s", err, out)
+		}
+	}
+	if del.Len() == 0 {
+		return nil
+	}
+	return run("git", "-C", mirror, "gc", "-q", "--prune=now")
+}
+
+// setRefspecs set mirror origin fetch refspecs of refs patterns. Tags are
+// fetched only if they are included by the refspecs
+func setRefspecs(mirror string, patterns []string) error {
+	exec.Command("git", "-C", mirror, "config", "--unset-all",
+		"remote.origin.fetch").Run()
+	if err := run("git", "-C", mirror, "config", "remote.origin.tagOpt",
+		"--no-tags"); err != nil {
+		return err
+	}
+	for _, spec := range refspecs(patterns) {
+		if err := run("git", "-C", mirror, "config", "--add",
+			"remote.origin.fetch", spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
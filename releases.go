@@ -0,0 +1,248 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup release assets flag
+var releaseAssets bool
+
+// Release assets changed upstream after their first backup in this run
+var changedAssets []string
+
+// assetsName is release assets manifest file name in repository releases
+// folder owner/repo.releases
+const assetsName = "assets.json"
+
+// releaseAsset is backed up release asset recorded in assets manifest
+type releaseAsset struct {
+	ID         int64         `json:"id"`
+	Release    string        `json:"release"` // Release tag
+	File       string        `json:"file"`    // File relative to releases folder
+	Size       int64         `json:"size"`
+	SHA256     string        `json:"sha256"`
+	Digest     string        `json:"upstream_digest,omitempty"` // Digest reported by github
+	Updated    time.Time     `json:"updated_at"`
+	Downloaded time.Time     `json:"downloaded"`
+	Changed    []assetChange `json:"changed,omitempty"`
+}
+
+// assetChange is previous content of release asset changed upstream after
+// publication. The previous content is kept in file
+type assetChange struct {
+	Detected time.Time `json:"detected"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	File     string    `json:"file"`
+}
+
+// upstreamAsset is release asset in github api response
+type upstreamAsset struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	Digest  string    `json:"digest"`
+	Updated time.Time `json:"updated_at"`
+}
+
+// releasesStage backup release assets to owner/repo.releases/tag/name files.
+// Downloads are verified against sizes and digests reported by github, and
+// sizes and SHA-256 digests are recorded in assets.json manifest. Assets not
+// changed upstream are not downloaded again. Assets which content changed
+// after previous backup are flagged: changed upstream release asset is a
+// supply-chain red flag. The previous content is kept next to the new one
+func releasesStage(j *pipelineJob) error {
+	folder := j.path + ".releases"
+	dir := filepath.Join(j.dir, filepath.FromSlash(folder))
+	known := map[int64]releaseAsset{}
+	if list, err := readAssets(dir); err == nil {
+		for _, a := range list {
+			known[a.ID] = a
+		}
+	}
+
+	c := newAPIClient(j.acc.endpoint)
+	releases, err := apiList(c, "/repos/"+j.repo+"/releases?per_page=100")
+	if err != nil {
+		return err
+	}
+	var assets []releaseAsset
+	var failed []string
+	for _, data := range releases {
+		var release struct {
+			TagName string          `json:"tag_name"`
+			ID      int64           `json:"id"`
+			Assets  []upstreamAsset `json:"assets"`
+		}
+		if json.Unmarshal(data, &release) != nil {
+			continue
+		}
+		tag := release.TagName
+		if len(tag) == 0 {
+			tag = fmt.Sprint(release.ID)
+		}
+		for _, u := range release.Assets {
+			a, err := backupAsset(c, dir, tag, u, known)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s/%s: %s", tag, u.Name,
+					err))
+				if prev, ok := known[u.ID]; ok {
+					assets = append(assets, prev)
+				}
+				continue
+			}
+			if n := len(a.Changed); n != 0 && a.Changed[n-1].Detected.After(runStart) {
+				msg := fmt.Sprintf("%s: release asset %s changed upstream after "+
+					"publication: size %d sha256 %s, was size %d sha256 %s",
+					j.repo, a.File, a.Size, a.SHA256, a.Changed[n-1].Size,
+					a.Changed[n-1].SHA256)
+				logWarn(msg, append(repoFields(j.repo), "asset", a.File)...)
+				changedAssets = append(changedAssets, msg)
+			}
+			assets = append(assets, a)
+		}
+	}
+	if len(assets) != 0 {
+		if err := writeAssets(dir, assets); err != nil {
+			return err
+		}
+		j.paths = append(j.paths, folder)
+		j.files = j.paths
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d release assets failed:\n%s", len(failed),
+			strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// backupAsset download release asset if it is new or changed upstream, and
+// verify download against upstream size and digest
+func backupAsset(c *apiClient, dir, tag string, u upstreamAsset,
+	known map[int64]releaseAsset) (a releaseAsset, err error) {
+
+	prev, ok := known[u.ID]
+	file := filepath.Base(tag) + "/" + filepath.Base(u.Name)
+	name := filepath.Join(dir, filepath.FromSlash(file))
+	if _, serr := os.Stat(name); ok && serr == nil && prev.File == file &&
+		prev.Size == u.Size && prev.Updated.Equal(u.Updated) &&
+		(len(u.Digest) == 0 || u.Digest == "sha256:"+prev.SHA256) {
+		return prev, nil
+	}
+
+	if err = c.download(u.URL, name+".new"); err != nil {
+		return
+	}
+	defer os.Remove(name + ".new")
+	sum, err := verifyAsset(name+".new", u.Size, u.Digest)
+	if err != nil {
+		return
+	}
+	a = releaseAsset{ID: u.ID, Release: tag, File: file, Size: u.Size,
+		SHA256: sum, Digest: u.Digest, Updated: u.Updated,
+		Downloaded: time.Now().UTC()}
+	if ok {
+		a.Changed = prev.Changed
+		if prev.SHA256 == sum {
+			a.Downloaded = prev.Downloaded
+		} else {
+			// Keep previous content as evidence
+			change := assetChange{Detected: time.Now().UTC(), Size: prev.Size,
+				SHA256: prev.SHA256, File: prev.File + "." + prev.SHA256[:12]}
+			prevName := filepath.Join(dir, filepath.FromSlash(prev.File))
+			if os.Rename(prevName, filepath.Join(dir,
+				filepath.FromSlash(change.File))) != nil {
+				change.File = ""
+			}
+			a.Changed = append(a.Changed, change)
+		}
+	}
+	err = os.Rename(name+".new", name)
+	return
+}
+
+// verifyAsset check downloaded release asset size and digest reported by
+// github and return its SHA-256 digest
+func verifyAsset(name string, size int64, digest string) (sum string,
+	err error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	if info.Size() != size {
+		return "", fmt.Errorf("size %d doesn't match upstream size %d",
+			info.Size(), size)
+	}
+	if sum, err = fileSHA256(name); err != nil {
+		return
+	}
+	if algo, want, ok := strings.Cut(digest, ":"); ok && algo == "sha256" &&
+		want != sum {
+		return "", fmt.Errorf("sha256 %s doesn't match digest %s",
+			sum, want)
+	}
+	return
+}
+
+// readAssets read release assets manifest of releases folder
+func readAssets(dir string) (assets []releaseAsset, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, assetsName))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &assets)
+	return
+}
+
+// writeAssets write release assets manifest to releases folder
+func writeAssets(dir string, assets []releaseAsset) error {
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].File < assets[j].File
+	})
+	data, err := json.MarshalIndent(assets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, assetsName), append(data, '\n'),
+		0644)
+}
+
+// verifyAssets re-verify release assets of releases folders in output folder
+// against sizes and digests recorded in assets manifests and return number
+// of verified assets and errors of corrupted ones
+func verifyAssets(output string) (n int, errs []string) {
+	var dirs []string
+	filepath.Walk(output, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && strings.HasSuffix(path, ".releases") {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	for _, dir := range dirs {
+		assets, err := readAssets(dir)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", dir, err))
+			continue
+		}
+		for _, a := range assets {
+			n++
+			name := filepath.Join(dir, filepath.FromSlash(a.File))
+			if _, err := verifyAsset(name, a.Size, "sha256:"+a.SHA256); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+	return
+}
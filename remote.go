@@ -0,0 +1,110 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kirill-scherba/github-backup/client"
+)
+
+// remoteCmd is 'remote' command: control central backup server started
+// with 'server' command over its api: show status, trigger runs, list runs
+// and fetch runs logs and reports
+func remoteCmd(args []string) {
+	fs := flag.NewFlagSet("remote", flag.ExitOnError)
+	url := fs.String("url", os.Getenv("GITHUB_BACKUP_SERVER"), "backup server url, default: GITHUB_BACKUP_SERVER environment variable")
+	token := fs.String("token", os.Getenv("GITHUB_BACKUP_API_TOKEN"), "backup server api token, default: GITHUB_BACKUP_API_TOKEN environment variable")
+	usage := func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup remote [-url url] [-token token] status | runs |\n"+
+			"  run [-users list] [-limit list] [-wait] | show id | log id | report id | manifest id")
+		fs.PrintDefaults()
+	}
+	fs.Usage = usage
+	fs.Parse(args)
+	if len(*url) == 0 || fs.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c := client.New(*url, *token)
+	ctx := context.Background()
+	verb, args := fs.Arg(0), fs.Args()[1:]
+	id := func() string {
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		return args[0]
+	}
+	var v interface{}
+	var err error
+	switch verb {
+	case "status":
+		v, err = c.Status(ctx)
+	case "runs":
+		var runs []client.Run
+		if runs, err = c.Runs(ctx); err == nil {
+			for _, r := range runs {
+				printRun(r)
+			}
+			return
+		}
+	case "run":
+		rfs := flag.NewFlagSet("remote run", flag.ExitOnError)
+		users := rfs.String("users", "", "users or organisations overriding server -users parameter")
+		limit := rfs.String("limit", "", "repositories overriding server -limit parameter")
+		wait := rfs.Bool("wait", false, "wait until the run finishes, exit code is 1 if the run failed")
+		rfs.Parse(args)
+		var r client.Run
+		r, err = c.Trigger(ctx, client.TriggerOptions{Users: *users, Limit: *limit})
+		if err == nil && *wait {
+			logInfo(fmt.Sprintf("run %s started, waiting", r.ID), "run", r.ID)
+			r, err = c.Wait(ctx, r.ID, 10*time.Second)
+		}
+		if err == nil {
+			printRun(r)
+			if r.Status == client.StatusFailed {
+				os.Exit(1)
+			}
+			return
+		}
+	case "show":
+		v, err = c.Run(ctx, id())
+	case "log":
+		var out string
+		if out, err = c.Log(ctx, id()); err == nil {
+			fmt.Print(out)
+			return
+		}
+	case "report":
+		v, err = c.Report(ctx, id())
+	case "manifest":
+		v, err = c.Manifest(ctx, id())
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logFatal(err)
+	}
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+// printRun print run line: id, status, exit code, start time and duration
+func printRun(r client.Run) {
+	duration := "-"
+	if !r.End.IsZero() {
+		duration = r.End.Sub(r.Start).Round(time.Second).String()
+	}
+	fmt.Printf("%s  %-8s %3d  %s  %s\n", r.ID, r.Status, r.ExitCode,
+		r.Start.Local().Format("2006-01-02 15:04:05"), duration)
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Run report json file name, empty if report is not written
+var reportFile string
+
+// Comma separated list of urls to post run report to when run finishes
+var reportWebhooks string
+
+// runReport is end-of-run json report: run totals, bytes transferred and
+// status and timing of each repository
+type runReport struct {
+	Tool     string       `json:"tool"`
+	Host     string       `json:"host"`
+	Start    time.Time    `json:"start"`
+	End      time.Time    `json:"end"`
+	Duration float64      `json:"duration"` // Run duration in seconds
+	Status   string       `json:"status"`   // success, failed, aborted
+	Aborted  string       `json:"aborted,omitempty"`
+	Totals   reportTotals `json:"totals"`
+	Bytes    int64        `json:"bytes"` // Bytes of new objects fetched to mirrors
+	Repos    []reportRepo `json:"repos"`
+}
+
+// reportTotals is numbers of repositories by result
+type reportTotals struct {
+	Repos   int `json:"repos"`
+	Cloned  int `json:"cloned"`  // New mirrors cloned
+	Updated int `json:"updated"` // Existing mirrors updated
+	Skipped int `json:"skipped"` // Completed by interrupted run
+	Failed  int `json:"failed"`
+	Blocked int `json:"blocked"` // Blocked by github, last good mirror kept
+}
+
+// reportRepo is repository entry of run report
+type reportRepo struct {
+	Repo     string    `json:"repo"`
+	Account  string    `json:"account"`
+	Status   string    `json:"status"` // cloned, updated, skipped, failed, blocked
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // Backup duration in seconds
+	Bytes    int64     `json:"bytes"`
+	Size     int64     `json:"size"`
+	Head     string    `json:"head,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// repoStatus return run report status of repository result
+func repoStatus(r *repoResult) string {
+	_, skipped := completedRepo(r.Path)
+	switch {
+	case len(r.Blocked) != 0:
+		return "blocked"
+	case r.Err != nil:
+		return "failed"
+	case skipped:
+		return "skipped"
+	case r.Cloned:
+		return "cloned"
+	}
+	return "updated"
+}
+
+// newRunReport return run report of repositories results
+func newRunReport() runReport {
+	end := time.Now()
+	report := runReport{
+		Tool:     userAgent(),
+		Host:     hostname(),
+		Start:    runStart.UTC(),
+		End:      end.UTC(),
+		Duration: end.Sub(runStart).Seconds(),
+		Status:   "success",
+		Aborted:  abortReason,
+		Repos:    []reportRepo{},
+	}
+	for i := range results {
+		r := &results[i]
+		e := reportRepo{
+			Repo:     r.Path,
+			Account:  r.Account,
+			Status:   repoStatus(r),
+			Start:    r.Start.UTC(),
+			Duration: r.Duration.Seconds(),
+			Bytes:    r.Fetched,
+			Size:     r.Size,
+			Head:     r.Tip,
+		}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		switch e.Status {
+		case "cloned":
+			report.Totals.Cloned++
+		case "updated":
+			report.Totals.Updated++
+		case "skipped":
+			report.Totals.Skipped++
+		case "failed":
+			report.Totals.Failed++
+		case "blocked":
+			report.Totals.Blocked++
+		}
+		if e.Status != "skipped" {
+			report.Bytes += r.Fetched
+		}
+		report.Repos = append(report.Repos, e)
+	}
+	report.Totals.Repos = len(report.Repos)
+	switch {
+	case len(abortReason) != 0:
+		report.Status = "aborted"
+	case report.Totals.Failed > 0:
+		report.Status = "failed"
+	}
+	return report
+}
+
+// writeReport write run report json file
+func writeReport(filename string) error {
+	data, err := json.MarshalIndent(newRunReport(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeReportFile(filename, append(data, '\n'))
+}
+
+// postReport post run report json to each of comma separated webhook urls.
+// The body is signed with HMAC-SHA256 of GITHUB_BACKUP_WEBHOOK_SECRET
+// environment variable in X-Hub-Signature-256 header sha256=<hex>, the same
+// as github signs its webhooks, so receivers may validate it the same way
+func postReport(list string) (err error) {
+	data, err := json.Marshal(newRunReport())
+	if err != nil {
+		return err
+	}
+	var signature string
+	if secret := os.Getenv("GITHUB_BACKUP_WEBHOOK_SECRET"); len(secret) != 0 {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(data)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, url := range strings.Split(list, ",") {
+		url = strings.TrimSpace(url)
+		if len(url) == 0 {
+			continue
+		}
+		req, e := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		if e != nil {
+			err = e
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent())
+		req.Header.Set("X-Github-Backup-Event", "run")
+		if len(signature) != 0 {
+			req.Header.Set("X-Hub-Signature-256", signature)
+		}
+		resp, e := client.Do(req)
+		if e != nil {
+			err = e
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("POST %s: %s\n%s", url, resp.Status, body)
+		}
+	}
+	return
+}
+
+// writeReportFile write report file, creating its folder
+func writeReportFile(filename string, data []byte) error {
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filename, data, 0644)
+}
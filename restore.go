@@ -0,0 +1,334 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Default description of mirror created by git, not restored
+const gitDefaultDescription = "Unnamed repository;"
+
+// restoreRepo is local mirror to restore and its settings
+type restoreRepo struct {
+	mirror      string // Mirror folder
+	path        string // Repository path in backup: [host/]owner/repo
+	name        string // Repository name
+	wiki        string // Wiki mirror folder, empty if wiki is not backed up
+	description string
+	homepage    string
+	topics      []string
+	visibility  string // public, private or internal
+	archived    bool
+	settings    *repoMetadata // Settings of metadata file, nil if not saved
+}
+
+// restoreCmd is 'restore' command: recreate repositories of local mirrors
+// under destination owner with github api (name, visibility, description,
+// homepage and topics) and push mirrors branches and tags to them, so
+// disaster recovery is one command instead of manual per-repo work
+func restoreCmd(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	to := fs.String("to", "", "[host/]owner (user or organisation) to restore repositories to")
+	limit := fs.String("limit", "", "comma separated list of repositories ([host/]owner/repo or repo name) to restore, all mirrors by default")
+	metadata := fs.Bool("metadata", false, "restore exported labels, milestones, issues, comments and releases with assets too")
+	dryRun := fs.Bool("dry-run", false, "print repositories to restore but does not change anything")
+	force := fs.Bool("force", false, "overwrite branches and tags of existing not empty repositories not created by restore")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup restore -to [host/]owner [-output folder] [-limit list] [-metadata] [-force] [-dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*to) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	acc := parseAccount(*to, map[string]*endpoint{})
+	repos, err := findRestorable(*output, strings.Split(*limit, ","))
+	if err != nil {
+		logFatal(err)
+	}
+	if len(repos) == 0 {
+		logFatal("no mirrors to restore found in ", *output)
+	}
+	var failed int
+	for _, r := range repos {
+		if *dryRun {
+			fmt.Printf("restore %s to %s/%s (%s)\n", r.path, acc, r.name,
+				r.visibility)
+			continue
+		}
+		err := restoreRepository(acc, *output, r, *force)
+		if err == nil && *metadata {
+			err = restoreMetadata(acc, *output, r)
+		}
+		if err != nil {
+			logError(fmt.Sprintf("restore %s: %s", r.path, err),
+				repoFields(acc.Name+"/"+r.name)...)
+			failed++
+			continue
+		}
+		logInfo(fmt.Sprintf("restored %s to %s/%s", r.path, acc, r.name),
+			repoFields(acc.Name+"/"+r.name)...)
+	}
+	if !*dryRun {
+		fmt.Printf("%d repositories restored to %s, %d failed\n",
+			len(repos)-failed, acc, failed)
+	}
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// findRestorable return mirrors of output folder to restore, limited to
+// repositories in limit list if it's not empty. Settings are read from
+// metadata file written by describe stage, or from mirror description and
+// config, and visibility and archived state from run manifest. Repositories
+// without metadata file not listed in manifest are restored private.
+// Repositories of different owners or snapshots with the same name would be
+// restored to the same repository, which is an error
+func findRestorable(output string, limit []string) (repos []restoreRepo,
+	err error) {
+
+	paths := map[string]string{} // Backup paths by repository name
+
+	mirrors, err := findMirrors(output)
+	if err != nil {
+		return
+	}
+	attrs := map[string]manifestEntry{}
+	if m, err := readManifest(filepath.Join(output, manifestName)); err == nil {
+		for _, e := range m.Repos {
+			attrs[e.Repo] = e
+		}
+	}
+	for _, mirror := range mirrors {
+		rel, err := filepath.Rel(output, mirror)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.") ||
+			strings.HasSuffix(rel, ".wiki.git") {
+			continue
+		}
+		r := restoreRepo{mirror: mirror, path: strings.TrimSuffix(rel, ".git"),
+			visibility: "private"}
+		r.name = filepath.Base(r.path)
+		if !restoreLimited(r, limit) {
+			continue
+		}
+		if path, ok := paths[r.name]; ok {
+			return nil, fmt.Errorf("%s and %s would be restored to the same "+
+				"repository %s, select one of them with -limit or -output",
+				path, r.path, r.name)
+		}
+		paths[r.name] = r.path
+		wiki := strings.TrimSuffix(mirror, ".git") + ".wiki.git"
+		if _, err := os.Stat(filepath.Join(wiki, "HEAD")); err == nil {
+			r.wiki = wiki
+		}
+		desc, _ := os.ReadFile(filepath.Join(mirror, "description"))
+		r.description = strings.TrimSpace(string(desc))
+		if strings.HasPrefix(r.description, gitDefaultDescription) ||
+			r.description == r.path {
+			r.description = ""
+		}
+		r.homepage = gitConfig(mirror, "gitweb.homepage")
+		if topics := gitConfig(mirror, "github.topics"); len(topics) != 0 {
+			r.topics = strings.Split(topics, ",")
+		}
+		if e, ok := attrs[r.path]; ok {
+			if len(e.Visibility) != 0 {
+				r.visibility = e.Visibility
+			}
+			r.archived = e.Archived
+		}
+		base := strings.TrimSuffix(mirror, ".git")
+		if m, err := readMetadata(base + metadataSuffix); err == nil {
+			r.description, r.homepage, r.topics = m.Description, m.Homepage,
+				m.Topics
+			if len(m.Visibility) != 0 {
+				r.visibility = m.Visibility
+			} else if !m.Private {
+				r.visibility = "public"
+			}
+			r.archived, r.settings = m.Archived, &m.repoMetadata
+		}
+		repos = append(repos, r)
+	}
+	return
+}
+
+// restoreLimited return true if repository is in limit list or limit list
+// is empty
+func restoreLimited(r restoreRepo, limit []string) bool {
+	empty := true
+	for _, l := range limit {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 {
+			continue
+		}
+		empty = false
+		if l == r.path || l == r.name ||
+			strings.HasSuffix(r.path, "/"+strings.TrimPrefix(l, "/")) {
+			return true
+		}
+	}
+	return empty
+}
+
+// gitConfig return value of mirror config key, empty if key is not set
+func gitConfig(mirror, key string) string {
+	out, err := exec.Command("git", "-C", mirror, "config", "--get",
+		key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// restoreRepository create repository under account if it doesn't exist,
+// push mirror branches and tags and wiki to it, and archive it if backed up
+// repository was archived. Pull requests refs are not pushed, github rejects
+// them. Existing not empty repository is overwritten only if it was created
+// by previous restore, which is recorded in mapping file in output folder,
+// or if force is set
+func restoreRepository(acc account, output string, r restoreRepo,
+	force bool) error {
+
+	api := newAPIClient(acc.endpoint)
+	repo := acc.Name + "/" + r.name
+	m, err := loadRestoreMap(restoreMapFile(output, acc, r.name))
+	if err != nil {
+		return err
+	}
+	created, err := createRepository(api, acc, r)
+	switch {
+	case err != nil:
+		return err
+	case created:
+		m.Created = true
+		if err := m.save(); err != nil {
+			return err
+		}
+	case !m.Created && !force:
+		out, err := exec.Command("git", "ls-remote", "--heads", "--tags",
+			acc.gitURL(repo)).Output()
+		if err != nil {
+			return fmt.Errorf("check existing repository: %w", err)
+		}
+		if len(strings.TrimSpace(string(out))) != 0 {
+			return fmt.Errorf("%s already exists and is not empty, use -force "+
+				"to overwrite its branches and tags", repo)
+		}
+	}
+	if len(r.topics) != 0 {
+		err := api.send(http.MethodPut, "/repos/"+repo+"/topics",
+			map[string][]string{"names": r.topics}, nil)
+		if err != nil {
+			logWarn(fmt.Sprintf("%s: can't set topics: %s", repo,
+				firstLine(err.Error())), repoFields(repo)...)
+		}
+	}
+
+	err = retry(repo+": push", func() error {
+		return run("git", "-C", r.mirror, "push", "--force", "--prune",
+			acc.gitURL(repo), "+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*")
+	})
+	if err != nil {
+		return err
+	}
+	if len(r.wiki) != 0 {
+		err := retry(repo+": push wiki", func() error {
+			return run("git", "-C", r.wiki, "push", "--force",
+				acc.gitURL(repo+".wiki"), "+refs/heads/*:refs/heads/*")
+		})
+		if err != nil {
+			logWarn(fmt.Sprintf("%s: can't push wiki, create the first wiki "+
+				"page and restore again: %s", repo, firstLine(err.Error())),
+				repoFields(repo)...)
+		}
+	}
+
+	if r.settings != nil {
+		if err := api.send(http.MethodPatch, "/repos/"+repo,
+			restoreSettings(*r.settings), nil); err != nil {
+			return fmt.Errorf("restore settings: %w", err)
+		}
+	}
+	if r.archived {
+		return api.send(http.MethodPatch, "/repos/"+repo,
+			map[string]bool{"archived": true}, nil)
+	}
+	return nil
+}
+
+// restoreSettings return repository update request of metadata settings:
+// default branch, features and merge settings. Topics are set separately,
+// and repository is archived after all updates
+func restoreSettings(m repoMetadata) map[string]interface{} {
+	var settings map[string]interface{}
+	data, _ := json.Marshal(m)
+	json.Unmarshal(data, &settings)
+	for _, key := range []string{"topics", "archived", "private"} {
+		delete(settings, key)
+	}
+	if len(m.DefaultBranch) == 0 {
+		delete(settings, "default_branch")
+	}
+	if len(m.Visibility) == 0 {
+		delete(settings, "visibility")
+	}
+	return settings
+}
+
+// createRepository create repository under user or organisation account.
+// Returns false if repository already exists, so interrupted restore may be
+// repeated
+func createRepository(api *apiClient, acc account, r restoreRepo) (
+	created bool, err error) {
+
+	var owner struct {
+		Type string `json:"type"`
+	}
+	if err = api.get("/users/"+acc.Name, &owner); err != nil {
+		return
+	}
+	endpoint := "/user/repos"
+	if owner.Type == "Organization" {
+		endpoint = "/orgs/" + acc.Name + "/repos"
+	}
+	data := map[string]interface{}{
+		"name":        r.name,
+		"description": r.description,
+		"homepage":    r.homepage,
+		"private":     r.visibility != "public",
+		"has_wiki":    len(r.wiki) != 0,
+	}
+	if r.visibility == "internal" && owner.Type == "Organization" {
+		data["visibility"] = "internal"
+	}
+	err = api.create(endpoint, data, nil)
+	var e *apiError
+	if errors.As(err, &e) && e.code == http.StatusUnprocessableEntity &&
+		strings.Contains(e.msg, "already exists") {
+		logInfo(fmt.Sprintf("%s/%s already exists", acc.Name, r.name),
+			repoFields(acc.Name+"/"+r.name)...)
+		return false, nil
+	}
+	return err == nil, err
+}
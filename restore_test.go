@@ -0,0 +1,103 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreRepository(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // Existing target: empty, "empty" or "foreign"
+		force    bool
+		runs     int
+		err      string
+	}{
+		{"new repository", "", false, 1, ""},
+		{"repeated restore", "", false, 2, ""},
+		{"existing empty repository", "empty", false, 1, ""},
+		{"existing repository", "foreign", false, 1, "not empty"},
+		{"existing repository forced", "foreign", true, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestGitHub(t)
+			output := t.TempDir()
+			mirrorRemote(t, m, "octo/alpha", output, "octo/alpha")
+			target := mockRestoreOwner + "/alpha"
+			switch tt.existing {
+			case "empty":
+				err := run("git", "init", "-q", "--bare", filepath.Join(m.dir,
+					"remotes", target+".git"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			case "foreign":
+				if err := m.createRemote(target, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			foreignTip := m.remoteTip(target)
+
+			repos, err := findRestorable(output, nil)
+			if err != nil || len(repos) != 1 {
+				t.Fatalf("%d repositories to restore found: %v", len(repos),
+					err)
+			}
+			acc := account{endpoint: m.endpoint(), Name: mockRestoreOwner}
+			for i := 0; i < tt.runs && err == nil; i++ {
+				err = restoreRepository(acc, output, repos[0], tt.force)
+			}
+			switch {
+			case len(tt.err) == 0 && err != nil:
+				t.Fatal(err)
+			case len(tt.err) != 0 && (err == nil ||
+				!strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v, expected %q", err, tt.err)
+			case len(tt.err) != 0:
+				if m.remoteTip(target) != foreignTip {
+					t.Error("existing repository is overwritten")
+				}
+			case m.remoteTip(target) != m.remoteTip("octo/alpha"):
+				t.Error("restored tip mismatch")
+			}
+		})
+	}
+}
+
+func TestFindRestorableDuplicates(t *testing.T) {
+	m := newTestGitHub(t)
+	output := t.TempDir()
+	mirrorRemote(t, m, "octo/alpha", output, "octo/alpha")
+	mirrorRemote(t, m, "octo/alpha", output, "other/alpha")
+	mirrorRemote(t, m, "octo/beta", output, "octo/beta")
+
+	tests := []struct {
+		name  string
+		limit []string
+		repos int
+		err   bool
+	}{
+		{"all", nil, 0, true},
+		{"same name", []string{"alpha"}, 0, true},
+		{"owner path", []string{"octo/alpha", "octo/beta"}, 2, false},
+		{"other owner", []string{"other/alpha"}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repos, err := findRestorable(output, tt.limit)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected error %v", err, tt.err)
+			}
+			if len(repos) != tt.repos {
+				t.Errorf("%d repositories found, %d expected", len(repos),
+					tt.repos)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pause between github api writes of metadata restore, github asks to pause
+// between content creating requests to avoid secondary rate limits
+var restoreWriteDelay = time.Second
+
+// restoreMap is mapping of exported metadata items to items created in
+// restored repository. The map is saved to mapping file after each created
+// item, so repeated or interrupted restore doesn't duplicate items
+type restoreMap struct {
+	Created    bool             `json:"created"`    // Repository created by restore
+	Labels     map[string]bool  `json:"labels"`     // Restored labels names
+	Milestones map[int]int      `json:"milestones"` // Exported to restored number
+	Issues     map[int]int      `json:"issues"`     // Exported to restored number
+	Closed     map[int]bool     `json:"closed"`     // Exported issues closed after restore
+	Comments   map[int64]int64  `json:"comments"`   // Exported to restored id
+	Releases   map[string]int64 `json:"releases"`   // Release tag to restored id
+	Assets     map[string]bool  `json:"assets"`     // Uploaded tag/name assets
+
+	file string
+}
+
+// exportedRelease is release restored from releases.json export or from
+// release assets manifest
+type exportedRelease struct {
+	Tag        string
+	Target     string
+	Name       string
+	Body       string
+	Draft      bool
+	Prerelease bool
+	Files      []string // Asset files
+}
+
+// restoreMapFile return mapping file name of restored repository in output
+// folder
+func restoreMapFile(output string, acc account, name string) string {
+	return filepath.Join(output, ".github-backup", "restore",
+		filepath.FromSlash(acc.path(acc.Name+"/"+name))+".json")
+}
+
+// loadRestoreMap read mapping file, missing file is empty mapping
+func loadRestoreMap(file string) (*restoreMap, error) {
+	m := &restoreMap{file: file}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if m.Labels == nil {
+		m.Labels = map[string]bool{}
+	}
+	if m.Milestones == nil {
+		m.Milestones = map[int]int{}
+	}
+	if m.Issues == nil {
+		m.Issues = map[int]int{}
+	}
+	if m.Closed == nil {
+		m.Closed = map[int]bool{}
+	}
+	if m.Comments == nil {
+		m.Comments = map[int64]int64{}
+	}
+	if m.Releases == nil {
+		m.Releases = map[string]int64{}
+	}
+	if m.Assets == nil {
+		m.Assets = map[string]bool{}
+	}
+	return m, err
+}
+
+// save write mapping file
+func (m *restoreMap) save() error {
+	return writeJSON(m.file, m)
+}
+
+// restoreMetadata replay metadata exported next to mirror (labels,
+// milestones, issues with comments and releases with assets) into restored
+// repository. Issues and comments are created by the token user, so original
+// author and time are quoted at the top of body. Pull requests can't be
+// recreated and are skipped
+func restoreMetadata(acc account, output string, r restoreRepo) error {
+	m, err := loadRestoreMap(restoreMapFile(output, acc, r.name))
+	if err != nil {
+		return err
+	}
+	api := newAPIClient(acc.endpoint)
+	repo := acc.Name + "/" + r.name
+	base := strings.TrimSuffix(r.mirror, ".git")
+	for _, step := range []func(*apiClient, string, string, *restoreMap) error{
+		restoreLabels, restoreMilestones, restoreIssues, restoreComments,
+		restoreReleases,
+	} {
+		if err := step(api, repo, base, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExport read exported json list file, missing file is not an error
+func readExport(name string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return true, nil
+}
+
+// restoreCreate send api request creating or updating item, pause after it
+// and save mapping with item added by add function. The POST requests
+// creating items are not retried to not create duplicates
+func restoreCreate(api *apiClient, m *restoreMap, method, endpoint string,
+	data, v interface{}, add func()) error {
+
+	var err error
+	if method == http.MethodPost {
+		err = api.create(endpoint, data, v)
+	} else {
+		err = api.send(method, endpoint, data, v)
+	}
+	time.Sleep(restoreWriteDelay)
+	if err != nil {
+		return err
+	}
+	add()
+	return m.save()
+}
+
+// alreadyExists return true if api error is validation error of existing item
+func alreadyExists(err error) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.code == http.StatusUnprocessableEntity &&
+		strings.Contains(e.msg, "already_exists")
+}
+
+// restoreLabels create exported labels, existing labels with the same name
+// are updated
+func restoreLabels(api *apiClient, repo, base string, m *restoreMap) error {
+	var labels []struct {
+		Name        string `json:"name"`
+		Color       string `json:"color"`
+		Description string `json:"description"`
+	}
+	if ok, err := readExport(base+".labels.json", &labels); !ok {
+		return err
+	}
+	for _, l := range labels {
+		if m.Labels[l.Name] {
+			continue
+		}
+		data := map[string]string{"name": l.Name, "color": l.Color,
+			"description": l.Description}
+		add := func() { m.Labels[l.Name] = true }
+		err := restoreCreate(api, m, http.MethodPost, "/repos/"+repo+"/labels",
+			data, nil, add)
+		if alreadyExists(err) {
+			err = restoreCreate(api, m, http.MethodPatch, "/repos/"+repo+
+				"/labels/"+url.PathEscape(l.Name), data, nil, add)
+		}
+		if err != nil {
+			return fmt.Errorf("label %s: %w", l.Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreMilestones create exported milestones, existing milestones with
+// the same title are mapped
+func restoreMilestones(api *apiClient, repo, base string,
+	m *restoreMap) error {
+
+	var milestones []struct {
+		Number      int     `json:"number"`
+		Title       string  `json:"title"`
+		State       string  `json:"state"`
+		Description string  `json:"description"`
+		DueOn       *string `json:"due_on"`
+	}
+	if ok, err := readExport(base+".milestones.json", &milestones); !ok {
+		return err
+	}
+	list, err := apiList(api, "/repos/"+repo+"/milestones?state=all&per_page=100")
+	if err != nil {
+		return err
+	}
+	existing := map[string]int{} // Milestones numbers by title
+	for _, data := range list {
+		var e struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+		}
+		if json.Unmarshal(data, &e) == nil {
+			existing[e.Title] = e.Number
+		}
+	}
+	sort.Slice(milestones, func(i, j int) bool {
+		return milestones[i].Number < milestones[j].Number
+	})
+	for _, ms := range milestones {
+		if _, ok := m.Milestones[ms.Number]; ok {
+			continue
+		}
+		if n, ok := existing[ms.Title]; ok {
+			m.Milestones[ms.Number] = n
+			continue
+		}
+		data := map[string]interface{}{"title": ms.Title, "state": ms.State,
+			"description": ms.Description}
+		if ms.DueOn != nil {
+			data["due_on"] = *ms.DueOn
+		}
+		var created struct {
+			Number int `json:"number"`
+		}
+		err := restoreCreate(api, m, http.MethodPost, "/repos/"+repo+
+			"/milestones", data, &created, func() {
+			m.Milestones[ms.Number] = created.Number
+		})
+		if err != nil {
+			return fmt.Errorf("milestone %s: %w", ms.Title, err)
+		}
+	}
+	return m.save()
+}
+
+// restoreIssues create exported issues in number order with labels,
+// milestone and state. Closed state is recorded in mapping after it is
+// applied, so issue created by interrupted restore is closed on re-run. Pull
+// requests are skipped
+func restoreIssues(api *apiClient, repo, base string, m *restoreMap) error {
+	var issues []struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+		State  string `json:"state"`
+		User   struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Created time.Time `json:"created_at"`
+		Labels  []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+		Milestone *struct {
+			Number int `json:"number"`
+		} `json:"milestone"`
+		PullRequest json.RawMessage `json:"pull_request"`
+	}
+	if ok, err := readExport(base+".issues.json", &issues); !ok {
+		return err
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].Number < issues[j].Number
+	})
+	for _, is := range issues {
+		if len(is.PullRequest) != 0 {
+			continue
+		}
+		number, ok := m.Issues[is.Number]
+		if !ok {
+			data := map[string]interface{}{"title": is.Title,
+				"body": restoredBody(is.User.Login, is.Created, "opened", "#"+
+					fmt.Sprint(is.Number), is.Body)}
+			var labels []string
+			for _, l := range is.Labels {
+				labels = append(labels, l.Name)
+			}
+			if len(labels) != 0 {
+				data["labels"] = labels
+			}
+			if is.Milestone != nil {
+				if n, ok := m.Milestones[is.Milestone.Number]; ok {
+					data["milestone"] = n
+				}
+			}
+			var created struct {
+				Number int `json:"number"`
+			}
+			err := restoreCreate(api, m, http.MethodPost, "/repos/"+repo+
+				"/issues", data, &created, func() {
+				m.Issues[is.Number] = created.Number
+			})
+			if err != nil {
+				return fmt.Errorf("issue #%d: %w", is.Number, err)
+			}
+			number = created.Number
+		}
+		if is.State != "closed" || m.Closed[is.Number] {
+			continue
+		}
+		err := api.send(http.MethodPatch, fmt.Sprintf("/repos/%s/issues/%d",
+			repo, number), map[string]string{"state": "closed"}, nil)
+		if err != nil {
+			return fmt.Errorf("issue #%d: close: %w", is.Number, err)
+		}
+		m.Closed[is.Number] = true
+		if err := m.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreComments create exported issue comments in restored issues
+func restoreComments(api *apiClient, repo, base string, m *restoreMap) error {
+	var comments []struct {
+		ID       int64  `json:"id"`
+		IssueURL string `json:"issue_url"`
+		Body     string `json:"body"`
+		User     struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Created time.Time `json:"created_at"`
+	}
+	if ok, err := readExport(base+".comments.json", &comments); !ok {
+		return err
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].ID < comments[j].ID
+	})
+	for _, c := range comments {
+		var number int
+		fmt.Sscan(c.IssueURL[strings.LastIndex(c.IssueURL, "/")+1:], &number)
+		issue, ok := m.Issues[number]
+		if _, done := m.Comments[c.ID]; done || !ok {
+			continue
+		}
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		err := restoreCreate(api, m, http.MethodPost, fmt.Sprintf(
+			"/repos/%s/issues/%d/comments", repo, issue),
+			map[string]string{"body": restoredBody(c.User.Login, c.Created,
+				"commented", "", c.Body)}, &created,
+			func() { m.Comments[c.ID] = created.ID })
+		if err != nil {
+			return fmt.Errorf("comment %d: %w", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// restoredBody return body of restored issue or comment quoting original
+// author, time and number
+func restoredBody(login string, created time.Time, action, number,
+	body string) string {
+
+	header := fmt.Sprintf("> Originally %s by @%s on %s", action, login,
+		created.UTC().Format("2006-01-02 15:04 MST"))
+	if len(number) != 0 {
+		header += " as " + number
+	}
+	return header + "\n\n" + body
+}
+
+// restoreReleases create exported releases and upload its assets. Releases
+// are read from releases.json export, or from release assets manifest of
+// releases stage with tags only
+func restoreReleases(api *apiClient, repo, base string, m *restoreMap) error {
+	releases, err := exportedReleases(base)
+	if err != nil {
+		return err
+	}
+	for _, rel := range releases {
+		id, ok := m.Releases[rel.Tag]
+		if !ok {
+			data := map[string]interface{}{"tag_name": rel.Tag,
+				"name": rel.Name, "body": rel.Body, "draft": rel.Draft,
+				"prerelease": rel.Prerelease}
+			if len(rel.Target) != 0 {
+				data["target_commitish"] = rel.Target
+			}
+			var created struct {
+				ID int64 `json:"id"`
+			}
+			err := restoreCreate(api, m, http.MethodPost, "/repos/"+repo+
+				"/releases", data, &created, func() {
+				m.Releases[rel.Tag] = created.ID
+			})
+			if err != nil {
+				return fmt.Errorf("release %s: %w", rel.Tag, err)
+			}
+			id = created.ID
+		}
+		for _, file := range rel.Files {
+			key := rel.Tag + "/" + filepath.Base(file)
+			if m.Assets[key] {
+				continue
+			}
+			if err := api.upload(repo, id, file); err != nil {
+				return fmt.Errorf("release %s asset %s: %w", rel.Tag,
+					filepath.Base(file), err)
+			}
+			m.Assets[key] = true
+			if err := m.save(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportedReleases return releases exported next to mirror base path with
+// existing asset files
+func exportedReleases(base string) (releases []exportedRelease, err error) {
+	dir := base + ".releases"
+	var list []struct {
+		Tag        string `json:"tag_name"`
+		Target     string `json:"target_commitish"`
+		Name       string `json:"name"`
+		Body       string `json:"body"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+		Assets     []struct {
+			Name string `json:"name"`
+		} `json:"assets"`
+	}
+	ok, err := readExport(base+".releases.json", &list)
+	if err != nil {
+		return
+	}
+	if ok {
+		for _, l := range list {
+			rel := exportedRelease{Tag: l.Tag, Target: l.Target, Name: l.Name,
+				Body: l.Body, Draft: l.Draft, Prerelease: l.Prerelease}
+			for _, a := range l.Assets {
+				file := filepath.Join(dir, filepath.Base(l.Tag),
+					filepath.Base(a.Name))
+				if _, err := os.Stat(file); err == nil {
+					rel.Files = append(rel.Files, file)
+				}
+			}
+			releases = append(releases, rel)
+		}
+		return
+	}
+
+	assets, err := readAssets(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	byTag := map[string]int{}
+	for _, a := range assets {
+		i, ok := byTag[a.Release]
+		if !ok {
+			i = len(releases)
+			byTag[a.Release] = i
+			releases = append(releases, exportedRelease{Tag: a.Release,
+				Name: a.Release})
+		}
+		releases[i].Files = append(releases[i].Files, filepath.Join(dir,
+			filepath.FromSlash(a.File)))
+	}
+	return
+}
+
+// upload upload release asset file to release of repository with github
+// uploads api
+func (c *apiClient) upload(repo string, release int64, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	uploads := strings.Replace(c.APIURL, "://api.", "://uploads.", 1)
+	if uploads == c.APIURL {
+		uploads = strings.TrimSuffix(c.APIURL, "/api/v3") + "/api/uploads"
+	}
+	u := fmt.Sprintf("%s/repos/%s/releases/%d/assets?name=%s", uploads, repo,
+		release, url.QueryEscape(filepath.Base(file)))
+	req, err := c.newRequest(http.MethodPost, "")
+	if err != nil {
+		return err
+	}
+	if req.URL, err = url.Parse(u); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Body, req.ContentLength = f, info.Size()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s: %s\n%s", u, resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssues is mock github issues api of restored repository, other
+// requests are served by mock github
+type mockIssues struct {
+	sync.Mutex
+	m          *mockGitHub
+	states     map[int]string // Issues states by number
+	failCloses int            // Number of close requests to fail
+	failCreate int            // Number of created issues to respond with error
+}
+
+func (s *mockIssues) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	prefix := "/repos/" + mockRestoreOwner + "/alpha/issues"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == prefix:
+		n := len(s.states) + 1
+		s.states[n] = "open"
+		if s.failCreate > 0 {
+			s.failCreate--
+			http.Error(w, `{"message":"Bad Gateway"}`, http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int{"number": n})
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path,
+		prefix+"/"):
+		if s.failCloses > 0 {
+			s.failCloses--
+			http.Error(w, `{"message":"Validation Failed"}`,
+				http.StatusUnprocessableEntity)
+			return
+		}
+		var n int
+		fmt.Sscan(strings.TrimPrefix(r.URL.Path, prefix+"/"), &n)
+		var req struct {
+			State string `json:"state"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		s.states[n] = req.State
+		json.NewEncoder(w).Encode(map[string]int{"number": n})
+	default:
+		s.m.serve(w, r)
+	}
+}
+
+func TestRestoreIssues(t *testing.T) {
+	defer func(d time.Duration) { restoreWriteDelay = d }(restoreWriteDelay)
+	restoreWriteDelay = 0
+
+	type issue struct {
+		Number      int             `json:"number"`
+		Title       string          `json:"title"`
+		State       string          `json:"state"`
+		PullRequest json.RawMessage `json:"pull_request,omitempty"`
+	}
+	tests := []struct {
+		name       string
+		issues     []issue
+		failCloses int
+		states     map[int]string // Restored issues states after all runs
+	}{
+		{"open and closed", []issue{
+			{Number: 1, Title: "open", State: "open"},
+			{Number: 2, Title: "closed", State: "closed"},
+		}, 0, map[int]string{1: "open", 2: "closed"}},
+		{"pull requests skipped", []issue{
+			{Number: 1, Title: "pr", State: "closed",
+				PullRequest: json.RawMessage(`{}`)},
+			{Number: 2, Title: "closed", State: "closed"},
+		}, 0, map[int]string{1: "closed"}},
+		{"close failed", []issue{
+			{Number: 1, Title: "closed", State: "closed"},
+			{Number: 2, Title: "open", State: "open"},
+		}, 1, map[int]string{1: "closed", 2: "open"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestGitHub(t)
+			mock := &mockIssues{m: m, states: map[int]string{},
+				failCloses: tt.failCloses}
+			srv := httptest.NewServer(mock)
+			defer srv.Close()
+			e := m.endpoint()
+			e.APIURL = srv.URL
+			api := &apiClient{endpoint: e, token: "test"}
+
+			dir := t.TempDir()
+			base := filepath.Join(dir, "octo", "alpha")
+			if err := writeJSON(base+".issues.json", tt.issues); err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(dir, "restore.json")
+			repo := mockRestoreOwner + "/alpha"
+
+			// Interrupted restore is repeated until it succeeds
+			for run := 0; ; run++ {
+				rm, err := loadRestoreMap(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = restoreIssues(api, repo, base, rm)
+				if err == nil {
+					break
+				}
+				if run >= tt.failCloses {
+					t.Fatalf("run %d: %s", run, err)
+				}
+			}
+
+			// Nothing is created or changed by one more restore
+			rm, _ := loadRestoreMap(file)
+			if err := restoreIssues(api, repo, base, rm); err != nil {
+				t.Fatal(err)
+			}
+			if len(mock.states) != len(tt.states) {
+				t.Fatalf("%d issues restored, %d expected", len(mock.states),
+					len(tt.states))
+			}
+			for n, state := range tt.states {
+				if mock.states[n] != state {
+					t.Errorf("issue #%d state %s, expected %s", n,
+						mock.states[n], state)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreCreateNotRetried(t *testing.T) {
+	defer func(d, rd time.Duration) {
+		restoreWriteDelay, retryDelay = d, rd
+	}(restoreWriteDelay, retryDelay)
+	restoreWriteDelay, retryDelay = 0, time.Millisecond
+
+	m := newTestGitHub(t)
+	mock := &mockIssues{m: m, states: map[int]string{}, failCreate: 1}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+	e := m.endpoint()
+	e.APIURL = srv.URL
+	api := &apiClient{endpoint: e, token: "test"}
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "octo", "alpha")
+	issues := []map[string]interface{}{{"number": 1, "title": "open",
+		"state": "open"}}
+	if err := writeJSON(base+".issues.json", issues); err != nil {
+		t.Fatal(err)
+	}
+	rm, err := loadRestoreMap(filepath.Join(dir, "restore.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Issue is created but the response is failed, the request creating
+	// issue is not repeated
+	if err := restoreIssues(api, mockRestoreOwner+"/alpha", base, rm); err == nil {
+		t.Fatal("restore with failed create succeeded")
+	}
+	if len(mock.states) != 1 {
+		t.Fatalf("%d issues created, 1 expected", len(mock.states))
+	}
+}
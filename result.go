@@ -0,0 +1,91 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// repoResult is result of repository backup
+type repoResult struct {
+	Account  string        // Account name with host prefix
+	Repo     string        // Full repository name
+	Start    time.Time     // Backup start time
+	Duration time.Duration // Backup duration
+	Tip      string        // Upstream HEAD commit hash captured
+	Err      error         // Backup error, nil on success
+	Stages   []stageResult // Pipeline stages results
+
+	Path  string            // Repository path relative to output folder
+	Refs  map[string]string // Refs of the mirror captured
+	Wiki  bool              // Wiki is backed up
+	Size  int64             // Size of backup files in bytes
+	Files []string          // Backup files relative to output folder
+	Tier  string            // Repository tier set by policy file
+
+	Shallow  bool              // Mirror is shallow clone
+	Coverage map[string]string // Coverage of repository parts by backup
+	Blocked  string            // Reason of block by github, empty if not blocked
+	Fetched  int64             // Growth of mirrors size, bytes of new objects fetched
+	Cloned   bool              // Mirror is cloned in this run, not updated
+}
+
+// Results of repositories backup in this run
+var results []repoResult
+
+// addResult add repository backup result with pipeline stages results and
+// return added result
+func addResult(acc account, repo string, start time.Time, tip string,
+	err error, stages ...stageResult) *repoResult {
+
+	results = append(results, repoResult{
+		Account:  acc.String(),
+		Repo:     repo,
+		Start:    start,
+		Duration: time.Since(start),
+		Tip:      tip,
+		Err:      err,
+		Stages:   stages,
+		Path:     acc.path(repo),
+	})
+	return &results[len(results)-1]
+}
+
+// failedResults return number of failed repositories, repositories blocked
+// by github are not counted
+func failedResults() (n int) {
+	for i := range results {
+		if results[i].Err != nil && len(results[i].Blocked) == 0 {
+			n++
+		}
+	}
+	return
+}
+
+// Maximum number of failed repositories listed in run summary
+const summaryFailed = 20
+
+// failedSummary return failed repositories list with first line of error of
+// each repository, for run summary notification
+func failedSummary() string {
+	var b strings.Builder
+	n := 0
+	for _, r := range results {
+		if r.Err == nil || len(r.Blocked) != 0 {
+			continue
+		}
+		if n++; n > summaryFailed {
+			continue
+		}
+		fmt.Fprintf(&b, "failed: %s: %s\n", r.Path, firstLine(r.Err.Error()))
+	}
+	if n > summaryFailed {
+		fmt.Fprintf(&b, "... and %d more failed repositories\n",
+			n-summaryFailed)
+	}
+	return b.String()
+}
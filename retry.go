@@ -0,0 +1,78 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of retries of failed network operations set by -retries parameter,
+// and initial backoff delay set by -retry-delay parameter
+var retries = 3
+var retryDelay = 2 * time.Second
+
+// Random source of backoff jitter, used by parallel workers
+var retryRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var retryRandMu sync.Mutex
+
+// apiError is github api response error status
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+// Git errors output which are not fixed by retry
+var permanentGitErrors = []string{"not found", "Authentication failed",
+	"Permission denied", "does not appear to be a git repository",
+	"could not read Username", "already exists"}
+
+// transient return true if error of network operation may be fixed by retry:
+// network errors, api server errors and rate limits, and git errors except
+// missing repository and authentication errors
+func transient(err error) bool {
+	if errors.Is(err, errRepoTimeout) || len(blockReason(err)) != 0 {
+		return false
+	}
+	var e *apiError
+	if errors.As(err, &e) {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+	for _, s := range permanentGitErrors {
+		if strings.Contains(err.Error(), s) {
+			return false
+		}
+	}
+	return true
+}
+
+// retry execute network operation and retry it if it fails transiently, with
+// exponential jittered backoff delay between attempts
+func retry(name string, op func() error) (err error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		if err = op(); err == nil || attempt >= retries || !transient(err) {
+			return
+		}
+		// Jitter the delay from half to full backoff
+		retryRandMu.Lock()
+		d := delay/2 + time.Duration(retryRand.Int63n(int64(delay/2)+1))
+		retryRandMu.Unlock()
+		logWarn(fmt.Sprintf("%s: attempt %d failed, retrying in %s: %s", name,
+			attempt+1, d.Round(time.Millisecond), firstLine(err.Error())),
+			"attempt", attempt+1, "delay", d)
+		time.Sleep(d)
+		delay *= 2
+	}
+}
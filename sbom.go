@@ -0,0 +1,36 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Export dependency graph SBOM flag
+var sbom bool
+
+// exportSBOM save repository dependency graph SBOM (SPDX json) from github api
+// to the owner/repo.sbom.json file. Returns file path relative to dir folder
+func exportSBOM(acc account, repo, dir, path string) (name string, err error) {
+	var data json.RawMessage
+	err = newAPIClient(acc.endpoint).get("/repos/"+repo+
+		"/dependency-graph/sbom", &data)
+	if err != nil {
+		return
+	}
+
+	var out bytes.Buffer
+	if err = json.Indent(&out, data, "", "  "); err != nil {
+		return
+	}
+	out.WriteByte('\n')
+
+	name = path + ".sbom.json"
+	err = os.WriteFile(filepath.Join(dir, name), out.Bytes(), 0644)
+	return
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Scheduling parameters: maximum random delay of run start set by -jitter
+// parameter, and blackout windows set by -blackout parameter
+var jitter time.Duration
+var blackouts []blackoutWindow
+
+// blackoutWindow is time window when backups should not run: daily or week
+// days window of day time, or dates range
+type blackoutWindow struct {
+	days     [7]bool // Week days of daily window, indexed by time.Weekday
+	from, to int     // Day time window in minutes, may wrap midnight
+	dateFrom string  // Dates range YYYY-MM-DD, inclusive
+	dateTo   string
+}
+
+// weekDays contains week days by short name
+var weekDays = map[string]time.Weekday{"sun": time.Sunday,
+	"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+// parseBlackout parse semicolon separated list of blackout windows in local
+// time:
+//
+//	HH:MM-HH:MM                  - every day, e.g. 22:00-02:00
+//	Day[-Day][,Day] HH:MM-HH:MM  - week days, e.g. Mon-Fri 09:00-18:00
+//	YYYY-MM-DD..YYYY-MM-DD       - dates, e.g. 2022-12-20..2023-01-03
+func parseBlackout(list string) (windows []blackoutWindow, err error) {
+	for _, s := range strings.Split(list, ";") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		var w blackoutWindow
+		if from, to, ok := strings.Cut(s, ".."); ok {
+			for _, d := range []string{from, to} {
+				if _, err := time.Parse("2006-01-02", d); err != nil {
+					return nil, fmt.Errorf("wrong blackout window '%s' date", s)
+				}
+			}
+			w.dateFrom, w.dateTo = from, to
+			windows = append(windows, w)
+			continue
+		}
+
+		days, hours, ok := strings.Cut(s, " ")
+		if !ok {
+			days, hours = "", s
+		}
+		if err = w.parseDays(days); err == nil {
+			err = w.parseHours(strings.TrimSpace(hours))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wrong blackout window '%s': %s", s, err)
+		}
+		windows = append(windows, w)
+	}
+	return
+}
+
+// parseDays parse week days list: Mon-Fri,Sun. All days if list is empty
+func (w *blackoutWindow) parseDays(list string) error {
+	if len(list) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, r := range strings.Split(strings.ToLower(list), ",") {
+		from, to, _ := strings.Cut(r, "-")
+		if len(to) == 0 {
+			to = from
+		}
+		d1, ok1 := weekDays[from]
+		d2, ok2 := weekDays[to]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("wrong week days '%s'", r)
+		}
+		for d := d1; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == d2 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseHours parse day time window HH:MM-HH:MM
+func (w *blackoutWindow) parseHours(s string) error {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("wrong time window '%s'", s)
+	}
+	for _, v := range []struct {
+		s string
+		m *int
+	}{{from, &w.from}, {to, &w.to}} {
+		t, err := time.Parse("15:04", v.s)
+		if err != nil {
+			return fmt.Errorf("wrong time '%s'", v.s)
+		}
+		*v.m = t.Hour()*60 + t.Minute()
+	}
+	return nil
+}
+
+// contains return true if time is in blackout window
+func (w blackoutWindow) contains(t time.Time) bool {
+	if len(w.dateFrom) != 0 {
+		date := t.Format("2006-01-02")
+		return date >= w.dateFrom && date <= w.dateTo
+	}
+	m := t.Hour()*60 + t.Minute()
+	prevDay := (t.Weekday() + 6) % 7
+	switch {
+	case w.from < w.to:
+		return w.days[t.Weekday()] && m >= w.from && m < w.to
+	case w.from > w.to:
+		// Window wraps midnight and started today or yesterday
+		return w.days[t.Weekday()] && m >= w.from ||
+			w.days[prevDay] && m < w.to
+	}
+	return false
+}
+
+// blackoutEnd return end time of blackout windows containing time t, or
+// false if t is not in blackout window. The end is searched for a month ahead,
+// so returned end of longer blackout is still in blackout window
+func blackoutEnd(t time.Time) (end time.Time, in bool) {
+	end = t
+	for i := 0; i < 60*24*31; i++ {
+		found := false
+		for _, w := range blackouts {
+			if w.contains(end) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+		in = true
+		end = end.Truncate(time.Minute).Add(time.Minute)
+	}
+	return
+}
+
+// waitBlackout wait until blackout window ends if current time is in
+// blackout window. The time is checked again after waiting, so backup never
+// starts in blackout window
+func waitBlackout() {
+	for {
+		end, in := blackoutEnd(time.Now())
+		if !in {
+			return
+		}
+		logInfo(fmt.Sprintf("blackout window, backup is paused until %s",
+			end.Format("2006-01-02 15:04")), "until", end.Format(time.RFC3339))
+		time.Sleep(time.Until(end))
+	}
+}
+
+// waitJitter wait random delay up to jitter before run start, so many backup
+// hosts scheduled at the same time don't start together
+func waitJitter() {
+	if jitter <= 0 {
+		return
+	}
+	delay := time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).
+		Int63n(int64(jitter)))
+	logInfo(fmt.Sprintf("jitter: backup starts in %s",
+		delay.Round(time.Second)), "delay", delay)
+	time.Sleep(delay)
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Read-only mode flag set by -read-only parameter. In read-only mode features
+// which could write to github are disabled and token with write or admin
+// scopes is refused
+var readOnly bool
+
+// readScopes is classic token scopes which don't grant write access
+var readScopes = map[string]bool{
+	"read:org":             true,
+	"read:user":            true,
+	"user:email":           true,
+	"read:packages":        true,
+	"read:discussion":      true,
+	"read:project":         true,
+	"read:audit_log":       true,
+	"read:enterprise":      true,
+	"read:repo_hook":       true,
+	"read:public_key":      true,
+	"read:gpg_key":         true,
+	"read:ssh_signing_key": true,
+}
+
+// checkReadOnly return error if feature writes to github in read-only mode.
+// Features which write to github should call it before writing
+func checkReadOnly(feature string) error {
+	if readOnly {
+		return fmt.Errorf("%s writes to github and can't be used in read-only mode",
+			feature)
+	}
+	return nil
+}
+
+// scopes return classic token scopes from X-OAuth-Scopes response header.
+// The ok is false if scopes are not reported (fine-grained or no token)
+func (c *apiClient) scopes() (scopes []string, ok bool, err error) {
+	req, err := c.newRequest("GET", "/")
+	if err != nil {
+		return
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+		return
+	}
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if !ok || len(c.token) == 0 {
+		return nil, false, nil
+	}
+	for _, scope := range strings.Split(strings.Join(header, ","), ",") {
+		if scope = strings.TrimSpace(scope); len(scope) != 0 {
+			scopes = append(scopes, scope)
+		}
+	}
+	return
+}
+
+// neededScopes return write or admin scopes needed by selected features. The
+// repo scope is needed to backup private repositories, so it is excess in
+// public mirror mode only
+func neededScopes() map[string]bool {
+	return map[string]bool{
+		"repo":      !publicMirror,
+		"admin:org": orgActions, // Actions secrets and runner groups
+	}
+}
+
+// excessScopes return token scopes not needed by selected features
+func excessScopes(scopes []string) (excess []string) {
+	needed := neededScopes()
+	for _, scope := range scopes {
+		if readScopes[scope] || needed[scope] {
+			continue
+		}
+		excess = append(excess, scope)
+	}
+	return
+}
+
+// checkScopes check tokens of accounts hosts have only scopes the selected
+// features need. Excess write or admin scopes are refused in read-only mode
+// and warned otherwise
+func checkScopes(accounts []account) error {
+	checked := map[string]bool{}
+	for _, acc := range accounts {
+		if checked[acc.Host] {
+			continue
+		}
+		checked[acc.Host] = true
+
+		scopes, ok, err := newAPIClient(acc.endpoint).scopes()
+		if err != nil {
+			return fmt.Errorf("can't check token scopes of %s: %s", acc.Host, err)
+		}
+		if !ok {
+			logWarn(fmt.Sprintf("token scopes of %s are not reported, can't "+
+				"check it", acc.Host), "host", acc.Host)
+			continue
+		}
+		excess := excessScopes(scopes)
+		if len(excess) == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("token of %s has scopes not needed for backup: %s",
+			acc.Host, strings.Join(excess, ", "))
+		if readOnly {
+			return fmt.Errorf("%s, use token without this scopes in read-only mode",
+				msg)
+		}
+		logWarn(msg, "host", acc.Host)
+	}
+	return nil
+}
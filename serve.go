@@ -0,0 +1,307 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveCmd is 'serve' command: serve backed up repositories read-only over
+// git smart http with git http-backend. Repositories stored remotely as
+// bundles chains, plain or encrypted, are materialized to local cache on
+// first clone request
+func serveCmd(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "http listen address")
+	source := fs.String("source", "", "bundles storage url: s3://bucket/prefix, gs://bucket/prefix, az://account/container/prefix or local folder")
+	cacheDir := fs.String("cache", "serve-cache", "local cache folder of materialized mirrors")
+	cacheSize := fs.String("cache-size", "10G", "maximum cache size, least recently used mirrors are evicted")
+	fs.StringVar(&decryptIdentity, "identity", "", "age identity file to decrypt .age bundles, .gpg bundles are decrypted with gpg keyring")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup serve -source url [-listen addr] [-cache folder] [-cache-size size] [-identity file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*source) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	d, err := newDestination(*source)
+	if err != nil {
+		logFatal(err)
+	}
+	src, ok := d.(gcDest)
+	if !ok {
+		logFatal(fmt.Sprintf("serving from %s is not supported", d))
+	}
+	size, err := parseSize(*cacheSize)
+	if err != nil {
+		logFatal(err)
+	}
+	out, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		logFatal("can't find git exec path: ", err)
+	}
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		logFatal(err)
+	}
+	dir, _ := filepath.Abs(*cacheDir)
+
+	c := &restoreCache{dir: dir, max: int64(size), source: src,
+		used: map[string]int{}, loading: map[string]*sync.Mutex{}}
+	backend := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(out)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	logInfo(fmt.Sprintf("serve repositories of %s on %s, cache %s (%s)", src,
+		*listen, dir, formatSize(c.max)), "listen", *listen)
+	logFatal(http.ListenAndServe(*listen, c.handler(backend)))
+}
+
+// restoreCache is read-through cache of mirrors restored from remote bundles
+// with least recently used eviction
+type restoreCache struct {
+	dir    string // Cache folder
+	max    int64  // Maximum cache size
+	source gcDest // Bundles storage
+
+	mu      sync.Mutex
+	used    map[string]int         // Number of requests using mirror
+	loading map[string]*sync.Mutex // Materialization locks by repository
+}
+
+// handler return http handler which materializes requested repository to
+// cache and passes the request to git http backend. Push is refused
+func (c *restoreCache) handler(backend http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, ok := repoFromURL(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/git-receive-pack") ||
+			r.URL.Query().Get("service") == "git-receive-pack" {
+			http.Error(w, "backup mirrors are read-only", http.StatusForbidden)
+			return
+		}
+		if err := c.acquire(repo); err != nil {
+			logError(fmt.Sprintf("%s: %s", repo, err),
+				append(repoFields(repo), "error", err)...)
+			http.NotFound(w, r)
+			return
+		}
+		defer c.release(repo)
+		backend.ServeHTTP(w, r)
+	})
+}
+
+// repoFromURL return repository path owner/repo from git http url path
+// /owner/repo.git/info/refs
+func repoFromURL(p string) (repo string, ok bool) {
+	p = path.Clean("/" + p)
+	i := strings.Index(p, ".git/")
+	if i < 0 {
+		return "", false
+	}
+	repo = strings.TrimPrefix(p[:i], "/")
+	if len(repo) == 0 || strings.Contains(repo, "..") {
+		return "", false
+	}
+	return repo, true
+}
+
+// acquire materialize repository mirror in cache if it is not cached and mark
+// it used so it is not evicted until release
+func (c *restoreCache) acquire(repo string) error {
+	c.mu.Lock()
+	l, ok := c.loading[repo]
+	if !ok {
+		l = &sync.Mutex{}
+		c.loading[repo] = l
+	}
+	c.used[repo]++
+	c.mu.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+	mirror := filepath.Join(c.dir, filepath.FromSlash(repo)+".git")
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err == nil {
+		now := time.Now()
+		os.Chtimes(mirror, now, now)
+		return nil
+	}
+	if err := c.materialize(repo, mirror); err != nil {
+		c.release(repo)
+		return err
+	}
+	c.evict()
+	return nil
+}
+
+// release mark repository mirror not used by request
+func (c *restoreCache) release(repo string) {
+	c.mu.Lock()
+	c.used[repo]--
+	c.mu.Unlock()
+}
+
+// materialize download repository bundles chain from source, decrypt
+// encrypted bundles, clone mirror from base bundle and fetch incremental
+// bundles to it in creation order
+func (c *restoreCache) materialize(repo, mirror string) error {
+	start := time.Now()
+	files, err := c.source.listFiles("")
+	if err != nil {
+		return err
+	}
+	chain := sourceChain(files, repo)
+	if len(chain) == 0 {
+		return fmt.Errorf("bundle is not found in %s", c.source)
+	}
+
+	bundles := mirror + ".bundles.tmp"
+	tmp := mirror + ".tmp"
+	defer os.RemoveAll(bundles)
+	os.RemoveAll(tmp)
+	for i, file := range chain {
+		bundle := filepath.Join(bundles, fmt.Sprintf("%d.bundle", i))
+		if isEncrypted(file) {
+			bundle += filepath.Ext(file)
+		}
+		err = getFile(c.source, file, bundle)
+		if err == nil && isEncrypted(bundle) {
+			bundle, err = decryptFile(bundle)
+		}
+		switch {
+		case err != nil:
+		case i == 0:
+			err = run("git", "clone", "-q", "--mirror", bundle, tmp)
+		default:
+			err = run("git", "-C", tmp, "fetch", "-q", bundle, "+refs/*:refs/*")
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := os.Rename(tmp, mirror); err != nil {
+		return err
+	}
+	logInfo(fmt.Sprintf("%s: materialized in %s", repo,
+		time.Since(start).Round(time.Millisecond)),
+		append(repoFields(repo), "duration", time.Since(start))...)
+	return nil
+}
+
+// sourceChain return source paths of repository base bundle and incremental
+// bundles sorted by creation time, or nil if there is no base bundle. The
+// bundles may be encrypted
+func sourceChain(files []string, repo string) (chain []string) {
+	var base string
+	var incs []string
+	for _, file := range files {
+		name := file
+		if isEncrypted(name) {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		if name == repo+".bundle" {
+			base = file
+			continue
+		}
+		if !strings.HasPrefix(name, repo+"-") ||
+			!strings.HasSuffix(name, ".inc.bundle") {
+			continue
+		}
+		t := strings.TrimSuffix(strings.TrimPrefix(name, repo+"-"),
+			".inc.bundle")
+		if _, err := time.Parse("20060102T150405", t); err == nil {
+			incs = append(incs, file)
+		}
+	}
+	if len(base) == 0 {
+		return nil
+	}
+	sort.Strings(incs)
+	return append([]string{base}, incs...)
+}
+
+// evict remove least recently used mirrors which are not used by requests
+// until cache size fits maximum size
+func (c *restoreCache) evict() {
+	type cached struct {
+		repo, mirror string
+		size         int64
+		atime        time.Time
+	}
+	var list []cached
+	var total int64
+	mirrors, _ := findMirrors(c.dir)
+	for _, m := range mirrors {
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(c.dir, m)
+		e := cached{strings.TrimSuffix(filepath.ToSlash(rel), ".git"), m,
+			dirSize(m), info.ModTime()}
+		total += e.size
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].atime.Before(list[j].atime)
+	})
+	for _, e := range list {
+		if total <= c.max {
+			return
+		}
+		c.mu.Lock()
+		used := c.used[e.repo] > 0
+		c.mu.Unlock()
+		if used {
+			continue
+		}
+		if err := os.RemoveAll(e.mirror); err != nil {
+			logError(fmt.Sprintf("%s: can't evict: %s", e.repo, err),
+				append(repoFields(e.repo), "error", err)...)
+			continue
+		}
+		total -= e.size
+		logInfo(fmt.Sprintf("%s: evicted from cache, %s", e.repo,
+			formatSize(e.size)), append(repoFields(e.repo), "size", e.size)...)
+	}
+}
+
+// getFile download file path from storage to local file
+func getFile(d destination, path, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	switch d := d.(type) {
+	case localDest:
+		return localDest(filepath.Dir(local)).putFile(
+			filepath.Join(string(d), filepath.FromSlash(path)),
+			filepath.Base(local))
+	case *s3Dest:
+		return run("aws", "s3", "cp", "--only-show-errors", d.url(path), local)
+	case *gcsDest:
+		return run("gcloud", "storage", "cp", "--quiet", d.url(path), local)
+	case *azureDest:
+		return run("az", "storage", "blob", "download", "--only-show-errors",
+			"--account-name", d.account, "--container-name", d.container,
+			"--name", joinPath(d.prefix, path), "--file", local)
+	}
+	return fmt.Errorf("serving from %s is not supported", d)
+}
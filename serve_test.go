@@ -0,0 +1,127 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSourceChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		chain []string
+	}{
+		{"base", []string{"octo/alpha.bundle", "octo/alpha.bundle.refs"},
+			[]string{"octo/alpha.bundle"}},
+		{"chain", []string{
+			"octo/alpha-20240102T000000.inc.bundle",
+			"octo/alpha.bundle",
+			"octo/alpha-20240101T000000.inc.bundle",
+			"octo/alpha-beta.bundle",
+			"octo/alpha-beta-20240101T000000.inc.bundle",
+			"octo/alpha.wiki-20240101T000000.inc.bundle",
+		}, []string{"octo/alpha.bundle",
+			"octo/alpha-20240101T000000.inc.bundle",
+			"octo/alpha-20240102T000000.inc.bundle"}},
+		{"encrypted", []string{"octo/alpha.bundle.age",
+			"octo/alpha-20240101T000000.inc.bundle.age"},
+			[]string{"octo/alpha.bundle.age",
+				"octo/alpha-20240101T000000.inc.bundle.age"}},
+		{"no base", []string{"octo/alpha-20240101T000000.inc.bundle",
+			"octo/alpha.tar.gz"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := sourceChain(tt.files, "octo/alpha")
+			if !reflect.DeepEqual(chain, tt.chain) {
+				t.Errorf("chain %v, expected %v", chain, tt.chain)
+			}
+		})
+	}
+}
+
+// newGPGKey generate gpg key without passphrase in temporary gpg home and
+// return its email, the test is skipped if gpg is not installed
+func newGPGKey(t *testing.T) string {
+	t.Helper()
+	home, err := os.MkdirTemp("", "gpg-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		run("gpgconf", "--kill", "gpg-agent")
+		os.RemoveAll(home)
+	})
+	t.Setenv("GNUPGHOME", home)
+	const email = "backup@example.com"
+	if err := run("gpg", "--batch", "--quiet", "--passphrase", "",
+		"--quick-gen-key", email, "default", "default", "never"); err != nil {
+		t.Skip("gpg key can't be generated:", err)
+	}
+	return email
+}
+
+func TestMaterialize(t *testing.T) {
+	m := newTestGitHub(t)
+	defer func(r []string) { encryptRecipients = r }(encryptRecipients)
+
+	tests := []struct {
+		name    string
+		updates int  // Commits pushed between runs
+		encrypt bool // Bundles are encrypted with gpg
+	}{
+		{"base", 0, false},
+		{"chain", 1, false},
+		{"encrypted chain", 1, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryptRecipients = nil
+			if tt.encrypt {
+				encryptRecipients = []string{newGPGKey(t)}
+			}
+			const repo = "octo/alpha"
+			source := t.TempDir()
+			mirrorRemote(t, m, repo, source, repo)
+			for n := 0; n <= tt.updates; n++ {
+				if n > 0 {
+					if err := m.addCommit(repo, fmt.Sprintf("update%d.txt", i)); err != nil {
+						t.Fatal(err)
+					}
+					if err := run("git", "-C", filepath.Join(source,
+						repo+".git"), "fetch", "-q", "--prune",
+						"origin"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				name, err := bundleIncrement(source, repo+".git", repo)
+				if err == nil {
+					_, err = encryptFile(source, name)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dir := t.TempDir()
+			c := &restoreCache{dir: dir, source: localDest(source),
+				used: map[string]int{}, loading: map[string]*sync.Mutex{}}
+			mirror := filepath.Join(dir, repo+".git")
+			if err := c.materialize(repo, mirror); err != nil {
+				t.Fatal(err)
+			}
+			if tip := headTip(mirror); tip != m.remoteTip(repo) {
+				t.Errorf("materialized tip %s, expected %s", tip,
+					m.remoteTip(repo))
+			}
+		})
+	}
+}
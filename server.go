@@ -0,0 +1,306 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kirill-scherba/github-backup/client"
+)
+
+// backupServer is central backup server: runs backups with configured
+// parameters triggered by orchestration api requests and keeps runs logs
+// and reports
+type backupServer struct {
+	args    []string // Backup parameters
+	output  string   // Backup output folder
+	runsDir string   // Runs logs and reports folder
+	token   string   // Api token
+
+	mu      sync.Mutex
+	runs    []*client.Run // Runs newest first
+	current *client.Run
+}
+
+// serverCmd is 'server' command: start orchestration api server running
+// backup with parameters after -- when run is triggered by api request
+func serverCmd(args []string) {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8090", "api listen address, use :8090 to listen on all interfaces")
+	token := fs.String("token", os.Getenv("GITHUB_BACKUP_API_TOKEN"), "api bearer token, default: GITHUB_BACKUP_API_TOKEN environment variable")
+	insecure := fs.Bool("insecure", false, "serve api without token, anyone reaching listen address may trigger backups")
+	runsDir := fs.String("runs", "server-runs", "folder of runs logs and reports")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup server [-listen addr] [-token token | -insecure] [-runs folder] -- backup parameters")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*token) == 0 && !*insecure {
+		fmt.Fprintln(fs.Output(), "api token is not set, set -token or GITHUB_BACKUP_API_TOKEN, or -insecure to serve api without authorization")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s := &backupServer{args: fs.Args(), output: backupParam(fs.Args(), "output"),
+		runsDir: *runsDir, token: *token}
+	if len(s.output) == 0 {
+		s.output = "repos"
+	}
+	if err := s.loadRuns(); err != nil {
+		logFatal(err)
+	}
+	metrics.seed(s.output)
+	if len(s.token) == 0 {
+		logWarn("-insecure is set, the api is not protected")
+	}
+	logInfo("backup server api on "+*listen, "listen", *listen)
+	logFatal(http.ListenAndServe(*listen, s))
+}
+
+// loadRuns load runs saved in runs folder. Runs interrupted by server stop
+// are marked failed
+func (s *backupServer) loadRuns() error {
+	if err := os.MkdirAll(s.runsDir, 0755); err != nil {
+		return err
+	}
+	names, _ := filepath.Glob(filepath.Join(s.runsDir, "*", "run.json"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		r := &client.Run{}
+		if json.Unmarshal(data, r) != nil {
+			continue
+		}
+		if r.Status == client.StatusRunning {
+			r.Status, r.ExitCode = client.StatusFailed, -1
+		}
+		s.runs = append(s.runs, r)
+	}
+	sort.Slice(s.runs, func(i, j int) bool {
+		return s.runs[i].Start.After(s.runs[j].Start)
+	})
+	return nil
+}
+
+// ServeHTTP serve orchestration api requests:
+//
+//	GET  /api/v1/status            - server status
+//	POST /api/v1/runs              - trigger run, body: {"users":"","limit":""}
+//	GET  /api/v1/runs              - runs list
+//	GET  /api/v1/runs/{id}         - run
+//	GET  /api/v1/runs/{id}/log     - run log
+//	GET  /api/v1/runs/{id}/report  - run json report
+//	GET  /api/v1/runs/{id}/manifest - run manifest
+//	GET  /metrics                  - Prometheus metrics
+func (s *backupServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.token) != 0 && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/metrics" && r.Method == http.MethodGet {
+		metrics.ServeHTTP(w, r)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "status" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		st := client.Status{Running: s.current != nil, Current: s.current}
+		for _, run := range s.runs {
+			if run.Status != client.StatusRunning {
+				st.Last = run
+				break
+			}
+		}
+		serveJSON(w, st)
+		s.mu.Unlock()
+	case path == "runs" && r.Method == http.MethodPost:
+		var opts client.TriggerOptions
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		run, err := s.trigger(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		serveJSON(w, run)
+	case path == "runs" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		serveJSON(w, s.runs)
+		s.mu.Unlock()
+	case parts[0] == "runs" && len(parts) <= 3 && r.Method == http.MethodGet:
+		run := s.run(parts[1])
+		if run == nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			s.mu.Lock()
+			serveJSON(w, run)
+			s.mu.Unlock()
+		case parts[2] == "log":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, filepath.Join(s.runsDir, run.ID, "run.log"))
+		case parts[2] == "report":
+			w.Header().Set("Content-Type", "application/json")
+			http.ServeFile(w, r, filepath.Join(s.runsDir, run.ID, "report.json"))
+		case parts[2] == "manifest":
+			w.Header().Set("Content-Type", "application/json")
+			http.ServeFile(w, r, filepath.Join(s.runsDir, run.ID, manifestName))
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveJSON write json response
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// run return run by id or nil if not found
+func (s *backupServer) run(id string) *client.Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.runs {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// trigger start backup run with options overriding backup parameters
+func (s *backupServer) trigger(opts client.TriggerOptions) (client.Run,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		return client.Run{}, errors.New("backup is already running: " +
+			s.current.ID)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return client.Run{}, err
+	}
+	start := time.Now().UTC()
+	run := &client.Run{ID: start.Format("20060102T150405.000"),
+		Start: start, Status: client.StatusRunning,
+		Users: opts.Users, Limit: opts.Limit}
+
+	// Run id has millisecond resolution, counter suffix is added if run
+	// folder with the same id exists (e.g. system clock was set back)
+	dir := filepath.Join(s.runsDir, run.ID)
+	for i := 2; ; i++ {
+		err = os.Mkdir(dir, 0755)
+		if !os.IsExist(err) {
+			break
+		}
+		run.ID = fmt.Sprintf("%s-%d", start.Format("20060102T150405.000"), i)
+		dir = filepath.Join(s.runsDir, run.ID)
+	}
+	if err != nil {
+		return client.Run{}, err
+	}
+	logFile, err := os.Create(filepath.Join(dir, "run.log"))
+	if err != nil {
+		return client.Run{}, err
+	}
+
+	// Later parameters override server backup parameters
+	args := append([]string{}, s.args...)
+	if len(opts.Users) != 0 {
+		args = append(args, "-users="+opts.Users)
+	}
+	if len(opts.Limit) != 0 {
+		args = append(args, "-limit="+opts.Limit)
+	}
+
+	// The run json report is written to run folder, or copied there when
+	// report file is set in server backup parameters
+	report := backupParam(args, "report")
+	if len(report) == 0 {
+		args = append(args, "-report="+filepath.Join(dir, "report.json"))
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return client.Run{}, err
+	}
+	s.current = run
+	metrics.runStarted()
+	s.runs = append([]*client.Run{run}, s.runs...)
+	s.saveRun(run)
+	logInfo(fmt.Sprintf("run %s started", run.ID), "run", run.ID)
+
+	go func() {
+		err := cmd.Wait()
+		logFile.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		run.End, run.Status = time.Now().UTC(), client.StatusSuccess
+		if err != nil {
+			run.Status, run.ExitCode = client.StatusFailed, -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				run.ExitCode = exitErr.ExitCode()
+			}
+		}
+		metrics.runFinished(s.output, run.Start, err == nil)
+		cur, _ := manifestFiles(s.output)
+		copyRunFile(cur, filepath.Join(dir, manifestName))
+		if len(report) != 0 {
+			copyRunFile(report, filepath.Join(dir, "report.json"))
+		}
+		s.saveRun(run)
+		s.current = nil
+		logInfo(fmt.Sprintf("run %s finished: %s", run.ID, run.Status),
+			"run", run.ID, "status", run.Status, "exit_code", run.ExitCode)
+	}()
+	return *run, nil
+}
+
+// copyRunFile copy backup output file to run folder if it exists
+func copyRunFile(src, dst string) {
+	if data, err := os.ReadFile(src); err == nil {
+		os.WriteFile(dst, data, 0644)
+	}
+}
+
+// saveRun save run to runs folder
+func (s *backupServer) saveRun(run *client.Run) {
+	data, _ := json.MarshalIndent(run, "", "  ")
+	err := os.WriteFile(filepath.Join(s.runsDir, run.ID, "run.json"),
+		append(data, '\n'), 0644)
+	if err != nil {
+		logError("save run", "run", run.ID, "error", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// smtpNotifier send notifications by email with SMTP server
+type smtpNotifier struct {
+	addr      string // Server host:port
+	implicit  bool   // TLS connection (smtps), STARTTLS is used otherwise
+	user      string
+	password  string
+	from      string
+	to        []string
+	onFailure bool // Send failure and warning notifications only
+}
+
+// newSMTPNotifier create SMTP notifier from url:
+//
+//	smtp[s]://[user[:password]@]host[:port]?from=addr&to=addr,addr&policy=always|on-failure
+//
+// The smtp scheme uses STARTTLS on port 587 by default, smtps uses TLS on port
+// 465. If password is not set in url it's read from GITHUB_BACKUP_SMTP_PASSWORD
+// environment variable, so it is not visible in process list
+func newSMTPNotifier(u *url.URL) (*smtpNotifier, error) {
+	q := u.Query()
+	n := &smtpNotifier{addr: u.Host, implicit: u.Scheme == "smtps",
+		from: q.Get("from")}
+	if len(u.Port()) == 0 {
+		port := "587"
+		if n.implicit {
+			port = "465"
+		}
+		n.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		n.user = u.User.Username()
+		var ok bool
+		if n.password, ok = u.User.Password(); !ok {
+			n.password = os.Getenv("GITHUB_BACKUP_SMTP_PASSWORD")
+		}
+	}
+	for _, to := range strings.Split(q.Get("to"), ",") {
+		if to = strings.TrimSpace(to); len(to) != 0 {
+			n.to = append(n.to, to)
+		}
+	}
+	switch q.Get("policy") {
+	case "", "always":
+	case "on-failure":
+		n.onFailure = true
+	default:
+		return nil, fmt.Errorf("wrong smtp notification policy '%s', should "+
+			"be always or on-failure", q.Get("policy"))
+	}
+	if len(n.to) == 0 {
+		return nil, fmt.Errorf("smtp notification recipients are not set: " +
+			"add to=addr to url")
+	}
+	if len(n.from) == 0 {
+		if len(n.user) != 0 && strings.Contains(n.user, "@") {
+			n.from = n.user
+		} else {
+			n.from = "github-backup@" + hostname()
+		}
+	}
+	return n, nil
+}
+
+func (n *smtpNotifier) notify(nt notification) error {
+	if n.onFailure && (nt.Type == notifySuccess || nt.Type == notifyInfo) {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(n.addr)
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if n.implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.addr,
+			&tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", n.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp %s: %w", n.addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp %s: %w", n.addr, err)
+	}
+	defer c.Close()
+	if err = n.send(c, host, nt); err != nil {
+		return fmt.Errorf("smtp %s: %w", n.addr, err)
+	}
+	return c.Quit()
+}
+
+// send send notification email with connected SMTP client
+func (n *smtpNotifier) send(c *smtp.Client, host string, nt notification) error {
+	if ok, _ := c.Extension("STARTTLS"); ok && !n.implicit {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if len(n.user) != 0 {
+		if err := c.Auth(smtp.PlainAuth("", n.user, n.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(n.message(nt)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// message return email message of notification: subject is notification
+// title with host name and plain text body
+func (n *smtpNotifier) message(nt notification) []byte {
+	var b strings.Builder
+	subject := fmt.Sprintf("[github-backup] %s (%s)", nt.Title, hostname())
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&b, "X-Github-Backup-Status: %s\r\n\r\n", nt.Type)
+	body := strings.ReplaceAll(nt.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,237 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotLayout is time layout of snapshot folder name
+const snapshotLayout = "2006-01-02T15:04"
+
+// Snapshot mode parameters: snapshot flag and retention policy. The
+// snapshotName is current run snapshot folder name, empty if snapshot mode is
+// off
+var snapshot bool
+var snapshotName string
+var keepDaily, keepWeekly, keepMonthly int
+
+// Hardlink deduplication flag set by -hardlink parameter, and previous
+// snapshot folder name to link unchanged files against
+var hardlink bool
+var prevSnapshot string
+
+// startSnapshot set current snapshot folder name and find previous snapshot
+func startSnapshot(output string) {
+	snapshotName = time.Now().Format(snapshotLayout)
+	if snapshots, _ := listSnapshots(output); len(snapshots) != 0 &&
+		snapshots[0].Name != snapshotName {
+		prevSnapshot = snapshots[0].Name
+	}
+}
+
+// resumeSnapshot continue writing to snapshot folder of interrupted run
+func resumeSnapshot(output, name string) {
+	snapshotName, prevSnapshot = name, ""
+	snapshots, _ := listSnapshots(output)
+	for _, s := range snapshots {
+		if s.Name < name {
+			prevSnapshot = s.Name
+			break
+		}
+	}
+}
+
+// snapshotPath return path of repository relative to the output folder with
+// snapshot folder prefix in snapshot mode
+func snapshotPath(path string) string {
+	if len(snapshotName) == 0 {
+		return path
+	}
+	return snapshotName + "/" + path
+}
+
+// linkSnapshot replace object files of mirrors (paths relative to output
+// folder) which are unchanged since previous snapshot with hardlinks to files
+// of previous snapshot. Loose objects and pack files are immutable and named
+// by their content hash, so files with the same name and size are the same.
+// Other files of objects folder (info/packs, info/alternates, commit-graph,
+// multi-pack-index) are rewritten in place and are never linked. Returns
+// number of linked files and saved bytes
+func linkSnapshot(output string, paths []string) (n int, saved int64,
+	err error) {
+
+	if len(prevSnapshot) == 0 {
+		return
+	}
+	for _, path := range paths {
+		rel := strings.TrimPrefix(path, snapshotName+"/")
+		if rel == path || !strings.HasSuffix(path, ".git") {
+			continue
+		}
+		objects := filepath.Join(output, path, "objects")
+		prevObjects := filepath.Join(output, prevSnapshot, rel, "objects")
+		err = filepath.Walk(objects, func(p string, info os.FileInfo,
+			err error) error {
+
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			name, err := filepath.Rel(objects, p)
+			if err != nil || !immutableObject(name) {
+				return err
+			}
+			prev := filepath.Join(prevObjects, name)
+			prevInfo, err := os.Stat(prev)
+			if err != nil || prevInfo.Size() != info.Size() ||
+				os.SameFile(info, prevInfo) {
+				return nil
+			}
+
+			// Replace file with hardlink
+			tmp := p + ".link"
+			if err := os.Link(prev, tmp); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, p); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+			n++
+			saved += info.Size()
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// immutableObject return true if file of objects folder (path relative to
+// the folder) is named by its content hash: loose object ??/<hash> or pack
+// file pack/pack-<hash>.pack, .idx or .rev
+func immutableObject(name string) bool {
+	dir, file := path.Split(filepath.ToSlash(name))
+	switch {
+	case len(dir) == 3 && isHex(dir[:2]):
+		return isHex(file)
+	case dir == "pack/":
+		ext := filepath.Ext(file)
+		if ext != ".pack" && ext != ".idx" && ext != ".rev" {
+			return false
+		}
+		hash := strings.TrimSuffix(file, ext)
+		return strings.HasPrefix(hash, "pack-") &&
+			isHex(strings.TrimPrefix(hash, "pack-"))
+	}
+	return false
+}
+
+// isHex return true if s is not empty lowercase hex string
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return len(s) != 0
+}
+
+// snapshotInfo is snapshot folder name and time
+type snapshotInfo struct {
+	Name string
+	Time time.Time
+}
+
+// listSnapshots return snapshots in output folder sorted by time, newest first
+func listSnapshots(output string) (snapshots []snapshotInfo, err error) {
+	entries, err := os.ReadDir(output)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		t, err := time.ParseInLocation(snapshotLayout, e.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshotInfo{e.Name(), t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return
+}
+
+// pruneSnapshots remove snapshots not retained by keep-daily, keep-weekly and
+// keep-monthly policy. The newest snapshot of each of last N days, weeks and
+// months is retained, and the newest snapshot is always retained
+func pruneSnapshots(output string) error {
+	if keepDaily <= 0 && keepWeekly <= 0 && keepMonthly <= 0 {
+		return nil
+	}
+	snapshots, err := listSnapshots(output)
+	if err != nil {
+		return err
+	}
+
+	keep := retainSnapshots(snapshots)
+	for _, s := range snapshots {
+		if keep[s.Name] {
+			continue
+		}
+		logInfo("prune snapshot: "+s.Name, "snapshot", s.Name)
+		if err := os.RemoveAll(filepath.Join(output, s.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retainSnapshots return names of snapshots retained by policy. Snapshots
+// should be sorted newest first
+func retainSnapshots(snapshots []snapshotInfo) (keep map[string]bool) {
+	keep = map[string]bool{}
+	if len(snapshots) == 0 {
+		return
+	}
+	keep[snapshots[0].Name] = true
+
+	policies := []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{keepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{keepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{keepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range policies {
+		periods := map[string]bool{}
+		for _, s := range snapshots {
+			if len(periods) >= p.n {
+				break
+			}
+			period := p.period(s.Time)
+			if periods[period] {
+				continue
+			}
+			periods[period] = true
+			keep[s.Name] = true
+		}
+	}
+	return
+}
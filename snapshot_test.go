@@ -0,0 +1,87 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImmutableObject(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ab/" + hash[2:], true},
+		{"pack/pack-" + hash + ".pack", true},
+		{"pack/pack-" + hash + ".idx", true},
+		{"pack/pack-" + hash + ".rev", true},
+		{"pack/pack-" + hash + ".keep", false},
+		{"pack/pack-" + hash + ".mtimes", false},
+		{"pack/multi-pack-index", false},
+		{"info/packs", false},
+		{"info/alternates", false},
+		{"info/commit-graph", false},
+		{"info/commit-graphs/commit-graph-chain", false},
+		{"ab/tmp_obj_123", false},
+		{"AB/" + hash[2:], false},
+	}
+	for _, tt := range tests {
+		if got := immutableObject(filepath.FromSlash(tt.name)); got != tt.want {
+			t.Errorf("immutableObject(%s) = %v, expected %v", tt.name, got,
+				tt.want)
+		}
+	}
+}
+
+func TestLinkSnapshot(t *testing.T) {
+	defer func(name, prev string) {
+		snapshotName, prevSnapshot = name, prev
+	}(snapshotName, prevSnapshot)
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	files := map[string]bool{ // Object files and if they should be linked
+		"ab/" + hash[2:]:              true,
+		"pack/pack-" + hash + ".pack": true,
+		"pack/pack-" + hash + ".idx":  true,
+		"info/packs":                  false,
+		"info/commit-graph":           false,
+		"pack/multi-pack-index":       false,
+	}
+	output := t.TempDir()
+	prevSnapshot, snapshotName = "2022-01-01T10:00", "2022-01-02T10:00"
+	for _, s := range []string{prevSnapshot, snapshotName} {
+		for file := range files {
+			writeFiles(t, output, s+"/o/a.git/objects/"+file)
+		}
+	}
+
+	n, _, err := linkSnapshot(output, []string{snapshotName + "/o/a.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linked int
+	for file, link := range files {
+		rel := filepath.FromSlash("/o/a.git/objects/" + file)
+		info, err := os.Stat(filepath.Join(output, snapshotName+rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev, err := os.Stat(filepath.Join(output, prevSnapshot+rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(info, prev) != link {
+			t.Errorf("%s: linked %v, expected %v", file, !link, link)
+		}
+		if link {
+			linked++
+		}
+	}
+	if n != linked {
+		t.Errorf("%d files linked, %d expected", n, linked)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export stargazers and watchers flag set by -stargazers parameter
+var stargazers bool
+
+// communityExport is repository stargazers and watchers export written to
+// owner/repo.stargazers.json file
+type communityExport struct {
+	Stargazers []stargazer `json:"stargazers"`
+	Watchers   []string    `json:"watchers"` // Watchers logins
+}
+
+// stargazer is login of user starred repository with star time
+type stargazer struct {
+	Login     string    `json:"login"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// stargazersStage save repository stargazers with star time and watchers
+// logins with GraphQL api to owner/repo.stargazers.json file
+func stargazersStage(j *pipelineJob) error {
+	owner, name, _ := strings.Cut(j.repo, "/")
+	api := newAPIClient(j.acc.endpoint)
+	export := communityExport{Stargazers: []stargazer{}, Watchers: []string{}}
+	for _, conn := range []string{"stargazers", "watchers"} {
+		var cursor interface{}
+		for {
+			var data struct {
+				Repository map[string]struct {
+					PageInfo graphqlPageInfo `json:"pageInfo"`
+					Edges    []struct {
+						StarredAt time.Time `json:"starredAt"`
+						Node      struct {
+							Login string `json:"login"`
+						} `json:"node"`
+					} `json:"edges"`
+				} `json:"repository"`
+			}
+			starred := ""
+			if conn == "stargazers" {
+				starred = "starredAt "
+			}
+			err := api.graphql(`query($owner: String!, $name: String!, `+
+				`$cursor: String) { repository(owner: $owner, name: $name) `+
+				`{ `+conn+`(first: 100, after: $cursor) { pageInfo { `+
+				`hasNextPage endCursor } edges { `+starred+`node { login } `+
+				`} } } }`, map[string]interface{}{"owner": owner,
+				"name": name, "cursor": cursor}, &data)
+			if err != nil {
+				return err
+			}
+			page := data.Repository[conn]
+			for _, e := range page.Edges {
+				if conn == "stargazers" {
+					export.Stargazers = append(export.Stargazers,
+						stargazer{Login: e.Node.Login, StarredAt: e.StarredAt})
+					continue
+				}
+				export.Watchers = append(export.Watchers, e.Node.Login)
+			}
+			if !page.PageInfo.HasNextPage {
+				break
+			}
+			cursor = page.PageInfo.EndCursor
+		}
+	}
+
+	file := j.path + ".stargazers.json"
+	if err := writeJSON(filepath.Join(j.dir, file), export); err != nil {
+		return err
+	}
+	j.addPrivate(file)
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// backupState is state of backups saved between runs
+type backupState struct {
+	LastRun time.Time               `json:"last_run"` // Last run start time
+	Repos   map[string]time.Time    `json:"repos"`    // Last successful backup by repository path
+	Caps    map[string]*repoCaps    `json:"capabilities,omitempty"`
+	Blocked map[string]*blockedRepo `json:"blocked,omitempty"` // Repositories blocked by github
+}
+
+// State of backups loaded at start of run and run start time
+var state = &backupState{Repos: map[string]time.Time{},
+	Caps: map[string]*repoCaps{}, Blocked: map[string]*blockedRepo{}}
+var runStart = time.Now()
+
+// Catch-up parameters: expected interval between scheduled runs, pause
+// between repositories in catch-up mode, and catch-up mode flag set when
+// scheduled runs were missed
+var catchUp time.Duration
+var catchUpDelay time.Duration
+var catchingUp bool
+
+// stateFile return backup state file name in output folder
+func stateFile(output string) string {
+	return filepath.Join(output, ".github-backup", "state.json")
+}
+
+// loadState load backup state from output folder
+func loadState(output string) error {
+	data, err := os.ReadFile(stateFile(output))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+	if state.Repos == nil {
+		state.Repos = map[string]time.Time{}
+	}
+	if state.Caps == nil {
+		state.Caps = map[string]*repoCaps{}
+	}
+	if state.Blocked == nil {
+		state.Blocked = map[string]*blockedRepo{}
+	}
+	return nil
+}
+
+// saveState save backup state with this run start time to output folder
+func saveState(output string) error {
+	state.LastRun = runStart
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := stateFile(output)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// startCatchUp switch on catch-up mode if scheduled runs were missed since
+// the last run, e.g. the host was off for days
+func startCatchUp() {
+	if catchUp <= 0 || state.LastRun.IsZero() {
+		return
+	}
+	since := runStart.Sub(state.LastRun)
+	missed := int((since+catchUp/2)/catchUp) - 1
+	if missed <= 0 {
+		return
+	}
+	catchingUp = true
+	logInfo(fmt.Sprintf("catch-up: %d scheduled runs missed since %s, backup "+
+		"stalest repositories first", missed,
+		state.LastRun.Format(time.RFC3339)), "missed", missed)
+}
+
+// sortStalest sort repositories of account by last successful backup time,
+// never backed up repositories first
+func sortStalest(acc account, repos []string) {
+	sort.SliceStable(repos, func(i, j int) bool {
+		return state.Repos[acc.path(repos[i])].Before(
+			state.Repos[acc.path(repos[j])])
+	})
+}
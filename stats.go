@@ -0,0 +1,224 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// repoAttr is repository attributes got from repositories listing
+type repoAttr struct {
+	Visibility string // public, private or internal
+	Fork       bool
+	Archived   bool
+}
+
+// Attributes of repositories listed in this run by repository path
+var repoAttrs = map[string]repoAttr{}
+
+// setRepoAttr save listed repository attributes
+func setRepoAttr(acc account, repo, visibility string, fork, archived bool) {
+	repoAttrs[acc.path(repo)] = repoAttr{strings.ToLower(visibility), fork,
+		archived}
+}
+
+// backupStats is backup size and composition report
+type backupStats struct {
+	DiskSize   int64          `json:"disk_size"` // Output folder size
+	Repos      int            `json:"repos"`
+	Size       int64          `json:"size"` // Last run backup files size
+	Visibility map[string]int `json:"visibility"`
+	Forks      int            `json:"forks"`
+	Archived   int            `json:"archived"`
+	Growth     *int64         `json:"growth,omitempty"` // Since previous run
+	NewRepos   int            `json:"new_repos"`
+	Removed    int            `json:"removed_repos"`
+	Owners     []sizeStat     `json:"owners"`
+	RepoSizes  []sizeStat     `json:"repo_sizes"`
+}
+
+// sizeStat is size of owner or repository
+type sizeStat struct {
+	Name   string `json:"name"`
+	Repos  int    `json:"repos,omitempty"`
+	Size   int64  `json:"size"`
+	Growth *int64 `json:"growth,omitempty"`
+}
+
+// statsCmd is 'stats' command: report on-disk size, per-owner and per-repo
+// sizes, repositories counts by visibility, fork and archived status and
+// growth since the previous run from run manifests
+func statsCmd(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	top := fs.Int("top", 20, "number of largest repositories to print, 0 - all")
+	jsonOut := fs.Bool("json", false, "print report in json format")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup stats [-output folder] [-top n] [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cur, prev := manifestFiles(*output)
+	m, err := readManifest(cur)
+	if err != nil {
+		logFatal("can't read run manifest: ", err)
+	}
+	var pm *runManifest
+	if p, err := readManifest(prev); err == nil {
+		pm = &p
+	}
+	st := getStats(m, pm)
+	st.DiskSize = dirSize(*output)
+	if *top > 0 && len(st.RepoSizes) > *top {
+		st.RepoSizes = st.RepoSizes[:*top]
+	}
+
+	if *jsonOut {
+		data, _ := json.MarshalIndent(st, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Printf("On-disk size:  %s\n", formatSize(st.DiskSize))
+	fmt.Printf("Last run:      %s, %d repositories, %s\n",
+		m.Start.Format("2006-01-02 15:04:05"), st.Repos, formatSize(st.Size))
+	var vis []string
+	for v, n := range st.Visibility {
+		vis = append(vis, fmt.Sprintf("%s %d", v, n))
+	}
+	sort.Strings(vis)
+	fmt.Printf("Visibility:    %s\n", strings.Join(vis, ", "))
+	fmt.Printf("Forks:         %d, archived: %d\n", st.Forks, st.Archived)
+	if st.Growth != nil {
+		fmt.Printf("Growth:        %s since %s, %d new, %d removed repositories\n",
+			formatGrowth(*st.Growth), pm.Start.Format("2006-01-02 15:04:05"),
+			st.NewRepos, st.Removed)
+	}
+
+	fmt.Printf("\n%-40s %6s %10s\n", "OWNER", "REPOS", "SIZE")
+	for _, o := range st.Owners {
+		fmt.Printf("%-40s %6d %10s\n", o.Name, o.Repos, formatSize(o.Size))
+	}
+	fmt.Printf("\n%-50s %10s %10s\n", "REPOSITORY", "SIZE", "GROWTH")
+	for _, r := range st.RepoSizes {
+		growth := "-"
+		if r.Growth != nil {
+			growth = formatGrowth(*r.Growth)
+		}
+		fmt.Printf("%-50s %10s %10s\n", r.Name, formatSize(r.Size), growth)
+	}
+}
+
+// manifestFiles return current and previous run manifest files names: the
+// manifests of two newest snapshots in snapshot mode, or manifest of output
+// folder and saved previous manifest
+func manifestFiles(output string) (cur, prev string) {
+	var names []string
+	snapshots, _ := listSnapshots(output)
+	for _, s := range snapshots {
+		name := filepath.Join(output, s.Name, manifestName)
+		if _, err := os.Stat(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return filepath.Join(output, manifestName), prevManifestFile(output)
+	}
+	cur = names[0]
+	if len(names) > 1 {
+		prev = names[1]
+	}
+	return
+}
+
+// getStats return stats of successfully backed up repositories of run
+// manifest with growth since previous run manifest if it is not nil
+func getStats(m runManifest, prev *runManifest) (st backupStats) {
+	st.Visibility = map[string]int{}
+	prevSizes := map[string]int64{}
+	if prev != nil {
+		for _, e := range prev.Repos {
+			if e.Status == "success" {
+				prevSizes[e.Repo] = e.Size
+			}
+		}
+	}
+
+	owners := map[string]*sizeStat{}
+	seen := map[string]bool{}
+	for _, e := range m.Repos {
+		if e.Status != "success" {
+			continue
+		}
+		seen[e.Repo] = true
+		st.Repos++
+		st.Size += e.Size
+		if len(e.Visibility) != 0 {
+			st.Visibility[e.Visibility]++
+		}
+		if e.Fork {
+			st.Forks++
+		}
+		if e.Archived {
+			st.Archived++
+		}
+
+		owner := path.Dir(e.Repo)
+		o, ok := owners[owner]
+		if !ok {
+			o = &sizeStat{Name: owner}
+			owners[owner] = o
+		}
+		o.Repos++
+		o.Size += e.Size
+
+		r := sizeStat{Name: e.Repo, Size: e.Size}
+		if prevSize, ok := prevSizes[e.Repo]; ok {
+			growth := e.Size - prevSize
+			r.Growth = &growth
+		} else if prev != nil {
+			st.NewRepos++
+		}
+		st.RepoSizes = append(st.RepoSizes, r)
+	}
+
+	if prev != nil {
+		var prevSize int64
+		for repo, size := range prevSizes {
+			prevSize += size
+			if !seen[repo] {
+				st.Removed++
+			}
+		}
+		growth := st.Size - prevSize
+		st.Growth = &growth
+	}
+
+	for _, o := range owners {
+		st.Owners = append(st.Owners, *o)
+	}
+	sort.Slice(st.Owners, func(i, j int) bool {
+		return st.Owners[i].Size > st.Owners[j].Size
+	})
+	sort.Slice(st.RepoSizes, func(i, j int) bool {
+		return st.RepoSizes[i].Size > st.RepoSizes[j].Size
+	})
+	return
+}
+
+// formatGrowth return human readable size growth with sign
+func formatGrowth(growth int64) string {
+	if growth < 0 {
+		return "-" + formatSize(-growth)
+	}
+	return "+" + formatSize(growth)
+}
@@ -0,0 +1,543 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// destination is storage where backup files are copied to after they are
+// created in the local output folder
+type destination interface {
+	// putFile copy local file to the path in destination
+	putFile(local, path string) error
+	// putDir copy local folder content recursively to the path in destination
+	putDir(local, path string) error
+	// String return destination url
+	String() string
+}
+
+// Destinations to copy backup files set by -dest parameter, output format
+// copied to each destination (empty - the first output format), and status
+// of copying to each destination
+var dests []destination
+var destFormats []string
+var destStats []destStatus
+
+// destStatus is status of copying repositories to destination
+type destStatus struct {
+	OK, Failed int
+	LastErr    error
+}
+
+// newDestinations create destinations from comma separated urls list. Each
+// url may be set with fallback url: primary|fallback, and with output format
+// copied to the destination: format:url, e.g. bundle:s3://bucket/prefix
+func newDestinations(list string) (err error) {
+	for _, rawurl := range strings.Split(list, ",") {
+		rawurl = strings.TrimSpace(rawurl)
+		if len(rawurl) == 0 {
+			continue
+		}
+		var f string
+		if prefix, rest, ok := strings.Cut(rawurl, ":"); ok {
+			switch prefix {
+			case formatMirror, formatArchive, formatBundle:
+				if !hasFormat(prefix) {
+					return fmt.Errorf("destination %s format '%s' is not "+
+						"selected by -format parameter", rest, prefix)
+				}
+				f, rawurl = prefix, rest
+			}
+		}
+		var d destination
+		if primary, fallback, ok := strings.Cut(rawurl, "|"); ok {
+			d, err = newFailoverDest(primary, fallback)
+		} else {
+			d, err = newDestination(rawurl)
+		}
+		if err != nil {
+			return err
+		}
+		dests = append(dests, d)
+		destFormats = append(destFormats, f)
+	}
+	destStats = make([]destStatus, len(dests))
+	return
+}
+
+// putDests copy local files and folders (paths relative to dir folder) to
+// all destinations concurrently. Destination paths are transformed by name
+// rules. Status of each destination is tracked
+// independently. Returns error if copying to any destination fails
+func putDests(dir string, files []string) error {
+	return putDestsFiles(dir, func(int) []string { return files })
+}
+
+// putOutputs copy files of output formats to destinations: each destination
+// gets files of its output format
+func putOutputs(dir string, outputs map[string][]string) error {
+	return putDestsFiles(dir, func(i int) []string {
+		if f := destFormats[i]; len(f) != 0 {
+			return outputs[f]
+		}
+		return outputs[format]
+	})
+}
+
+// putDestsFiles copy files returned by files function for each destination
+// to all destinations concurrently
+func putDestsFiles(dir string, files func(i int) []string) error {
+	errs := make([]error, len(dests))
+	var wg sync.WaitGroup
+	for i := range dests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, file := range files(i) {
+				chaosSlow()
+				local := filepath.Join(dir, file)
+				if info, err := os.Stat(local); err == nil && info.IsDir() {
+					errs[i] = dests[i].putDir(local, destPath(file))
+				} else {
+					errs[i] = dests[i].putFile(local, destPath(file))
+				}
+				if errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			destStats[i].Failed++
+			destStats[i].LastErr = err
+			failed = append(failed, fmt.Sprintf("%s: %s", dests[i], err))
+			continue
+		}
+		destStats[i].OK++
+	}
+	if len(failed) != 0 {
+		return errors.New(strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// destSummary return status of copying to each destination
+func destSummary() string {
+	var b strings.Builder
+	for i, d := range dests {
+		fmt.Fprintf(&b, "%s: %d copied, %d failed\n", d, destStats[i].OK,
+			destStats[i].Failed)
+	}
+	return b.String()
+}
+
+// newDestination create destination by url:
+//
+//	s3://bucket/prefix              - Amazon S3 bucket, use 'aws' cli
+//	gs://bucket/prefix              - Google Cloud Storage bucket, use 'gcloud' cli
+//	az://account/container/prefix   - Azure Blob Storage container, use 'az' cli
+//	sftp://user@host[:port]/path    - remote host folder, use 'sftp' cli
+//	webdav[s]://user@host/path      - WebDAV folder (Nextcloud, ownCloud)
+//	/path or file:///path           - local folder
+func newDestination(rawurl string) (destination, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		return localDest(u.Path), nil
+	case "s3":
+		return &s3Dest{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "gs":
+		return &gcsDest{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "az":
+		container, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+		if len(container) == 0 {
+			return nil, fmt.Errorf("container is not set in destination: %s", rawurl)
+		}
+		return &azureDest{account: u.Host, container: container, prefix: prefix}, nil
+	case "sftp":
+		host := u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		return &sftpDest{host: host, port: u.Port(),
+			dir: strings.TrimSuffix(u.Path, "/")}, nil
+	case "webdav", "webdavs":
+		return newWebDAVDest(u), nil
+	}
+	return nil, fmt.Errorf("unsupported destination: %s", rawurl)
+}
+
+// joinPath join destination prefix and path with slash
+func joinPath(prefix, path string) string {
+	if len(prefix) == 0 {
+		return path
+	}
+	return prefix + "/" + path
+}
+
+// dirPrefix return slash terminated key prefix of folder dir in prefix
+// folder, or empty prefix of root folder
+func dirPrefix(prefix, dir string) string {
+	if p := strings.Trim(joinPath(prefix, dir), "/"); len(p) != 0 {
+		return p + "/"
+	}
+	return ""
+}
+
+// localDest is local folder destination
+type localDest string
+
+func (d localDest) String() string { return string(d) }
+
+func (d localDest) putFile(local, path string) (err error) {
+	dst := filepath.Join(string(d), filepath.FromSlash(path))
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+	in, err := os.Open(local)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
+
+func (d localDest) putDir(local, path string) error {
+	err := walkFiles(local, func(file, rel string) error {
+		return d.putFile(file, joinPath(path, rel))
+	})
+	if err != nil {
+		return err
+	}
+	return removeStale(d, local, path)
+}
+
+// removeStale remove files of destination folder path which are not in local
+// folder, so folder is synced with deletion on every destination as 'aws s3
+// sync --delete' does. E.g. mirror packs removed by repack are removed
+func removeStale(d gcDest, local, path string) error {
+	keep := map[string]bool{}
+	err := walkFiles(local, func(file, rel string) error {
+		keep[joinPath(path, rel)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	files, err := d.listFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if keep[file] {
+			continue
+		}
+		if err := d.removeFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkFiles call fn for each file in local folder with slash separated path
+// relative to the folder
+func walkFiles(local string, fn func(file, rel string) error) error {
+	return filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		return fn(p, filepath.ToSlash(rel))
+	})
+}
+
+// s3Dest is Amazon S3 bucket destination. It use 'aws' cli application which
+// should be preinstalled and configured on the host
+type s3Dest struct {
+	bucket, prefix string
+}
+
+func (d *s3Dest) String() string { return "s3://" + joinPath(d.bucket, d.prefix) }
+
+func (d *s3Dest) url(path string) string {
+	return "s3://" + d.bucket + "/" + joinPath(d.prefix, path)
+}
+
+func (d *s3Dest) putFile(local, path string) error {
+	return run("aws", "s3", "cp", "--only-show-errors", local, d.url(path))
+}
+
+func (d *s3Dest) putDir(local, path string) error {
+	return run("aws", "s3", "sync", "--only-show-errors", "--delete", local,
+		d.url(path))
+}
+
+// gcsDest is Google Cloud Storage bucket destination. It use 'gcloud' cli
+// application, credentials are discovered by gcloud: application default
+// credentials, GOOGLE_APPLICATION_CREDENTIALS or metadata server
+type gcsDest struct {
+	bucket, prefix string
+}
+
+func (d *gcsDest) String() string { return "gs://" + joinPath(d.bucket, d.prefix) }
+
+func (d *gcsDest) url(path string) string {
+	return "gs://" + d.bucket + "/" + joinPath(d.prefix, path)
+}
+
+func (d *gcsDest) putFile(local, path string) error {
+	return run("gcloud", "storage", "cp", "--quiet", local, d.url(path))
+}
+
+func (d *gcsDest) putDir(local, path string) error {
+	return run("gcloud", "storage", "rsync", "--quiet", "--recursive",
+		"--delete-unmatched-destination-objects", local, d.url(path))
+}
+
+// azureDest is Azure Blob Storage container destination. It use 'az' cli
+// application, credentials are discovered by az: AZURE_STORAGE_KEY,
+// AZURE_STORAGE_CONNECTION_STRING, AZURE_STORAGE_SAS_TOKEN environment
+// variables or logged in account (set AZURE_STORAGE_AUTH_MODE=login)
+type azureDest struct {
+	account, container, prefix string
+}
+
+func (d *azureDest) String() string {
+	return "az://" + d.account + "/" + joinPath(d.container, d.prefix)
+}
+
+func (d *azureDest) putFile(local, path string) error {
+	return run("az", "storage", "blob", "upload", "--only-show-errors",
+		"--overwrite", "--account-name", d.account, "--container-name",
+		d.container, "--name", joinPath(d.prefix, path), "--file", local)
+}
+
+func (d *azureDest) putDir(local, path string) error {
+	err := run("az", "storage", "blob", "upload-batch", "--only-show-errors",
+		"--overwrite", "--account-name", d.account, "--destination",
+		d.container, "--destination-path", joinPath(d.prefix, path),
+		"--source", local)
+	if err != nil {
+		return err
+	}
+	return removeStale(d, local, path)
+}
+
+// sftpDest is remote host folder destination. It use 'sftp' cli application
+// in batch mode, so ssh key authentication to the host should be configured.
+// Files are streamed to remote host by sftp without local copies
+type sftpDest struct {
+	host, port, dir string
+}
+
+func (d *sftpDest) String() string { return "sftp://" + d.host + d.dir }
+
+// batch execute sftp commands, commands started with '-' may fail
+func (d *sftpDest) batch(cmds []string) error {
+	args := []string{"-q", "-b", "-"}
+	if len(d.port) != 0 {
+		args = append(args, "-P", d.port)
+	}
+	args = append(args, d.host)
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(cmds, "\n") + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sftp %s: %s\n%s", d.host, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mkdirs return sftp commands to create remote folder and its parents
+func (d *sftpDest) mkdirs(dir string) (cmds []string) {
+	p := ""
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		p += "/" + name
+		cmds = append(cmds, "-mkdir "+sftpQuote(p))
+	}
+	return
+}
+
+func (d *sftpDest) putFile(local, path string) error {
+	remote := d.dir + "/" + path
+	cmds := d.mkdirs(remote[:strings.LastIndex(remote, "/")])
+	cmds = append(cmds, "put "+sftpQuote(local)+" "+sftpQuote(remote))
+	return d.batch(cmds)
+}
+
+func (d *sftpDest) putDir(local, path string) error {
+	remote := d.dir + "/" + path
+	cmds := d.mkdirs(remote)
+	cmds = append(cmds, "put -r "+sftpQuote(local+"/*")+" "+sftpQuote(remote))
+	if err := d.batch(cmds); err != nil {
+		return err
+	}
+	return removeStale(d, local, path)
+}
+
+// sftpQuote quote path for sftp batch command
+func sftpQuote(path string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
+
+// webdavDest is WebDAV server folder destination, e.g. Nextcloud:
+// webdavs://user@cloud.example.com/remote.php/dav/files/user/backup. The
+// password is taken from url or from WEBDAV_PASSWORD environment variable
+type webdavDest struct {
+	base           string // Base url without trailing slash
+	user, password string
+	mu             sync.Mutex      // Guards dirs of parallel uploads
+	dirs           map[string]bool // Already created collections
+}
+
+// newWebDAVDest create WebDAV destination from webdav:// or webdavs:// url
+func newWebDAVDest(u *url.URL) *webdavDest {
+	d := &webdavDest{password: os.Getenv("WEBDAV_PASSWORD"),
+		dirs: map[string]bool{}}
+	if u.User != nil {
+		d.user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			d.password = p
+		}
+	}
+	scheme := "http"
+	if u.Scheme == "webdavs" {
+		scheme = "https"
+	}
+	d.base = scheme + "://" + u.Host + strings.TrimSuffix(u.EscapedPath(), "/")
+	return d
+}
+
+func (d *webdavDest) String() string { return d.base }
+
+// request execute WebDAV request to the path and check response status
+func (d *webdavDest) request(method, path string, body io.Reader,
+	size int64) (int, error) {
+
+	u := d.base + "/" + (&url.URL{Path: path}).EscapedPath()
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	if len(d.user) != 0 {
+		req.SetBasicAuth(d.user, d.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// mkcol create collection and its parents if they have not been created yet
+func (d *webdavDest) mkcol(dir string) error {
+	p := ""
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if len(name) == 0 {
+			continue
+		}
+		p = joinPath(p, name)
+		d.mu.Lock()
+		created := d.dirs[p]
+		d.mu.Unlock()
+		if created {
+			continue
+		}
+		status, err := d.request("MKCOL", p, nil, 0)
+		if err != nil {
+			return err
+		}
+		// 405 Method Not Allowed is returned when collection already exists
+		if status/100 != 2 && status != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %s/%s: %s", d.base, p,
+				http.StatusText(status))
+		}
+		d.mu.Lock()
+		d.dirs[p] = true
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+func (d *webdavDest) putFile(local, path string) error {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		if err := d.mkcol(path[:i]); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	status, err := d.request("PUT", path, f, info.Size())
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("PUT %s/%s: %s", d.base, path, http.StatusText(status))
+	}
+	return nil
+}
+
+func (d *webdavDest) putDir(local, path string) error {
+	if err := d.mkcol(path); err != nil {
+		return err
+	}
+	err := walkFiles(local, func(file, rel string) error {
+		return d.putFile(file, joinPath(path, rel))
+	})
+	if err != nil {
+		return err
+	}
+	return removeStale(d, local, path)
+}
+
+// run execute command and return error with command output if it fails
+func run(name string, args ...string) error {
+	cmd, cancel := command(name, args...)
+	defer cancel()
+	out, err := cmd.CombinedOutput()
+	if err = commandErr(err); err != nil {
+		return fmt.Errorf("%s %s: %s\n%s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
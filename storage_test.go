@@ -0,0 +1,33 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLocalPutDirRemoveStale(t *testing.T) {
+	local := t.TempDir()
+	writeFiles(t, local, "HEAD", "objects/pack/pack-2.pack")
+	dest := localDest(t.TempDir())
+	writeFiles(t, string(dest), "o/a.git/HEAD", "o/a.git/objects/pack/pack-1.pack",
+		"o/a.git.bak/HEAD", "o/b.git/HEAD")
+
+	if err := dest.putDir(local, "o/a.git"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := dest.listFiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	expected := []string{"o/a.git.bak/HEAD", "o/a.git/HEAD",
+		"o/a.git/objects/pack/pack-2.pack", "o/b.git/HEAD"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("destination files %v, expected %v", files, expected)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// systemdUnits is parameters of generated systemd service and timer units
+type systemdUnits struct {
+	name     string   // Units name
+	user     string   // Dedicated service user
+	workdir  string   // Service working and state folder
+	envFile  string   // Environment file with github tokens
+	schedule string   // Timer OnCalendar schedule
+	interval string   // Timer interval used if schedule is not set
+	delay    string   // Timer RandomizedDelaySec
+	exec     string   // Executable absolute path
+	args     []string // Backup parameters
+}
+
+// installSystemdCmd is 'install-systemd' command: write hardened systemd
+// service unit running backup with parameters after -- as dedicated user,
+// and timer matching the configured schedule, then enable the timer
+func installSystemdCmd(args []string) {
+	fs := flag.NewFlagSet("install-systemd", flag.ExitOnError)
+	name := fs.String("name", "github-backup", "service and timer units name")
+	usr := fs.String("user", "github-backup", "dedicated system user running backup, created if not exists")
+	dir := fs.String("dir", "/etc/systemd/system", "systemd units folder")
+	workdir := fs.String("workdir", "/var/lib/github-backup", "service working folder, relative -output is saved here")
+	envFile := fs.String("env-file", "/etc/github-backup.env", "environment file with GH_TOKEN and other secrets")
+	schedule := fs.String("schedule", "", "timer OnCalendar schedule, e.g. daily or *-*-* 03:00, default: -catch-up interval of backup parameters or daily")
+	delay := fs.Duration("random-delay", 0, "timer randomized start delay, e.g. 15m")
+	dryRun := fs.Bool("dry-run", false, "print units but does not install it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup install-systemd [-name name] [-user user] [-schedule calendar] [-dry-run] -- backup parameters")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		logFatal(err)
+	}
+	u := systemdUnits{name: *name, user: *usr, workdir: *workdir,
+		envFile: *envFile, schedule: *schedule, exec: exe, args: fs.Args()}
+	if len(u.schedule) == 0 {
+		u.interval = backupParam(u.args, "catch-up")
+		if _, err := time.ParseDuration(u.interval); err != nil {
+			u.interval, u.schedule = "", "daily"
+		}
+	}
+	if *delay > 0 {
+		u.delay = delay.String()
+	}
+
+	service := filepath.Join(*dir, u.name+".service")
+	timer := filepath.Join(*dir, u.name+".timer")
+	if *dryRun {
+		fmt.Printf("# %s\n%s\n# %s\n%s", service, u.service(), timer, u.timer())
+		return
+	}
+
+	// Create dedicated user with working folder
+	if _, err := user.Lookup(u.user); err != nil {
+		if err := run("useradd", "--system", "--home-dir", u.workdir,
+			"--shell", "/usr/sbin/nologin", u.user); err != nil {
+			logFatal(err)
+		}
+		logInfo("user created: "+u.user, "user", u.user)
+	}
+	if err := os.MkdirAll(u.workdir, 0700); err != nil {
+		logFatal(err)
+	}
+	if err := run("chown", u.user+":", u.workdir); err != nil {
+		logFatal(err)
+	}
+
+	for name, text := range map[string]string{service: u.service(),
+		timer: u.timer()} {
+		if err := os.WriteFile(name, []byte(text), 0644); err != nil {
+			logFatal(err)
+		}
+		logInfo("unit written: "+name, "unit", name)
+	}
+	if err := run("systemctl", "daemon-reload"); err != nil {
+		logFatal(err)
+	}
+	if err := run("systemctl", "enable", "--now", u.name+".timer"); err != nil {
+		logFatal(err)
+	}
+	logInfo(fmt.Sprintf("timer %s.timer enabled, put github tokens to %s",
+		u.name, u.envFile), "unit", u.name+".timer")
+}
+
+// service return service unit text
+func (u systemdUnits) service() string {
+	return fmt.Sprintf(`[Unit]
+Description=GitHub repositories backup
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+User=%[1]s
+Group=%[1]s
+WorkingDirectory=%[2]s
+EnvironmentFile=-%[3]s
+ExecStart=%[4]s
+UMask=0077
+
+# Sandboxing
+ReadWritePaths=%[2]s
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+PrivateDevices=yes
+NoNewPrivileges=yes
+CapabilityBoundingSet=
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6
+LockPersonality=yes
+SystemCallArchitectures=native
+`, u.user, u.workdir, u.envFile, systemdCommand(u.exec, u.args))
+}
+
+// timer return timer unit text
+func (u systemdUnits) timer() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=Run %s.service on schedule\n\n", u.name)
+	b.WriteString("[Timer]\n")
+	if len(u.schedule) != 0 {
+		fmt.Fprintf(&b, "OnCalendar=%s\nPersistent=true\n", u.schedule)
+	} else {
+		fmt.Fprintf(&b, "OnBootSec=5min\nOnUnitActiveSec=%s\n", u.interval)
+	}
+	if len(u.delay) != 0 {
+		fmt.Fprintf(&b, "RandomizedDelaySec=%s\n", u.delay)
+	}
+	b.WriteString("\n[Install]\nWantedBy=timers.target\n")
+	return b.String()
+}
+
+// backupParam return value of backup parameter -name=value or -name value
+// from parameters list, or empty string if it is not set
+func backupParam(args []string, name string) string {
+	for i, a := range args {
+		a = strings.TrimLeft(a, "-")
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// systemdCommand return ExecStart command line with quoted arguments and
+// escaped systemd specifiers
+func systemdCommand(exe string, args []string) string {
+	words := []string{exe}
+	for _, a := range args {
+		a = strings.NewReplacer("%", "%%", "$", "$$", `\`, `\\`,
+			`"`, `\"`).Replace(a)
+		if strings.ContainsAny(a, " \t;'") {
+			a = `"` + a + `"`
+		}
+		words = append(words, a)
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Maximum time of one repository backup set by -repo-timeout parameter, and
+// deadline of currently processed repository
+var repoTimeout time.Duration
+var repoDeadline time.Time
+
+// errRepoTimeout is returned when repository backup exceeds -repo-timeout
+var errRepoTimeout = fmt.Errorf("repository backup timeout exceeded")
+
+// startRepoTimeout set deadline of repository backup and return function
+// which clears it
+func startRepoTimeout() func() {
+	if repoTimeout <= 0 {
+		return func() {}
+	}
+	repoDeadline = time.Now().Add(repoTimeout)
+	return func() { repoDeadline = time.Time{} }
+}
+
+// repoTimedOut return true if deadline of repository backup is exceeded
+func repoTimedOut() bool {
+	return !repoDeadline.IsZero() && time.Now().After(repoDeadline)
+}
+
+// command create command which is killed at deadline of currently processed
+// repository, so hung git process does not stall the whole run. The returned
+// cancel function should be called after command finished
+func command(name string, args ...string) (*exec.Cmd, context.CancelFunc) {
+	if repoDeadline.IsZero() {
+		return exec.Command(name, args...), func() {}
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), repoDeadline)
+	return exec.CommandContext(ctx, name, args...), cancel
+}
+
+// commandErr return errRepoTimeout if command was killed at repository
+// deadline, or err
+func commandErr(err error) error {
+	if err != nil && repoTimedOut() {
+		return fmt.Errorf("%w: killed after %s", errRepoTimeout, repoTimeout)
+	}
+	return err
+}
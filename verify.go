@@ -0,0 +1,118 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// verifyCmd is 'verify' command: run git fsck across all mirrors in output
+// folder in parallel and report corrupted repositories
+func verifyCmd(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	output := fs.String("output", "repos", "local folder name with saved repositories")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "number of mirrors checked in parallel")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup verify [-output folder] [-jobs n]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	mirrors, err := findMirrors(*output)
+	if err != nil {
+		logFatal(err)
+	}
+	if len(mirrors) == 0 {
+		logFatal(fmt.Sprintf("no mirrors found in %s", *output))
+	}
+
+	errs := verifyMirrors(mirrors, *jobs)
+	var corrupted []string
+	for _, mirror := range mirrors {
+		if err := errs[mirror]; err != nil {
+			corrupted = append(corrupted, mirror)
+			fmt.Printf("%s: corrupted\n%s\n", mirror, err)
+			continue
+		}
+		fmt.Printf("%s: ok\n", mirror)
+	}
+	fmt.Printf("verified %d mirrors, %d corrupted\n", len(mirrors),
+		len(corrupted))
+
+	// Re-verify release assets against recorded sizes and digests
+	n, assetErrs := verifyAssets(*output)
+	for _, err := range assetErrs {
+		fmt.Printf("%s: corrupted\n", err)
+	}
+	if n != 0 || len(assetErrs) != 0 {
+		fmt.Printf("verified %d release assets, %d corrupted\n", n,
+			len(assetErrs))
+	}
+	if len(corrupted) != 0 || len(assetErrs) != 0 {
+		os.Exit(1)
+	}
+}
+
+// findMirrors return sorted list of git mirrors (folders with .git suffix and
+// HEAD file) in output folder and its subfolders
+func findMirrors(output string) (mirrors []string, err error) {
+	err = filepath.Walk(output, func(path string, info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+			return nil
+		}
+		mirrors = append(mirrors, path)
+		return filepath.SkipDir
+	})
+	sort.Strings(mirrors)
+	return
+}
+
+// verifyMirrors check mirrors with git fsck using jobs parallel workers and
+// return errors of corrupted mirrors
+func verifyMirrors(mirrors []string, jobs int) map[string]error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs := map[string]error{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ch := make(chan string)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mirror := range ch {
+				err := run("git", "-C", mirror, "fsck", "--full",
+					"--no-progress", "--no-dangling")
+				if err != nil {
+					mu.Lock()
+					errs[mirror] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, mirror := range mirrors {
+		ch <- mirror
+	}
+	close(ch)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,39 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "runtime/debug"
+
+// Application version, may be set on build:
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+//
+// If it is not set the module version from build info is used
+var version = ""
+
+// appVersion return application version
+func appVersion() string {
+	if len(version) != 0 {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// Operator tag added to user agent, set by -user-agent-tag parameter
+var userAgentTag string
+
+// userAgent return User-Agent header value sent in all github api requests:
+// github-backup/version (+project-url) [operator-tag]
+func userAgent() string {
+	ua := "github-backup/" + appVersion() +
+		" (+https://github.com/kirill-scherba/github-backup)"
+	if len(userAgentTag) != 0 {
+		ua += " " + userAgentTag
+	}
+	return ua
+}
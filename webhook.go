@@ -0,0 +1,210 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Github webhook events which trigger repository backup
+var webhookEvents = map[string]bool{"push": true, "create": true,
+	"delete": true, "release": true, "repository": true}
+
+// webhookReceiver receives github webhooks and backs up affected repositories
+type webhookReceiver struct {
+	args   []string // Backup parameters
+	users  []string // Accounts of backup parameters, all accepted if empty
+	secret string   // Webhook secret
+
+	mu      sync.Mutex
+	queue   []webhookRepo
+	pending map[string]bool // Repositories in queue
+	wake    chan struct{}
+}
+
+// webhookRepo is repository to backup and account it belongs to
+type webhookRepo struct {
+	user, repo string
+}
+
+// serveWebhookCmd is 'serve-webhook' command: listen for github push, create,
+// delete, release and repository webhooks, validate webhooks signature and
+// immediately backup affected repository with backup parameters after --,
+// so the backup is near-real-time instead of hours stale
+func serveWebhookCmd(args []string) {
+	fs := flag.NewFlagSet("serve-webhook", flag.ExitOnError)
+	listen := fs.String("listen", ":8091", "webhooks listen address")
+	secret := fs.String("secret", os.Getenv("GITHUB_WEBHOOK_SECRET"), "webhook secret, default: GITHUB_WEBHOOK_SECRET environment variable")
+	insecure := fs.Bool("insecure", false, "accept webhooks without signature validation, any request may trigger backups")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: github-backup serve-webhook [-listen addr] [-secret secret | -insecure] -- backup parameters")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*secret) == 0 && !*insecure {
+		fmt.Fprintln(fs.Output(), "webhook secret is not set, set -secret or GITHUB_WEBHOOK_SECRET, or -insecure to accept webhooks without validation")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	w := &webhookReceiver{args: fs.Args(), secret: *secret,
+		pending: map[string]bool{}, wake: make(chan struct{}, 1)}
+	for _, u := range strings.Split(backupParam(w.args, "users"), ",") {
+		if u = strings.TrimSpace(u); len(u) != 0 {
+			w.users = append(w.users, u)
+		}
+	}
+	if len(w.secret) == 0 {
+		logWarn("-insecure is set, webhooks are not validated")
+	}
+	go w.worker()
+	logInfo("receive github webhooks on "+*listen, "listen", *listen)
+	logFatal(http.ListenAndServe(*listen, w))
+}
+
+// ServeHTTP receive github webhook and queue backup of affected repository
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 25*1024*1024))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validSignature(w.secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(rw, "wrong signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "ping" {
+		fmt.Fprintln(rw, "pong")
+		return
+	}
+	if !webhookEvents[event] {
+		fmt.Fprintln(rw, "event is ignored")
+		return
+	}
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil ||
+		len(payload.Repository.FullName) == 0 {
+		http.Error(rw, "repository is not set", http.StatusBadRequest)
+		return
+	}
+	repo := payload.Repository.FullName
+	user, ok := w.account(repo)
+	if !ok {
+		logInfo(fmt.Sprintf("webhook: %s %s: owner is not backed up, ignored",
+			event, repo), append(repoFields(repo), "event", event)...)
+		fmt.Fprintln(rw, "repository owner is not backed up")
+		return
+	}
+	logInfo(fmt.Sprintf("webhook: %s %s", event, repo),
+		append(repoFields(repo), "event", event)...)
+	w.enqueue(webhookRepo{user, repo})
+	rw.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(rw, "backup queued")
+}
+
+// validSignature check webhook body HMAC-SHA256 signature header
+// sha256=<hex> made with webhook secret. Any body is valid without secret
+func validSignature(secret string, body []byte, signature string) bool {
+	if len(secret) == 0 {
+		return true
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// account return account of backup parameters owning repository
+func (w *webhookReceiver) account(repo string) (string, bool) {
+	owner, _, _ := strings.Cut(repo, "/")
+	if len(w.users) == 0 {
+		return owner, true
+	}
+	for _, u := range w.users {
+		if strings.EqualFold(path.Base(u), owner) {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// enqueue add repository to backup queue if it is not queued already
+func (w *webhookReceiver) enqueue(r webhookRepo) {
+	w.mu.Lock()
+	if !w.pending[r.repo] {
+		w.pending[r.repo] = true
+		w.queue = append(w.queue, r)
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// worker backup queued repositories one by one. Each backup runs as child
+// process with backup parameters limited to the repository, which waits for
+// output folder lock held by other runs
+func (w *webhookReceiver) worker() {
+	exe, err := os.Executable()
+	if err != nil {
+		logFatal(err)
+	}
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.mu.Unlock()
+				break
+			}
+			r := w.queue[0]
+			w.queue = w.queue[1:]
+			delete(w.pending, r.repo)
+			w.mu.Unlock()
+
+			start := time.Now()
+			args := append(append([]string{}, w.args...), "-users="+r.user,
+				"-limit="+r.repo, "-lock=wait")
+			cmd := exec.Command(exe, args...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			err := cmd.Run()
+			fields := append(repoFields(r.repo), "duration", time.Since(start))
+			if err != nil {
+				logWarn(fmt.Sprintf("webhook: %s backup failed in %s: %s", r.repo,
+					time.Since(start).Round(time.Second), err),
+					append(fields, "error", err)...)
+				continue
+			}
+			logInfo(fmt.Sprintf("webhook: %s backup done in %s", r.repo,
+				time.Since(start).Round(time.Second)), fields...)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Kirill Scherba <kirill@scherba.ru>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Workflow runs logs backup limit: empty - disabled, 'all', number of last
+// runs or number of days with 'd' suffix
+var workflowLogs string
+
+// Workflow runs backup limits parsed from workflowLogs, 0 - not limited
+var workflowRuns, workflowDays int
+
+// workflowRun is completed workflow run in github api response
+type workflowRun struct {
+	ID      int64     `json:"id"`
+	Attempt int       `json:"run_attempt"`
+	Updated time.Time `json:"updated_at"`
+}
+
+// parseWorkflowLogs parse workflow runs logs backup limit: all runs, last n
+// runs or runs of last n days (nd)
+func parseWorkflowLogs(s string) (runs, days int, err error) {
+	if len(s) == 0 || s == "all" {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("wrong workflow logs limit '%s', should be "+
+			"all, number of runs or number of days, e.g. 30d", s)
+	}
+	if strings.HasSuffix(s, "d") {
+		return 0, n, nil
+	}
+	return n, 0, nil
+}
+
+// workflowsStage backup completed GitHub Actions workflow runs of repository
+// to owner/repo.workflows/<run_id> folders: run metadata to run.json and run
+// logs archive to logs.zip. Github purges runs and logs after retention
+// period, so saved runs are kept when they disappear upstream, and runs
+// already saved are not downloaded again until re-run
+func workflowsStage(j *pipelineJob) error {
+	folder := j.path + ".workflows"
+	dir := filepath.Join(j.dir, filepath.FromSlash(folder))
+	api := newAPIClient(j.acc.endpoint)
+	endpoint := "/repos/" + j.repo + "/actions/runs?status=completed&per_page=100"
+	if workflowDays != 0 {
+		endpoint += "&created=%3E%3D" + time.Now().UTC().
+			AddDate(0, 0, -workflowDays).Format("2006-01-02")
+	}
+
+	var saved, expired int
+	var failed []string
+	for p := 1; ; p++ {
+		var page []json.RawMessage
+		var data map[string]json.RawMessage
+		if err := api.get(fmt.Sprintf("%s&page=%d", endpoint, p),
+			&data); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data["workflow_runs"], &page); err != nil {
+			return err
+		}
+		for _, raw := range page {
+			if workflowRuns != 0 && saved+expired+len(failed) >= workflowRuns {
+				break
+			}
+			var run workflowRun
+			if err := json.Unmarshal(raw, &run); err != nil {
+				return err
+			}
+			gone, err := backupWorkflowRun(api, j.repo, dir, run, raw)
+			switch {
+			case err != nil:
+				failed = append(failed, fmt.Sprintf("%d: %s", run.ID,
+					firstLine(err.Error())))
+			case gone:
+				expired++
+			default:
+				saved++
+			}
+		}
+		if len(page) < 100 ||
+			(workflowRuns != 0 && saved+expired+len(failed) >= workflowRuns) {
+			break
+		}
+	}
+	if expired != 0 {
+		logInfo(fmt.Sprintf("%s: logs of %d workflow runs are expired, only "+
+			"runs metadata saved", j.repo, expired), repoFields(j.repo)...)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		j.addPrivate(folder)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d workflow runs failed:\n%s", len(failed),
+			strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// backupWorkflowRun save workflow run metadata and logs archive to run
+// folder. Returns true if logs are expired or deleted upstream and only
+// metadata is saved
+func backupWorkflowRun(api *apiClient, repo, dir string, run workflowRun,
+	raw json.RawMessage) (gone bool, err error) {
+
+	runDir := filepath.Join(dir, strconv.FormatInt(run.ID, 10))
+	logs := filepath.Join(runDir, "logs.zip")
+	if prev, err := readWorkflowRun(runDir); err == nil &&
+		prev.Attempt == run.Attempt && prev.Updated.Equal(run.Updated) {
+		_, err := os.Stat(logs)
+		return err != nil, nil
+	}
+
+	err = api.download(fmt.Sprintf("/repos/%s/actions/runs/%d/logs", repo,
+		run.ID), logs)
+	var e *apiError
+	if errors.As(err, &e) && (e.code == http.StatusGone ||
+		e.code == http.StatusNotFound) {
+		gone, err = true, nil
+	}
+	if err != nil {
+		return
+	}
+	err = writeJSON(filepath.Join(runDir, "run.json"), raw)
+	return
+}
+
+// readWorkflowRun read saved workflow run metadata of run folder
+func readWorkflowRun(runDir string) (run workflowRun, err error) {
+	data, err := os.ReadFile(filepath.Join(runDir, "run.json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &run)
+	return
+}